@@ -0,0 +1,28 @@
+package minidb
+
+import (
+	"strings"
+)
+
+var aggregateFunctions = map[string]bool{
+	"MIN": true,
+	"MAX": true,
+}
+
+func isAggregateName(tok string) bool {
+	return aggregateFunctions[strings.ToUpper(tok)]
+}
+
+// parseAggregate splits a select item like "MAX(age)" into its function and
+// column.
+func parseAggregate(item string) (string, string, bool) {
+	open := strings.IndexByte(item, '(')
+	if open <= 0 || !strings.HasSuffix(item, ")") {
+		return "", "", false
+	}
+	fn := strings.ToUpper(item[:open])
+	if !aggregateFunctions[fn] {
+		return "", "", false
+	}
+	return fn, strings.TrimSpace(item[open+1 : len(item)-1]), true
+}
@@ -0,0 +1,427 @@
+package minidb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupVersion is the format version of a backup's manifest.
+const backupVersion = 1
+
+const backupManifest = "manifest.json"
+
+// A backup is a directory holding a copy of the data file and log
+// segments with the commits made after it, listed in manifest.json with
+// their checksums. An incremental backup adds one more segment, starting
+// right after the last commit the backup held.
+type backupInfo struct {
+	Version  int          `json:"version"`
+	Database string       `json:"database"`
+	Files    []backupFile `json:"files"`
+}
+
+// backupFile is one file of a backup. A data file holds every commit up
+// to LSN; a log segment holds those from From to LSN.
+type backupFile struct {
+	Name    string    `json:"name"`
+	Kind    string    `json:"kind"`
+	From    uint64    `json:"from,omitempty"`
+	LSN     uint64    `json:"lsn"`
+	Size    int64     `json:"size"`
+	CRC     uint32    `json:"crc"`
+	Created time.Time `json:"created"`
+}
+
+const (
+	backupData = "data"
+	backupLog  = "log"
+)
+
+// lsn returns the last commit the backup holds.
+func (b *backupInfo) lsn() uint64 {
+	if len(b.Files) == 0 {
+		return 0
+	}
+	return b.Files[len(b.Files)-1].LSN
+}
+
+// archivePath is the directory a WALStorage keeps checkpointed logs in.
+func archivePath(base string) string {
+	return base + ".archive"
+}
+
+// backupDatabase backs up the WAL database whose files are base.db and
+// base.wal into dir, or with incremental adds the commits made since the
+// backup already in dir. It needs no lock: the log is read before the
+// data file, so a checkpoint running meanwhile only makes the data file
+// newer than the log, the same as for a read-only attach. It returns the
+// manifest and how many files it added.
+func backupDatabase(fs fileSystem, base, dir string, incremental bool) (*backupInfo, int, error) {
+	info, err := readBackupInfo(dir)
+	switch {
+	case incremental && err != nil:
+		return nil, 0, err
+	case !incremental && err == nil:
+		return nil, 0, fmt.Errorf("%s already holds a backup; add to it with INCREMENTAL or use another directory", dir)
+	case !incremental:
+		info = &backupInfo{Version: backupVersion, Database: filepath.Base(base)}
+	case info.Database != filepath.Base(base):
+		return nil, 0, fmt.Errorf("%s holds a backup of database %s", dir, info.Database)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	records, err := readWAL(base + ".wal")
+	if err != nil {
+		return nil, 0, err
+	}
+	df, err := openDataFile(base+".db", 1)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	var dataLSN uint64
+	if df != nil {
+		defer df.close()
+		if _, dataLSN, err = df.readCatalog(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	from := info.lsn()
+	added := len(info.Files)
+	if !incremental && df != nil {
+		file, err := copyDataFile(fs, df, dir, dataLSN)
+		if err != nil {
+			return nil, 0, err
+		}
+		info.Files = append(info.Files, *file)
+		from = dataLSN
+	}
+
+	// Commits the backup lacks may be only in archived logs by now
+	start := dataLSN + 1
+	if len(records) > 0 {
+		start = records[0].LSN
+	}
+	if start > from+1 {
+		archived, err := readArchive(archivePath(base), from)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(archived, records...)
+	}
+
+	// An archived log may overlap the live one if a checkpoint failed
+	// after archiving it, so take each commit once, in order
+	var segment []walRecord
+	last := max(dataLSN, from)
+	for _, record := range records {
+		if record.LSN == from+uint64(len(segment))+1 {
+			segment = append(segment, record)
+		}
+		last = max(last, record.LSN)
+	}
+	if from+uint64(len(segment)) < last {
+		return nil, 0, fmt.Errorf("the log no longer reaches back to commit %d; take a full backup, or keep logs with -wal-archive", from+1)
+	}
+
+	if len(segment) > 0 {
+		file, err := writeLogSegment(fs, dir, segment)
+		if err != nil {
+			return nil, 0, err
+		}
+		info.Files = append(info.Files, *file)
+	}
+	added = len(info.Files) - added
+	if added > 0 {
+		if err := writeBackupInfo(fs, dir, info); err != nil {
+			return nil, 0, err
+		}
+	}
+	return info, added, nil
+}
+
+func copyDataFile(fs fileSystem, df *dataFile, dir string, lsn uint64) (*backupFile, error) {
+	file := &backupFile{Name: "data.db", Kind: backupData, LSN: lsn, Size: df.size(), Created: time.Now().UTC()}
+	err := replaceFile(fs, filepath.Join(dir, file.Name), func(w io.Writer) error {
+		hash := crc32.New(walCRC)
+		if _, err := io.Copy(io.MultiWriter(w, hash), io.NewSectionReader(df.file, 0, df.size())); err != nil {
+			return err
+		}
+		file.CRC = hash.Sum32()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func writeLogSegment(fs fileSystem, dir string, records []walRecord) (*backupFile, error) {
+	first, last := records[0].LSN, records[len(records)-1].LSN
+	file := &backupFile{Name: fmt.Sprintf("log-%016x.wal", first), Kind: backupLog, From: first, LSN: last, Created: time.Now().UTC()}
+	var data []byte
+	for _, record := range records {
+		frame, err := encodeFrame(record)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, frame...)
+	}
+	file.Size, file.CRC = int64(len(data)), crc32.Checksum(data, walCRC)
+	err := replaceFile(fs, filepath.Join(dir, file.Name), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// readArchive returns the archived log records after lsn, oldest first.
+func readArchive(dir string, lsn uint64) ([]walRecord, error) {
+	logs, err := archived(dir, ".wal")
+	if err != nil {
+		return nil, err
+	}
+	var records []walRecord
+	for _, file := range logs {
+		segment, err := readWAL(file.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range segment {
+			if record.LSN > lsn {
+				records = append(records, record)
+			}
+		}
+	}
+	return records, nil
+}
+
+func readBackupInfo(dir string) (*backupInfo, error) {
+	data, err := os.ReadFile(filepath.Join(dir, backupManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no backup in %s", dir)
+		}
+		return nil, fmt.Errorf("failed to read backup: %v", err)
+	}
+	var info backupInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("backup in %s is corrupt: %v", dir, err)
+	}
+	if info.Version > backupVersion {
+		return nil, fmt.Errorf("backup in %s has format version %d; this build reads up to %d", dir, info.Version, backupVersion)
+	}
+	return &info, nil
+}
+
+func writeBackupInfo(fs fileSystem, dir string, info *backupInfo) error {
+	body, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replaceFile(fs, filepath.Join(dir, backupManifest), func(w io.Writer) error {
+		_, err := w.Write(append(body, '\n'))
+		return err
+	})
+}
+
+// verifyBackup checks every file of the backup in dir against its
+// checksum, every page of the data file, and that the log segments follow
+// on from each other. It returns the manifest and the log records.
+func verifyBackup(dir string) (*backupInfo, []walRecord, error) {
+	info, err := readBackupInfo(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(info.Files) == 0 {
+		return nil, nil, fmt.Errorf("backup in %s is empty", dir)
+	}
+
+	var records []walRecord
+	var lsn uint64
+	for i, file := range info.Files {
+		path := filepath.Join(dir, file.Name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup file %s: %v", file.Name, err)
+		}
+		if int64(len(data)) != file.Size || crc32.Checksum(data, walCRC) != file.CRC {
+			return nil, nil, fmt.Errorf("backup file %s is corrupt: checksum mismatch", file.Name)
+		}
+
+		switch {
+		case file.Kind == backupData && i == 0:
+			if err := verifyDataFile(path, file.LSN); err != nil {
+				return nil, nil, fmt.Errorf("backup file %s: %v", file.Name, err)
+			}
+		case file.Kind == backupLog:
+			segment, valid := decodeWAL(data)
+			if valid != int64(len(data)) || len(segment) == 0 {
+				return nil, nil, fmt.Errorf("backup file %s is corrupt: bad log frame", file.Name)
+			}
+			for j, record := range segment {
+				if record.LSN != file.From+uint64(j) {
+					return nil, nil, fmt.Errorf("backup file %s is corrupt: commits out of order", file.Name)
+				}
+			}
+			if file.From != lsn+1 || segment[len(segment)-1].LSN != file.LSN {
+				return nil, nil, fmt.Errorf("backup file %s does not follow on from commit %d", file.Name, lsn)
+			}
+			records = append(records, segment...)
+		default:
+			return nil, nil, fmt.Errorf("backup file %s has unexpected kind %q", file.Name, file.Kind)
+		}
+		lsn = file.LSN
+	}
+	return info, records, nil
+}
+
+// verifyDataFile reads every page of a data file, checking its checksum.
+func verifyDataFile(path string, lsn uint64) error {
+	df, err := openDataFile(path, 1)
+	if err != nil {
+		return err
+	}
+	defer df.close()
+	for id := 0; id < df.pages; id++ {
+		if _, err := df.readPage(pageID(id)); err != nil {
+			return err
+		}
+	}
+	_, got, err := df.readCatalog()
+	if err != nil {
+		return err
+	}
+	if got != lsn {
+		return errors.New("data file does not match the manifest")
+	}
+	return nil
+}
+
+// Backup backs up the WAL database whose files start with path into dir,
+// or with incremental adds the commits made since the backup already
+// there, as BACKUP does. It works while another process has the database
+// open. It returns the last commit the backup holds and how many files it
+// added, none if the backup was up to date.
+func Backup(path, dir string, incremental bool) (uint64, int, error) {
+	info, added, err := backupDatabase(osFS{}, path, dir, incremental)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.lsn(), added, nil
+}
+
+// Restore restores the backup in dir into the data directory dataDir, as
+// the database it was taken of or as name when set, and returns the name
+// and the last commit restored. Unless at is zero, only the commits
+// logged by then are restored. No process may have the database open; an
+// Instance restores its own databases with Instance.Restore.
+func Restore(dir, dataDir, name string, at time.Time) (string, uint64, error) {
+	info, err := readBackupInfo(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	if name == "" {
+		name = info.Database
+	}
+	if !databaseName.MatchString(name) {
+		return "", 0, fmt.Errorf("invalid database name %q", name)
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return "", 0, err
+	}
+	lsn, err := restoreDatabase(osFS{}, dir, filepath.Join(dataDir, name), at)
+	return name, lsn, err
+}
+
+// restoreDatabase replaces the files of the WAL database at base with the
+// backup in dir, after verifying all of it. The database must not be open.
+// Checkpointed logs of the replaced database are removed, since they
+// belong to a history the restored database no longer shares. The backup
+// is only read, so an interrupted restore can simply be run again. Unless
+// at is zero, only the commits logged by then are restored. It returns the
+// last commit restored.
+func restoreDatabase(fs fileSystem, dir, base string, at time.Time) (uint64, error) {
+	info, records, err := verifyBackup(dir)
+	if err != nil {
+		return 0, err
+	}
+	var lsn uint64
+	if info.Files[0].Kind == backupData {
+		lsn = info.Files[0].LSN
+	}
+	if !at.IsZero() {
+		if lsn > 0 {
+			b, err := readBase(filepath.Join(dir, info.Files[0].Name))
+			if err != nil {
+				return 0, err
+			}
+			if b.time.After(at) {
+				return 0, fmt.Errorf("the backup in %s starts at %s, after %s", dir, b.time.Local().Format(timestampLayout), at.Local().Format(timestampLayout))
+			}
+		}
+		n := 0
+		for n < len(records) && !records[n].Time.After(at) {
+			n++
+		}
+		records = records[:n]
+	}
+	if len(records) > 0 {
+		lsn = records[len(records)-1].LSN
+	}
+
+	lock, err := lockDatabase(base + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer lock.unlock()
+
+	var log []byte
+	for _, record := range records {
+		frame, err := encodeFrame(record)
+		if err != nil {
+			return 0, err
+		}
+		log = append(log, frame...)
+	}
+	if err := replaceFile(fs, base+".wal", func(w io.Writer) error {
+		_, err := w.Write(log)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	if info.Files[0].Kind == backupData {
+		data, err := os.Open(filepath.Join(dir, info.Files[0].Name))
+		if err != nil {
+			return 0, err
+		}
+		defer data.Close()
+		if err := replaceFile(fs, base+".db", func(w io.Writer) error {
+			_, err := io.Copy(w, data)
+			return err
+		}); err != nil {
+			return 0, err
+		}
+	} else if err := os.Remove(base + ".db"); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	for _, path := range []string{base + ".json", archivePath(base)} {
+		if err := os.RemoveAll(path); err != nil {
+			return 0, fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+	}
+	return lsn, nil
+}
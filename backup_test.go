@@ -0,0 +1,110 @@
+package minidb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// backupTestInstance returns a session on the database shop of a WAL
+// instance in dir, holding a few rows.
+func backupTestInstance(t *testing.T, dir string) (*Instance, *Session) {
+	t.Helper()
+	instance, err := NewInstance(dir, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { instance.Close() })
+	if _, err := instance.Open("shop"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := instance.NewSession("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	sessionExec(t, s, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+	sessionExec(t, s, "INSERT INTO items (id, name) VALUES (1, 'a')")
+	db, err := instance.Database("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	sessionExec(t, s, "INSERT INTO items (id, name) VALUES (2, 'b')")
+	return instance, s
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	_, s := backupTestInstance(t, t.TempDir())
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	sessionExec(t, s, "BACKUP TO '"+dir+"'")
+	full, err := readBackupInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionExec(t, s, "UPDATE items SET name = 'c' WHERE id = 1")
+	sessionExec(t, s, "INSERT INTO items (id, name) VALUES (3, 'd')")
+	sessionExec(t, s, "BACKUP TO '"+dir+"' INCREMENTAL")
+
+	info, err := readBackupInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Files) != len(full.Files)+1 || info.Files[len(info.Files)-1].Kind != backupLog {
+		t.Fatalf("incremental backup left %v, want one log segment added to %v", info.Files, full.Files)
+	}
+	if last := info.Files[len(info.Files)-1]; last.From != full.lsn()+1 {
+		t.Errorf("segment starts at commit %d, want %d", last.From, full.lsn()+1)
+	}
+
+	// Restoring as a new database leaves the one backed up alone
+	want := sessionContents(t, s, "SELECT * FROM items ORDER BY id")
+	sessionExec(t, s, "INSERT INTO items (id, name) VALUES (4, 'e')")
+	sessionExec(t, s, "RESTORE FROM '"+dir+"' AS shop_copy")
+	if got := sessionContents(t, s, "SELECT * FROM shop_copy.items ORDER BY id"); got != want {
+		t.Errorf("shop_copy holds %s, want %s", got, want)
+	}
+	if got := sessionContents(t, s, "SELECT * FROM items ORDER BY id"); got != want+"(4 e)" {
+		t.Errorf("shop holds %s after restoring a copy, want %s", got, want+"(4 e)")
+	}
+}
+
+func TestCorruptBackup(t *testing.T) {
+	_, s := backupTestInstance(t, t.TempDir())
+	dir := filepath.Join(t.TempDir(), "backup")
+	sessionExec(t, s, "BACKUP TO '"+dir+"'")
+
+	info, err := readBackupInfo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range info.Files {
+		t.Run(file.Kind, func(t *testing.T) {
+			path := filepath.Join(dir, file.Name)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := append([]byte(nil), data...)
+			damaged[len(damaged)/2] ^= 0xff
+			if err := os.WriteFile(path, damaged, 0644); err != nil {
+				t.Fatal(err)
+			}
+			defer os.WriteFile(path, data, 0644)
+
+			_, err = s.Exec("RESTORE FROM '" + dir + "' AS shop_copy")
+			if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Fatalf("restoring a damaged %s file: got %v, want a checksum mismatch", file.Kind, err)
+			}
+			if _, err := s.Exec("SELECT * FROM shop_copy.items"); err == nil {
+				t.Error("a failed restore created shop_copy")
+			}
+		})
+	}
+	sessionExec(t, s, "RESTORE FROM '"+dir+"' AS shop_copy")
+}
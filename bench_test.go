@@ -0,0 +1,112 @@
+package minidb
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// benchRows is how many rows the scan benchmarks hold in memory.
+const benchRows = 200000
+
+// benchQuery is the scan the benchmarks time; about one row in twenty
+// matches.
+const benchQuery = "SELECT * FROM bench WHERE qty = 7 AND score > 50"
+
+// BenchmarkScanRowMaps and BenchmarkScanTuples compare the two ways of
+// holding the rows of a table in memory: a Row map per row, as tables
+// used to keep them, and a rowTuple per row, as they do now. Each reports
+// the heap a row takes, as heap-B/row, and times a sequential scan through
+// benchQuery. Both scans return the rows they keep as Row maps, as a
+// seqScanNode does.
+func BenchmarkScanRowMaps(b *testing.B) {
+	t, snap, where := benchTable(b, benchTuples())
+	var rows []Row
+	heap := heapPerRow(func() {
+		rows = make([]Row, benchRows)
+		for i := range rows {
+			rows[i] = Row{"id": i, "name": fmt.Sprintf("item %d", i), "score": float64(i % 100), "qty": i % 10}
+		}
+	})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		kept := make([]Row, 0)
+		for i, row := range rows {
+			if !t.visible(snap, i) {
+				continue
+			}
+			if ok, err := t.matchesWhere(row, where); err != nil {
+				b.Fatal(err)
+			} else if ok {
+				kept = append(kept, row)
+			}
+		}
+	}
+	b.ReportMetric(heap, "heap-B/row")
+	runtime.KeepAlive(rows)
+}
+
+func BenchmarkScanTuples(b *testing.B) {
+	var tuples []rowTuple
+	heap := heapPerRow(func() { tuples = benchTuples() })
+	t, snap, where := benchTable(b, tuples)
+
+	filter, err := t.compile(where)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := runPlan(&seqScanNode{ctx: context.Background(), table: t, snap: snap, filter: filter}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(heap, "heap-B/row")
+}
+
+func benchTuples() []rowTuple {
+	tuples := make([]rowTuple, benchRows)
+	for i := range tuples {
+		tuples[i] = rowTuple{i, fmt.Sprintf("item %d", i), float64(i % 100), i % 10}
+	}
+	return tuples
+}
+
+// benchTable returns a table holding tuples, a snapshot to scan it under,
+// and the WHERE clause of benchQuery.
+func benchTable(b *testing.B, tuples []rowTuple) (*Table, snapshot, *WhereClause) {
+	db := NewDB(WithStorage(NewMemoryStorage()))
+	if err := db.Load(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE bench (id INT PRIMARY KEY, name STRING, score FLOAT, qty INT)"); err != nil {
+		b.Fatal(err)
+	}
+	stmt, err := Parse(benchQuery)
+	if err != nil {
+		b.Fatal(err)
+	}
+	t := db.tables["bench"]
+	if err := t.restore(tuples, nil, nil); err != nil {
+		b.Fatal(err)
+	}
+	tx := db.Begin()
+	b.Cleanup(func() { tx.Rollback() })
+	return t, tx.snapshot(), stmt.(*SelectStmt).Where
+}
+
+// heapPerRow returns how much live heap build leaves behind per row.
+func heapPerRow(build func()) float64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return float64(after.HeapAlloc-before.HeapAlloc) / benchRows
+}
@@ -0,0 +1,85 @@
+package minidb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// prepare binds args to the ? placeholders of query and parses it.
+func prepare(query string, args []interface{}) (Statement, error) {
+	if len(args) > 0 {
+		bound, err := bind(query, args)
+		if err != nil {
+			return nil, err
+		}
+		query = bound
+	}
+	return Parse(query)
+}
+
+// bind replaces each ? outside quotes in query with the next of args,
+// written as a SQL literal.
+func bind(query string, args []interface{}) (string, error) {
+	var b strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			// A doubled quote closes and reopens the literal, which
+			// leaves it open
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '?':
+			if n < len(args) {
+				literal, err := sqlLiteral(args[n])
+				if err != nil {
+					return "", fmt.Errorf("argument %d: %v", n+1, err)
+				}
+				b.WriteString(literal)
+			}
+			n++
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	if n != len(args) {
+		return "", fmt.Errorf("query has %d placeholder(s) but %d argument(s) were given", n, len(args))
+	}
+	return b.String(), nil
+}
+
+// sqlLiteral formats a value as a SQL literal, quoting and escaping
+// strings. A float64 is always written as a FLOAT, whole or not. Values of
+// other types, and floats no column can hold, are errors.
+func sqlLiteral(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "NULL", nil
+	case int:
+		return strconv.Itoa(val), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case int32:
+		return strconv.FormatInt(int64(val), 10), nil
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return "", fmt.Errorf("%v is not a number a FLOAT column can hold", val)
+		}
+		s := strconv.FormatFloat(val, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".en") {
+			s += ".0"
+		}
+		return s, nil
+	case string:
+		return "'" + strings.ReplaceAll(val, "'", "''") + "'", nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", v)
+	}
+}
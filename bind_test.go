@@ -0,0 +1,84 @@
+package minidb
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBindNull(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE tasks (id INT PRIMARY KEY, title STRING, priority INT)")
+	mustExec(t, db, "INSERT INTO tasks (id, title, priority) VALUES (?, ?, ?)", 1, nil, nil)
+	mustExec(t, db, "INSERT INTO tasks (id, title, priority) VALUES (2, NULL, null)")
+	mustExec(t, db, "INSERT INTO tasks (id, title, priority) VALUES (?, ?, ?)", 3, "NULL", 5)
+	mustExec(t, db, "UPDATE tasks SET priority = ? WHERE id = ?", nil, 3)
+
+	want := map[int]Row{
+		1: {"id": 1, "title": nil, "priority": nil},
+		2: {"id": 2, "title": nil, "priority": nil},
+		3: {"id": 3, "title": "NULL", "priority": nil},
+	}
+	for _, row := range mustExec(t, db, "SELECT * FROM tasks").Rows {
+		for col, val := range want[row["id"].(int)] {
+			if row[col] != val {
+				t.Errorf("row %v: %s is %#v, want %#v", row["id"], col, row[col], val)
+			}
+		}
+	}
+
+	// A comparison with NULL is never true
+	for _, query := range []string{
+		"SELECT * FROM tasks WHERE title = ?",
+		"SELECT * FROM tasks WHERE title != ?",
+		"SELECT * FROM tasks WHERE id > ?",
+		"SELECT * FROM tasks WHERE id BETWEEN 1 AND ?",
+	} {
+		if rows := mustExec(t, db, query, nil).Rows; len(rows) != 0 {
+			t.Errorf("%s with NULL: got %d row(s), want none", query, len(rows))
+		}
+	}
+}
+
+func TestBindUnsupportedType(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE tasks (id INT PRIMARY KEY, title STRING)")
+	for _, arg := range []interface{}{true, []byte("x"), time.Now(), uint(1)} {
+		_, err := db.Exec("INSERT INTO tasks (id, title) VALUES (1, ?)", arg)
+		if err == nil || !strings.Contains(err.Error(), "argument 1: unsupported type") {
+			t.Errorf("binding %T: got %v, want an unsupported type error", arg, err)
+		}
+	}
+	if rows := mustExec(t, db, "SELECT * FROM tasks").Rows; len(rows) != 0 {
+		t.Errorf("failed inserts left %d row(s)", len(rows))
+	}
+}
+
+func TestBindFloat(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE p (id INT PRIMARY KEY, price FLOAT)")
+	mustExec(t, db, "INSERT INTO p (id, price) VALUES (?, ?)", 1, 3.0)
+	mustExec(t, db, "INSERT INTO p (id, price) VALUES (?, ?)", 2, 2.5)
+	mustExec(t, db, "INSERT INTO p (id, price) VALUES (?, ?)", 3, 1e21)
+	mustExec(t, db, "UPDATE p SET price = ? WHERE id = ?", 4.0, 2)
+
+	for _, tc := range []struct {
+		price float64
+		id    int
+	}{{3.0, 1}, {4.0, 2}, {1e21, 3}} {
+		rows := mustExec(t, db, "SELECT id FROM p WHERE price = ?", tc.price).Rows
+		if len(rows) != 1 || rows[0]["id"] != tc.id {
+			t.Errorf("WHERE price = %v: got %v, want id %d", tc.price, rows, tc.id)
+		}
+	}
+	if rows := mustExec(t, db, "SELECT id FROM p WHERE price = 3.0").Rows; len(rows) != 1 {
+		t.Errorf("WHERE price = 3.0: got %v, want id 1", rows)
+	}
+
+	for _, arg := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		if _, err := db.Exec("UPDATE p SET price = ? WHERE id = 1", arg); err == nil {
+			t.Errorf("binding %v: no error", arg)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package minidb
+
+import (
+	"sort"
+)
+
+const btreeMaxKeys = 64
+
+// btree is an in-memory B+tree mapping composite keys to row positions.
+// Leaves are linked in both directions for ordered scans. Deletes do not
+// rebalance; emptied leaves are skipped during iteration.
+type btree struct {
+	root    *btreeNode
+	compare func(a, b []interface{}) int
+	length  int
+}
+
+type btreeNode struct {
+	keys     [][]interface{}
+	rows     [][]int      // leaf only
+	children []*btreeNode // internal only
+	next     *btreeNode
+	prev     *btreeNode
+}
+
+type btreeCursor struct {
+	node *btreeNode
+	pos  int
+}
+
+func newBTree(compare func(a, b []interface{}) int) *btree {
+	return &btree{root: &btreeNode{}, compare: compare}
+}
+
+func (n *btreeNode) isLeaf() bool {
+	return n.children == nil
+}
+
+// Len returns the number of distinct keys in the tree.
+func (bt *btree) Len() int {
+	return bt.length
+}
+
+func (bt *btree) Insert(key []interface{}, rowIdx int) {
+	sep, right := bt.insert(bt.root, key, rowIdx)
+	if right != nil {
+		bt.root = &btreeNode{
+			keys:     [][]interface{}{sep},
+			children: []*btreeNode{bt.root, right},
+		}
+	}
+}
+
+func (bt *btree) insert(n *btreeNode, key []interface{}, rowIdx int) ([]interface{}, *btreeNode) {
+	if n.isLeaf() {
+		i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) >= 0 })
+		if i < len(n.keys) && bt.compare(n.keys[i], key) == 0 {
+			n.rows[i] = append(n.rows[i], rowIdx)
+			return nil, nil
+		}
+
+		n.keys = append(n.keys, nil)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = key
+		n.rows = append(n.rows, nil)
+		copy(n.rows[i+1:], n.rows[i:])
+		n.rows[i] = []int{rowIdx}
+		bt.length++
+
+		if len(n.keys) <= btreeMaxKeys {
+			return nil, nil
+		}
+
+		// Split the leaf and link the new right half into the chain
+		mid := len(n.keys) / 2
+		right := &btreeNode{
+			keys: append([][]interface{}{}, n.keys[mid:]...),
+			rows: append([][]int{}, n.rows[mid:]...),
+			next: n.next,
+			prev: n,
+		}
+		if n.next != nil {
+			n.next.prev = right
+		}
+		n.next = right
+		n.keys = n.keys[:mid:mid]
+		n.rows = n.rows[:mid:mid]
+		return right.keys[0], right
+	}
+
+	i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) > 0 })
+	sep, child := bt.insert(n.children[i], key, rowIdx)
+	if child == nil {
+		return nil, nil
+	}
+
+	n.keys = append(n.keys, nil)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = sep
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = child
+
+	if len(n.keys) <= btreeMaxKeys {
+		return nil, nil
+	}
+
+	mid := len(n.keys) / 2
+	up := n.keys[mid]
+	right := &btreeNode{
+		keys:     append([][]interface{}{}, n.keys[mid+1:]...),
+		children: append([]*btreeNode{}, n.children[mid+1:]...),
+	}
+	n.keys = n.keys[:mid:mid]
+	n.children = n.children[: mid+1 : mid+1]
+	return up, right
+}
+
+func (bt *btree) Delete(key []interface{}, rowIdx int) {
+	n := bt.root
+	for !n.isLeaf() {
+		i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) > 0 })
+		n = n.children[i]
+	}
+
+	i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) >= 0 })
+	if i >= len(n.keys) || bt.compare(n.keys[i], key) != 0 {
+		return
+	}
+
+	rows := n.rows[i][:0]
+	for _, r := range n.rows[i] {
+		if r != rowIdx {
+			rows = append(rows, r)
+		}
+	}
+	if len(rows) > 0 {
+		n.rows[i] = rows
+		return
+	}
+
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.rows = append(n.rows[:i], n.rows[i+1:]...)
+	bt.length--
+}
+
+// Get returns the rows stored under exactly key.
+func (bt *btree) Get(key []interface{}) []int {
+	c := bt.seekGE(key)
+	if c.valid() && bt.compare(c.key(), key) == 0 {
+		return c.rows()
+	}
+	return nil
+}
+
+// Ascend calls fn for each key >= from in ascending order (from the first
+// key when from is nil) until fn returns false.
+func (bt *btree) Ascend(from []interface{}, fn func(key []interface{}, rows []int) bool) {
+	var c btreeCursor
+	if from == nil {
+		c = bt.first()
+	} else {
+		c = bt.seekGE(from)
+	}
+	for ; c.valid(); c.next() {
+		if !fn(c.key(), c.rows()) {
+			return
+		}
+	}
+}
+
+// Descend calls fn for each key <= from in descending order (from the last
+// key when from is nil) until fn returns false.
+func (bt *btree) Descend(from []interface{}, fn func(key []interface{}, rows []int) bool) {
+	var c btreeCursor
+	if from == nil {
+		c = bt.last()
+	} else {
+		c = bt.seekLE(from)
+	}
+	for ; c.valid(); c.prev() {
+		if !fn(c.key(), c.rows()) {
+			return
+		}
+	}
+}
+
+func (bt *btree) first() btreeCursor {
+	n := bt.root
+	for !n.isLeaf() {
+		n = n.children[0]
+	}
+	c := btreeCursor{node: n, pos: 0}
+	c.skipForward()
+	return c
+}
+
+func (bt *btree) last() btreeCursor {
+	n := bt.root
+	for !n.isLeaf() {
+		n = n.children[len(n.children)-1]
+	}
+	c := btreeCursor{node: n, pos: len(n.keys) - 1}
+	c.skipBackward()
+	return c
+}
+
+// seekGE positions a cursor at the first key >= key. Keys compare on their
+// common prefix, so a shorter key finds the first entry starting with it.
+func (bt *btree) seekGE(key []interface{}) btreeCursor {
+	n := bt.root
+	for !n.isLeaf() {
+		i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) >= 0 })
+		n = n.children[i]
+	}
+	i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) >= 0 })
+	c := btreeCursor{node: n, pos: i}
+	c.skipForward()
+	return c
+}
+
+// seekLE positions a cursor at the last key <= key.
+func (bt *btree) seekLE(key []interface{}) btreeCursor {
+	n := bt.root
+	for !n.isLeaf() {
+		i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) > 0 })
+		n = n.children[i]
+	}
+	i := sort.Search(len(n.keys), func(i int) bool { return bt.compare(n.keys[i], key) > 0 })
+	c := btreeCursor{node: n, pos: i - 1}
+	c.skipBackward()
+	return c
+}
+
+func (c *btreeCursor) valid() bool {
+	return c.node != nil
+}
+
+func (c *btreeCursor) key() []interface{} {
+	return c.node.keys[c.pos]
+}
+
+func (c *btreeCursor) rows() []int {
+	return c.node.rows[c.pos]
+}
+
+func (c *btreeCursor) next() {
+	c.pos++
+	c.skipForward()
+}
+
+func (c *btreeCursor) prev() {
+	c.pos--
+	c.skipBackward()
+}
+
+func (c *btreeCursor) skipForward() {
+	for c.node != nil && c.pos >= len(c.node.keys) {
+		c.node = c.node.next
+		c.pos = 0
+	}
+}
+
+func (c *btreeCursor) skipBackward() {
+	for c.node != nil && c.pos < 0 {
+		c.node = c.node.prev
+		if c.node != nil {
+			c.pos = len(c.node.keys) - 1
+		}
+	}
+}
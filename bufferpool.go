@@ -0,0 +1,76 @@
+package minidb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultCachePages bounds the buffer pool when no size is configured:
+// 4096 pages of 4 KB, so 16 MB.
+const DefaultCachePages = 4096
+
+// bufferPool caches up to capacity pages and evicts the least recently
+// used one to make room. Pages of a data file never change, so an evicted
+// page is simply dropped; a reader still holding it keeps a valid copy.
+type bufferPool struct {
+	mu       sync.Mutex
+	capacity int
+	load     func(pageID) (page, error)
+	frames   map[pageID]*list.Element
+	lru      *list.List // front is most recently used
+}
+
+type frame struct {
+	id   pageID
+	data page
+}
+
+func newBufferPool(capacity int, load func(pageID) (page, error)) *bufferPool {
+	if capacity <= 0 {
+		capacity = DefaultCachePages
+	}
+	return &bufferPool{
+		capacity: capacity,
+		load:     load,
+		frames:   make(map[pageID]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func (bp *bufferPool) get(id pageID) (page, error) {
+	bp.mu.Lock()
+	if e, ok := bp.frames[id]; ok {
+		bp.lru.MoveToFront(e)
+		bp.mu.Unlock()
+		return e.Value.(*frame).data, nil
+	}
+	bp.mu.Unlock()
+
+	// Read outside the lock so readers of other pages are not held up;
+	// two readers missing on the same page may both read it
+	data, err := bp.load(id)
+	if err != nil {
+		return nil, err
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if e, ok := bp.frames[id]; ok {
+		bp.lru.MoveToFront(e)
+		return e.Value.(*frame).data, nil
+	}
+	for bp.lru.Len() >= bp.capacity {
+		oldest := bp.lru.Back()
+		bp.lru.Remove(oldest)
+		delete(bp.frames, oldest.Value.(*frame).id)
+	}
+	bp.frames[id] = bp.lru.PushFront(&frame{id: id, data: data})
+	return data, nil
+}
+
+// cached returns how many pages the pool holds.
+func (bp *bufferPool) cached() int {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.lru.Len()
+}
@@ -0,0 +1,196 @@
+// Command minidb runs a minidb database as a REPL or a web server, and
+// backs up, restores and recovers databases.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"minidb"
+)
+
+func main() {
+	groupCommit := flag.Duration("group-commit", 0, "share log fsyncs between concurrent commits, waiting this long for more to join (0 syncs every commit on its own)")
+	cachePages := flag.Int("cache-pages", minidb.DefaultCachePages, "pages of the data file to keep in memory, 4 KB each")
+	archiveLog := flag.Bool("wal-archive", false, "keep the log of each checkpoint, so incremental backups can always reach back")
+	retention := flag.Duration("retention", 0, "keep this much history for AS OF TIMESTAMP queries and point-in-time recovery")
+	storageKind := flag.String("storage", "wal", "storage engine: "+minidb.StorageKinds)
+	dataDir := flag.String("data-dir", ".", "directory holding the database files")
+	dbName := flag.String("db", "minidb", "database to use at startup; created if missing")
+	statementTimeout := flag.Duration("statement-timeout", 0, "stop statements that run longer than this; sessions can change it with SET statement_timeout (0 is no limit)")
+	readOnly := flag.Bool("read-only", false, "attach without locking, beside a process writing the databases; writes are refused")
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "backup":
+		if err := runBackup(flag.Args()[1:], filepath.Join(*dataDir, *dbName)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "restore":
+		if err := runRestore(flag.Args()[1:], *dataDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "recover":
+		if err := runRecover(flag.Args()[1:], *dataDir, *dbName); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	instance, err := minidb.NewInstance(*dataDir, *storageKind)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	instance.ReadOnly = *readOnly
+	instance.StatementTimeout = *statementTimeout
+	instance.Configure = func(wal *minidb.WALStorage) {
+		wal.GroupCommit = *groupCommit
+		wal.CachePages = *cachePages
+		wal.ArchiveLog = *archiveLog
+		wal.Retention = *retention
+	}
+	defer instance.Close()
+
+	db, err := instance.Open(*dbName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "server" {
+		startWebServer(instance, *dbName, db)
+		return
+	}
+
+	// REPL mode
+	session, err := instance.NewSession(*dbName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer session.Close()
+	scanner := bufio.NewScanner(os.Stdin)
+
+	fmt.Println("SimpleDB RDBMS v1.0")
+	fmt.Println("Enter SQL commands (type 'exit' to quit)")
+	fmt.Print(prompt(session))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			fmt.Print(prompt(session))
+			continue
+		}
+
+		if strings.ToLower(line) == "exit" {
+			break
+		}
+
+		// Rows are printed as they are read
+		cursor, err := session.Query(line)
+		if err == nil {
+			err = cursor.Print(os.Stdout)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+
+		fmt.Print(prompt(session))
+	}
+}
+
+// runBackup runs "backup [-incremental] DIR" on the WAL database at base.
+// It works while another process has the database open.
+func runBackup(args []string, base string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	incremental := flags.Bool("incremental", false, "add the commits made since the backup in DIR was taken")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: backup [-incremental] DIR")
+	}
+
+	lsn, added, err := minidb.Backup(base, flags.Arg(0), *incremental)
+	if err != nil {
+		return err
+	}
+	if added == 0 {
+		fmt.Printf("Backup in %s is up to date at commit %d\n", flags.Arg(0), lsn)
+	} else {
+		fmt.Printf("Backed up %s to commit %d in %s\n", filepath.Base(base), lsn, flags.Arg(0))
+	}
+	return nil
+}
+
+// runRestore runs "restore [-as NAME] [-to TIME] DIR" into the data
+// directory. No process may have the database open.
+func runRestore(args []string, dataDir string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	as := flags.String("as", "", "restore into this database instead of the one backed up")
+	to := flags.String("to", "", "restore only the commits made by this time")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-as NAME] [-to TIME] DIR")
+	}
+	var at time.Time
+	if *to != "" {
+		var err error
+		if at, err = minidb.ParseTimestamp(*to); err != nil {
+			return err
+		}
+	}
+
+	name, lsn, err := minidb.Restore(flags.Arg(0), dataDir, *as, at)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database %s restored to commit %d\n", name, lsn)
+	return nil
+}
+
+// runRecover runs "recover -to TIME [-as NAME]" on the named database in
+// the data directory, from the history it keeps. No process may have the
+// database recovered into open.
+func runRecover(args []string, dataDir, name string) error {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	as := flags.String("as", "", "recover into a new database, leaving this one as it is")
+	to := flags.String("to", "", "the time to recover the database as of")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *to == "" {
+		return fmt.Errorf("usage: recover -to TIME [-as NAME]")
+	}
+	at, err := minidb.ParseTimestamp(*to)
+	if err != nil {
+		return err
+	}
+	into := name
+	if *as != "" {
+		into = *as
+	}
+
+	point, err := minidb.Recover(dataDir, name, at, into)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database %s recovered as of %s\n", into, point)
+	return nil
+}
+
+// prompt marks an open transaction with a star.
+func prompt(session *minidb.Session) string {
+	if session.InTransaction() {
+		return "*> "
+	}
+	return "> "
+}
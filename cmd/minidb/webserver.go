@@ -4,20 +4,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+
+	"minidb"
 )
 
-var globalDB *Database
+// globalDB is the database the task manager keeps its tasks in; queries
+// may use any database of globalInstance.
+var (
+	globalInstance *minidb.Instance
+	globalDBName   string
+	globalDB       *minidb.DB
+)
 
-func startWebServer() {
-	globalDB = NewDatabase()
-	err := globalDB.Load()
-	if err != nil {
-		return
-	}
+func startWebServer(instance *minidb.Instance, name string, db *minidb.DB) {
+	globalInstance, globalDBName, globalDB = instance, name, db
 	initializeDB()
 
 	http.HandleFunc("/", handleHome)
@@ -32,15 +38,21 @@ func startWebServer() {
 }
 
 func initializeDB() {
+	_, err := globalDB.Exec("CREATE TYPE status AS ENUM ('pending', 'in-progress', 'completed')")
+	if err != nil {
+		log.Printf("Error creating type: %v", err)
+	}
+
 	query := `CREATE TABLE tasks (
 		id INT PRIMARY KEY,
 		title STRING NOT NULL,
 		description STRING,
-		status STRING,
-		priority INT
+		status status,
+		priority INT,
+		metadata JSON
 	)`
 	log.Printf("Creating table with query: %s", query)
-	_, err := globalDB.Execute(query)
+	_, err = globalDB.Exec(query)
 
 	if err != nil {
 		log.Printf("Error creating table: %v", err)
@@ -88,7 +100,7 @@ func handleConsole(w http.ResponseWriter, r *http.Request) {
         .error { color: #ef4444; padding: 12px; background: #fee2e2; border-radius: 8px; margin-bottom: 15px; font-weight: 600; }
         table { width: 100%; border-collapse: collapse; margin-top: 15px; background: white; border-radius: 8px; overflow: hidden; box-shadow: 0 2px 8px rgba(0,0,0,0.1); }
         th { background: linear-gradient(135deg, #667eea 0%, #764ba2 100%); color: white; padding: 12px; text-align: left; font-weight: 600; }
-        td { padding: 12px; border-bottom: 1px solid #e9ecef; }
+        td { padding: 12px; border-bottom: 1px solid #e9ecef; white-space: pre; }
         tr:hover { background: #f8f9fa; }
         tr:last-child td { border-bottom: none; }
         .examples { background: #fff3cd; border-left: 4px solid #ffc107; padding: 15px; border-radius: 8px; margin-top: 15px; font-size: 12px; }
@@ -119,13 +131,15 @@ SELECT * FROM users
 SELECT * FROM users WHERE age > 25"></textarea>
                 <div class="btn-group">
                     <button onclick="executeQuery()">▶ Execute Query</button>
+                    <button onclick="explainQuery(false)">🔍 Explain</button>
+                    <button onclick="explainQuery(true)">⏱️ Explain Analyze</button>
                     <button class="btn-secondary" onclick="clearAll()">🗑️ Clear All</button>
                 </div>
                 <div class="examples">
                     <strong>💡 Quick Tips:</strong><br>
                     • Press <code>Ctrl+Enter</code> to execute<br>
-                    • Supports: CREATE, INSERT, SELECT, UPDATE, DELETE<br>
-                    • Data types: INT, STRING, FLOAT
+                    • Supports: CREATE, INSERT, SELECT, UPDATE, DELETE, ANALYZE, EXPLAIN<br>
+                    • Data types: INT, STRING, FLOAT, JSON
                 </div>
             </div>
             <div class="panel">
@@ -137,8 +151,20 @@ SELECT * FROM users WHERE age > 25"></textarea>
         </div>
     </div>
     <script>
-        async function executeQuery() {
-            const query = document.getElementById('query').value.trim();
+        function explainQuery(analyze) {
+            const query = document.getElementById('query').value.trim().replace(/^EXPLAIN\s+(ANALYZE\s+)?/i, '');
+            if (!query) {
+                alert('⚠️ Please enter a query');
+                return;
+            }
+            executeQuery((analyze ? 'EXPLAIN ANALYZE ' : 'EXPLAIN ') + query);
+        }
+
+        // The database chosen with USE, sent along with every query
+        let database = '';
+
+        async function executeQuery(explained) {
+            const query = explained || document.getElementById('query').value.trim();
             if (!query) {
                 alert('⚠️ Please enter a query');
                 return;
@@ -151,10 +177,13 @@ SELECT * FROM users WHERE age > 25"></textarea>
                 const response = await fetch('/api/query', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ query })
+                    body: JSON.stringify({ query, database })
                 });
 
                 const data = await response.json();
+                if (data.database) {
+                    database = data.database;
+                }
 
                 if (!response.ok) {
                     resultsDiv.innerHTML = ` + "`<div class=\"error\">❌ Error: ${data.error}</div>`" + `;
@@ -382,21 +411,13 @@ func handleTasks(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
-		result, err := globalDB.Execute("SELECT * FROM tasks")
+		cursor, err := globalDB.QueryContext(r.Context(), "SELECT * FROM tasks")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if result.Rows == nil {
-			err := json.NewEncoder(w).Encode([]Row{})
-			if err != nil {
-				return
-			}
-		} else {
-			err := json.NewEncoder(w).Encode(result.Rows)
-			if err != nil {
-				return
-			}
+		if err := writeRows(w, cursor); err != nil {
+			log.Printf("Listing tasks failed: %v", err)
 		}
 
 	case "POST":
@@ -407,17 +428,26 @@ func handleTasks(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		query := fmt.Sprintf(
-			"INSERT INTO tasks (id, title, description, status, priority) VALUES (%d, '%s', '%s', '%s', %d)",
+		query := "INSERT INTO tasks (id, title, description, status, priority) VALUES (?, ?, ?, ?, ?)"
+		args := []interface{}{
 			int(task["id"].(float64)),
 			task["title"],
 			task["description"],
 			task["status"],
 			int(task["priority"].(float64)),
-		)
+		}
+		if metadata, ok := task["metadata"]; ok && metadata != nil {
+			data, err := json.Marshal(metadata)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			query = "INSERT INTO tasks (id, title, description, status, priority, metadata) VALUES (?, ?, ?, ?, ?, ?)"
+			args = append(args, string(data))
+		}
 
 		log.Printf("Executing query: %s", query)
-		_, err := globalDB.Execute(query)
+		_, err := globalDB.ExecContext(r.Context(), query, args...)
 		if err != nil {
 			log.Printf("Execute error: %v", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -452,14 +482,29 @@ func handleTaskByID(w http.ResponseWriter, r *http.Request) {
 		}
 
 		var setClauses []string
+		var args []interface{}
 		for k, v := range updates {
-			setClauses = append(setClauses, fmt.Sprintf("%s = '%v'", k, v))
+			if k == "metadata" {
+				data, err := json.Marshal(v)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				v = string(data)
+			}
+			// JSON numbers decode as float64, but the tasks table only has
+			// INT columns
+			if f, ok := v.(float64); ok && f == math.Trunc(f) {
+				v = int(f)
+			}
+			setClauses = append(setClauses, k+" = ?")
+			args = append(args, v)
 		}
 
-		query := fmt.Sprintf("UPDATE tasks SET %s WHERE id = %d",
-			strings.Join(setClauses, ", "), id)
+		query := fmt.Sprintf("UPDATE tasks SET %s WHERE id = ?", strings.Join(setClauses, ", "))
+		args = append(args, id)
 
-		_, err := globalDB.Execute(query)
+		_, err := globalDB.ExecContext(r.Context(), query, args...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -471,8 +516,7 @@ func handleTaskByID(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case "DELETE":
-		query := fmt.Sprintf("DELETE FROM tasks WHERE id = %d", id)
-		_, err := globalDB.Execute(query)
+		_, err := globalDB.ExecContext(r.Context(), "DELETE FROM tasks WHERE id = ?", id)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -494,7 +538,8 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Query string `json:"query"`
+		Query    string `json:"query"`
+		Database string `json:"database"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -505,7 +550,19 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := globalDB.Execute(req.Query)
+	if req.Database == "" {
+		req.Database = globalDBName
+	}
+
+	// Each request runs in a session of its own on the named database, so
+	// requests for different databases never see each other
+	session, err := globalInstance.NewSession(req.Database)
+	var cursor *minidb.Rows
+	if err == nil {
+		defer session.Close()
+		// The query stops if the client goes away
+		cursor, err = session.QueryContext(r.Context(), req.Query)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		err := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
@@ -514,19 +571,61 @@ func handleQuery(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	defer cursor.Close()
 
-	if result.Message != "" {
-		err := json.NewEncoder(w).Encode(map[string]string{"message": result.Message})
+	// The session reports the database USE switched to
+	database := session.Database()
+	if cursor.Message != "" {
+		err := json.NewEncoder(w).Encode(map[string]string{"message": cursor.Message, "database": database})
 		if err != nil {
 			return
 		}
-	} else {
-		err := json.NewEncoder(w).Encode(map[string]interface{}{
-			"columns": result.Columns,
-			"rows":    result.Rows,
-		})
+		return
+	}
+
+	// Rows are streamed as they are read; an error met midway is added
+	// after them, since the status has already been sent
+	columns, _ := json.Marshal(cursor.Columns)
+	name, _ := json.Marshal(database)
+	if _, err := fmt.Fprintf(w, `{"columns":%s,"database":%s,"rows":`, columns, name); err != nil {
+		return
+	}
+	end := "}\n"
+	if err := writeRows(w, cursor); err != nil {
+		message, _ := json.Marshal(err.Error())
+		end = `,"error":` + string(message) + end
+	}
+	if _, err := io.WriteString(w, end); err != nil {
+		return
+	}
+}
+
+// writeRows streams the rows of cursor to w as a JSON array, one row at a
+// time, and closes the cursor. A failure to write, such as the client
+// going away, stops the query.
+func writeRows(w io.Writer, cursor *minidb.Rows) error {
+	defer cursor.Close()
+	sep := "["
+	for cursor.Next() {
+		data, err := json.Marshal(cursor.Row())
 		if err != nil {
-			return
+			return err
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
 		}
+		sep = ","
+	}
+	if sep == "[" {
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return err
 	}
+	return cursor.Err()
 }
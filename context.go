@@ -0,0 +1,50 @@
+package minidb
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// A statement runs under a context: scans check it before each batch, and
+// other loops over rows every checkRows rows, so a statement stops soon
+// after its context is cancelled and gives up the latches it holds. A
+// statement timeout is a deadline on that context, set when the statement
+// starts; waits for latches count towards it, but are not interrupted,
+// while a wait for a row or table lock ends with the context.
+
+// checkRows is how many rows a loop goes between checks of its context.
+const checkRows = 1024
+
+var ErrStatementTimeout = errors.New("canceling statement due to statement timeout")
+
+// withStatementTimeout returns ctx with a deadline timeout from now, or
+// ctx unchanged if timeout is zero. The caller must call the CancelFunc.
+func withStatementTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, ErrStatementTimeout)
+}
+
+// interrupted returns why ctx was cancelled, or nil if it was not:
+// ErrStatementTimeout when the statement timeout ran out.
+func interrupted(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return context.Cause(ctx)
+}
+
+// interrupter checks a context every checkRows calls.
+type interrupter struct {
+	ctx  context.Context
+	rows int
+}
+
+func (i *interrupter) check() error {
+	if i.rows++; i.rows%checkRows != 0 {
+		return nil
+	}
+	return interrupted(i.ctx)
+}
@@ -0,0 +1,223 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// faultFS runs file operations against the OS until step crashAt, where it
+// simulates the process dying: a write stops halfway, any other operation
+// does nothing, and everything after it fails. crash then applies the
+// worst a power cut could do to data that was never synced.
+type faultFS struct {
+	crashAt int
+	ops     []string
+	crashed bool
+
+	unsynced []string          // files written since their last sync
+	renamed  map[string][]byte // rename targets, with their old contents, whose directory was not synced yet
+}
+
+func (f *faultFS) step(op string) bool {
+	if f.crashed {
+		return true
+	}
+	f.ops = append(f.ops, op)
+	if len(f.ops) == f.crashAt {
+		f.crashed = true
+	}
+	return f.crashed
+}
+
+func (f *faultFS) Create(name string) (syncFile, error) {
+	if f.step("create " + filepath.Base(name)) {
+		return nil, errCrash
+	}
+	file, err := osFS{}.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f.unsynced = append(f.unsynced, name)
+	return &faultFile{fs: f, name: name, file: file.(*os.File)}, nil
+}
+
+func (f *faultFS) Rename(from, to string) error {
+	if f.step("rename " + filepath.Base(from)) {
+		return errCrash
+	}
+	old, err := os.ReadFile(to)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if f.renamed == nil {
+		f.renamed = make(map[string][]byte)
+	}
+	f.renamed[to] = old
+	return os.Rename(from, to)
+}
+
+func (f *faultFS) SyncDir(dir string) error {
+	if f.step("sync dir") {
+		return errCrash
+	}
+	if err := (osFS{}).SyncDir(dir); err != nil {
+		return err
+	}
+	f.renamed = nil
+	return nil
+}
+
+// crash loses every write that was not synced and every rename whose
+// directory was not synced.
+func (f *faultFS) crash() error {
+	for _, name := range f.unsynced {
+		if err := os.Truncate(name, 0); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for name, old := range f.renamed {
+		if old == nil {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.WriteFile(name, old, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type faultFile struct {
+	fs   *faultFS
+	name string
+	file *os.File
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if f.fs.step("write " + filepath.Base(f.name)) {
+		n, _ := f.file.Write(p[:len(p)/2])
+		return n, errCrash
+	}
+	return f.file.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if f.fs.step("sync " + filepath.Base(f.name)) {
+		return errCrash
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	for i, name := range f.fs.unsynced {
+		if name == f.name {
+			f.fs.unsynced = append(f.fs.unsynced[:i], f.fs.unsynced[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	err := f.file.Close()
+	if f.fs.step("close " + filepath.Base(f.name)) {
+		return errCrash
+	}
+	return err
+}
+
+// TestCheckpointCrash crashes a checkpoint at each of its steps in turn
+// and checks that the database reopens with every committed row.
+func TestCheckpointCrash(t *testing.T) {
+	for step := 1; ; step++ {
+		path := filepath.Join(t.TempDir(), "minidb.db")
+		storage := NewWALStorage(path)
+		db := crashTestDatabase(t, storage)
+		want := crashTestContents(t, db)
+
+		fault := &faultFS{crashAt: step}
+		storage.fs = fault
+		err := db.Checkpoint()
+		db.Close()
+		if err == nil {
+			t.Logf("checkpoint finished after %d steps", len(fault.ops))
+			return
+		}
+		if !fault.crashed {
+			t.Fatalf("step %d: %v", step, err)
+		}
+		if err := fault.crash(); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened := NewDB(WithStorage(NewWALStorage(path)))
+		if err := reopened.Load(); err != nil {
+			t.Fatalf("crash at %s: reopening failed: %v", fault.ops[step-1], err)
+		}
+		got := crashTestContents(t, reopened)
+		reopened.Close()
+		if got != want {
+			t.Fatalf("crash at %s: reopened with %s, want %s", fault.ops[step-1], got, want)
+		}
+	}
+}
+
+// TestDamagedDataFile checks that Load rejects a data file whose trailer
+// was damaged.
+func TestDamagedDataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minidb.db")
+	db := crashTestDatabase(t, NewWALStorage(path))
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-3] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db = NewDB(WithStorage(NewWALStorage(path)))
+	err = db.Load()
+	db.Close()
+	if err == nil {
+		t.Fatal("a damaged data file was loaded without error")
+	}
+}
+
+// crashTestDatabase builds a database with rows in an old data file and
+// more rows only in the write-ahead log.
+func crashTestDatabase(t *testing.T, storage *WALStorage) *DB {
+	t.Helper()
+	db := NewDB(WithStorage(storage))
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+	mustExec(t, db, "INSERT INTO items (id, name) VALUES (1, 'snapshot')")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "INSERT INTO items (id, name) VALUES (2, 'log')")
+	mustExec(t, db, "UPDATE items SET name = 'updated' WHERE id = 1")
+	return db
+}
+
+func crashTestContents(t *testing.T, db *DB) string {
+	t.Helper()
+	contents := ""
+	for _, row := range mustExec(t, db, "SELECT * FROM items ORDER BY id").Rows {
+		contents += fmt.Sprintf("(%v %v)", row["id"], row["name"])
+	}
+	return contents
+}
@@ -0,0 +1,341 @@
+package minidb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// printWindow is how many rows Print reads ahead to size its columns.
+const printWindow = 100
+
+// Rows reads the result of a statement one row at a time. The rows of a
+// SELECT are pulled through its plan as the cursor advances, so only what
+// an operator such as a sort has to gather is ever held in memory; the
+// results of other statements are read from memory. A cursor over a plan
+// holds no latches between calls to Next: its scans latch their tables a
+// batch at a time. It pins its snapshot instead, which holds back garbage
+// collection and makes VACUUM and checkpoints wait until it is closed or
+// has returned its last row, so it must always be closed.
+type Rows struct {
+	Columns []string
+	Message string
+	plan    PlanNode
+	rows    []Row
+	row     Row
+	err     error
+	release func()
+	cancel  context.CancelFunc
+}
+
+// cursor reads a result already in memory.
+func (r *Result) cursor() *Rows {
+	return &Rows{Columns: r.Columns, Message: r.Message, rows: r.Rows}
+}
+
+// openCursor runs stmt under the statement timeout: a SELECT through open,
+// whose cursor keeps the timeout running until it is closed, and anything
+// else, a SELECT that locks rows included, through run.
+func openCursor(ctx context.Context, timeout time.Duration, stmt Statement,
+	open func(context.Context, *SelectStmt) (*Rows, error),
+	run func(context.Context, Statement) (*Result, error)) (*Rows, error) {
+	ctx, cancel := withStatementTimeout(ctx, timeout)
+	if s, ok := stmt.(*SelectStmt); ok && s.AsOf.IsZero() && s.Lock == lockNone {
+		c, err := open(ctx, s)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.cancel = cancel
+		return c, nil
+	}
+	defer cancel()
+	result, err := run(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	return result.cursor(), nil
+}
+
+// openSelect plans a SELECT in tx and opens the plan for a cursor to read.
+// Opening runs without latches, since a sort or a hash join reads all of
+// its input then.
+func (db *DB) openSelect(tx *Tx, stmt *SelectStmt) (*Rows, error) {
+	plan, columns, ts, err := db.planCursor(tx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if err := openPlan(plan); err != nil {
+		db.txm.unpin(ts)
+		return nil, err
+	}
+	return &Rows{Columns: columns, plan: plan, release: func() { db.txm.unpin(ts) }}, nil
+}
+
+// planCursor plans a SELECT in tx under the read latches, and pins the
+// snapshot of the plan before it lets them go, so no checkpoint can slip
+// in between. It returns the timestamp to unpin.
+func (db *DB) planCursor(tx *Tx, stmt *SelectStmt) (plan PlanNode, columns []string, ts uint64, err error) {
+	defer db.latch(stmt)()
+	defer recoverStorage(&err)
+	if err := interrupted(tx.ctx); err != nil {
+		return nil, nil, 0, err
+	}
+	snap := tx.snapshot()
+	plan, columns, err = db.planSelect(tx.ctx, stmt, snap)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	db.latchScans(plan)
+	db.txm.pin(snap.ts)
+	return plan, columns, snap.ts, nil
+}
+
+func openPlan(plan PlanNode) (err error) {
+	defer recoverStorage(&err)
+	return plan.Open()
+}
+
+// scanLatch takes the latches a scan of a cursor's plan reads a batch
+// under, and returns what releases them. The scans of a statement run
+// under its latches have none.
+type scanLatch func() func()
+
+// hold takes the latches, if there are any.
+func (l scanLatch) hold() func() {
+	if l == nil {
+		return func() {}
+	}
+	return l()
+}
+
+// latchScans gives every scan in plan the latches of its table: mu and
+// the table's latch, both shared.
+func (db *DB) latchScans(plan PlanNode) {
+	switch n := plan.(type) {
+	case *seqScanNode:
+		n.latch = db.scanLatch(n.table)
+	case *parallelSeqScanNode:
+		n.latch = db.scanLatch(n.table)
+	case *indexScanNode:
+		n.latch = db.scanLatch(n.table)
+	case *indexNestedLoopJoinNode:
+		n.innerLatch = db.scanLatch(n.inner)
+	}
+	for _, child := range plan.Info().Children {
+		db.latchScans(child)
+	}
+}
+
+func (db *DB) scanLatch(t *Table) scanLatch {
+	return func() func() {
+		db.mu.RLock()
+		t.latch.RLock()
+		return func() {
+			t.latch.RUnlock()
+			db.mu.RUnlock()
+		}
+	}
+}
+
+// Next advances to the next row. It returns false once there are none
+// left or reading failed; Err tells which.
+func (c *Rows) Next() bool {
+	if c.plan == nil {
+		if len(c.rows) == 0 {
+			c.row = nil
+			return false
+		}
+		c.row, c.rows = c.rows[0], c.rows[1:]
+		return true
+	}
+
+	row, ok, err := c.next()
+	if err != nil || !ok {
+		c.err = err
+		c.Close()
+		return false
+	}
+	c.row = row
+	return true
+}
+
+func (c *Rows) next() (row Row, ok bool, err error) {
+	defer recoverStorage(&err)
+	return c.plan.Next()
+}
+
+// Row returns the row Next advanced to.
+func (c *Rows) Row() Row {
+	return c.row
+}
+
+// Scan copies the values of the row Next advanced to into dest, one
+// pointer for each of Columns in order. A *interface{} takes any value,
+// NULL included; *int, *int64, *float64 and *string take a value of their
+// kind, and *float64 an INT as well.
+func (c *Rows) Scan(dest ...interface{}) error {
+	if c.row == nil {
+		return errors.New("Scan called without a row")
+	}
+	if len(dest) != len(c.Columns) {
+		return fmt.Errorf("Scan expected %d destination(s), got %d", len(c.Columns), len(dest))
+	}
+	for i, col := range c.Columns {
+		if err := scanValue(dest[i], c.row[col]); err != nil {
+			return fmt.Errorf("cannot scan column %s: %v", col, err)
+		}
+	}
+	return nil
+}
+
+func scanValue(dest, val interface{}) error {
+	if d, ok := dest.(*interface{}); ok {
+		*d = val
+		return nil
+	}
+	switch d := dest.(type) {
+	case *int:
+		if v, ok := val.(int); ok {
+			*d = v
+			return nil
+		}
+	case *int64:
+		if v, ok := val.(int); ok {
+			*d = int64(v)
+			return nil
+		}
+	case *float64:
+		switch v := val.(type) {
+		case float64:
+			*d = v
+			return nil
+		case int:
+			*d = float64(v)
+			return nil
+		}
+	case *string:
+		if v, ok := val.(string); ok {
+			*d = v
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported destination %T", dest)
+	}
+	if val == nil {
+		return fmt.Errorf("NULL into %T", dest)
+	}
+	return fmt.Errorf("%T into %T", val, dest)
+}
+
+// Err returns the error that stopped the cursor, if any.
+func (c *Rows) Err() error {
+	return c.err
+}
+
+// Close stops reading and releases the snapshot and the statement's
+// context. Closing a cursor again does nothing.
+func (c *Rows) Close() error {
+	if c.plan != nil {
+		c.plan.Close()
+		c.plan = nil
+	}
+	if c.release != nil {
+		c.release()
+		c.release = nil
+	}
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	c.rows, c.row = nil, nil
+	return c.err
+}
+
+// Print writes the message, or the rows as a table, to w, reading them as
+// it goes; columns are sized to the widest value among the first rows. It
+// closes the cursor, and stops at the first error reading or writing.
+func (c *Rows) Print(w io.Writer) error {
+	defer c.Close()
+	if c.Message != "" {
+		_, err := fmt.Fprintln(w, c.Message)
+		return err
+	}
+
+	head := make([]Row, 0)
+	for len(head) < printWindow && c.Next() {
+		head = append(head, c.Row())
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if len(head) == 0 {
+		_, err := fmt.Fprintln(w, "No results")
+		return err
+	}
+
+	// Size each column to its widest value
+	widths := make([]int, len(c.Columns))
+	total := 0
+	for i, col := range c.Columns {
+		widths[i] = max(15, len(col))
+		for _, row := range head {
+			widths[i] = max(widths[i], len(printValue(row[col])))
+		}
+		total += widths[i] + 3
+	}
+
+	// Print header
+	var line strings.Builder
+	for i, col := range c.Columns {
+		if i > 0 {
+			line.WriteString(" | ")
+		}
+		fmt.Fprintf(&line, "%-*s", widths[i], col)
+	}
+	if _, err := fmt.Fprintf(w, "%s\n%s\n", line.String(), strings.Repeat("-", total)); err != nil {
+		return err
+	}
+
+	// Print rows
+	count := 0
+	print := func(row Row) error {
+		line.Reset()
+		for i, col := range c.Columns {
+			if i > 0 {
+				line.WriteString(" | ")
+			}
+			fmt.Fprintf(&line, "%-*s", widths[i], printValue(row[col]))
+		}
+		line.WriteByte('\n')
+		count++
+		_, err := io.WriteString(w, line.String())
+		return err
+	}
+	for _, row := range head {
+		if err := print(row); err != nil {
+			return err
+		}
+	}
+	for c.Next() {
+		if err := print(c.Row()); err != nil {
+			return err
+		}
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%d row(s)\n", count)
+	return err
+}
+
+// printValue formats a value for Print, writing NULL as SQL does.
+func printValue(val interface{}) string {
+	if val == nil {
+		return "NULL"
+	}
+	return fmt.Sprint(val)
+}
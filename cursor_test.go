@@ -0,0 +1,204 @@
+package minidb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cursorTestRows is more than a scan reads in one batch.
+const cursorTestRows = 3 * scanBatchRows
+
+func cursorTestDB(t *testing.T) *DB {
+	t.Helper()
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE a (id INT PRIMARY KEY, k INT, v INT)")
+	mustExec(t, db, "CREATE INDEX a_k ON a USING BTREE (k)")
+	for i := 1; i <= cursorTestRows; i++ {
+		mustExec(t, db, "INSERT INTO a (id, k, v) VALUES (?, ?, 0)", i, 2*i)
+	}
+	return db
+}
+
+// within fails the test if f has not returned after a while.
+func within(t *testing.T, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("deadlocked")
+	}
+}
+
+// writeWhile inserts into a from another goroutine until stop is closed,
+// so a writer is always waiting for the table's latch. Its keys fall
+// between those of the rows already there, splitting the nodes of a_k
+// under a cursor walking it.
+func writeWhile(t *testing.T, db *DB, stop chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for id := cursorTestRows + 1; ; id++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			k := 2*(id-cursorTestRows) - 1
+			if _, err := db.Exec("INSERT INTO a (id, k, v) VALUES (?, ?, 0)", id, k); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	return &wg
+}
+
+func TestCursorStatementsInLoop(t *testing.T) {
+	for _, query := range []string{
+		"SELECT id FROM a",
+		"SELECT id FROM a WHERE k > 0 ORDER BY k",
+	} {
+		t.Run(query, func(t *testing.T) {
+			db := cursorTestDB(t)
+			rows, err := db.Query(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			stop := make(chan struct{})
+			wg := writeWhile(t, db, stop)
+			defer wg.Wait()
+			defer close(stop)
+
+			within(t, func() {
+				seen := 0
+				for rows.Next() {
+					id := rows.Row()["id"]
+					if _, err := db.Exec("SELECT * FROM a WHERE id = ?", id); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := db.Exec("UPDATE a SET v = 1 WHERE id = ?", id); err != nil {
+						t.Error(err)
+						return
+					}
+					seen++
+				}
+				if err := rows.Err(); err != nil {
+					t.Error(err)
+				}
+				if seen != cursorTestRows {
+					t.Errorf("cursor returned %d rows, want the %d of its snapshot", seen, cursorTestRows)
+				}
+			})
+		})
+	}
+}
+
+func TestCursorDoesNotBlockWriters(t *testing.T) {
+	db := cursorTestDB(t)
+	rows, err := db.Query("SELECT id FROM a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	within(t, func() {
+		mustExec(t, db, "DELETE FROM a")
+		mustExec(t, db, "CREATE TABLE b (id INT)")
+	})
+
+	seen := 1
+	for rows.Next() {
+		seen++
+	}
+	if seen != cursorTestRows {
+		t.Errorf("cursor returned %d rows, want the %d of its snapshot", seen, cursorTestRows)
+	}
+}
+
+func TestCursorHoldsOffVacuum(t *testing.T) {
+	db := cursorTestDB(t)
+	rows, err := db.Query("SELECT id FROM a ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	// Garbage collection after the delete must leave the rows the cursor
+	// has yet to read, and VACUUM must wait for it
+	mustExec(t, db, "DELETE FROM a")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "VACUUM a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("VACUUM with a cursor open: got %v, want it to wait", err)
+	}
+
+	for i := 1; rows.Next(); i++ {
+		if got := rows.Row()["id"]; got != i {
+			t.Fatalf("row %d has id %v", i, got)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "VACUUM a")
+	if n := db.tables["a"].rowCount(); n != 0 {
+		t.Errorf("VACUUM after the cursor closed left %d row versions", n)
+	}
+}
+
+// failWriter fails every write.
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestPrint(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE a (id INT PRIMARY KEY, name STRING)")
+	mustExec(t, db, "INSERT INTO a (id, name) VALUES (1, 'ann')")
+	mustExec(t, db, "INSERT INTO a (id, name) VALUES (2, NULL)")
+
+	var out bytes.Buffer
+	if err := mustExec(t, db, "SELECT id, name FROM a ORDER BY id").Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"id              | name           ",
+		strings.Repeat("-", 36),
+		"1               | ann            ",
+		"2               | NULL           ",
+		"",
+		"2 row(s)",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("Print wrote\n%s\nwant\n%s", out.String(), want)
+	}
+
+	rows, err := db.Query("SELECT id FROM a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Print(failWriter{}); err == nil {
+		t.Error("Print to a failing writer returned no error")
+	}
+	if rows.Next() {
+		t.Error("Print left the cursor open")
+	}
+}
@@ -1,182 +1,571 @@
-package main
+package minidb
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"io"
+	"sort"
 	"sync"
+	"time"
 )
 
-type Database struct {
-	tables      map[string]*Table
-	mu          sync.RWMutex
-	persistence *PersistenceManager
+// DB is a database, safe to use from many goroutines at once. It keeps its
+// tables in memory under two levels of latches. A statement shares mu, the
+// catalog latch, and latches each table it reads shared and the table it
+// changes exclusive, so statements on different tables run side by side;
+// statements changing the catalog, vacuums and checkpoints take mu
+// exclusive. Latches last one statement, or one batch a cursor reads; the
+// locks of the lock manager last a transaction.
+type DB struct {
+	tables   map[string]*Table
+	types    map[string]*EnumType
+	mu       sync.RWMutex
+	commitMu sync.Mutex // orders commits in the log
+	storage  storageEngine
+	txm      *txManager
+	locks    *lockManager
+	readOnly bool
+	timeout  time.Duration // statement timeout, unless a session sets one
 }
 
-type QueryResult struct {
-	Columns []string
-	Rows    []Row
-	Message string
+// Result is the whole result of a statement: the rows of a SELECT, or
+// the message of anything else, with how many rows an INSERT, UPDATE or
+// DELETE changed.
+type Result struct {
+	Columns      []string
+	Rows         []Row
+	Message      string
+	RowsAffected int
 }
 
-func NewDatabase() *Database {
-	return &Database{
-		tables:      make(map[string]*Table),
-		persistence: NewPersistenceManager("minidb.json"),
+// NewDB returns an empty database. Call Load to read what its storage
+// engine holds.
+func NewDB(options ...Option) *DB {
+	db := &DB{
+		tables: make(map[string]*Table),
+		types:  make(map[string]*EnumType),
+		txm:    newTxManager(),
+		locks:  newLockManager(),
 	}
+	for _, option := range options {
+		option(db)
+	}
+	if db.storage == nil {
+		db.storage = NewWALStorage("minidb.db")
+	}
+	return db
+}
+
+func (db *DB) Load() error {
+	return db.storage.Load(db)
+}
+
+// Checkpoint folds everything committed so far into the storage engine;
+// for a WALStorage it writes the data file and empties the log. It waits
+// for open cursors to be closed first, since a checkpoint moves rows.
+func (db *DB) Checkpoint() error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if err := db.lockUnpinned(context.Background()); err != nil {
+		return err
+	}
+	defer db.mu.Unlock()
+	return db.checkpoint()
+}
+
+// lockUnpinned takes mu exclusive once no cursor is open. Cursors pin
+// under mu shared, so none opens while the caller holds it.
+func (db *DB) lockUnpinned(ctx context.Context) error {
+	for {
+		if err := db.txm.unpinned(ctx); err != nil {
+			return err
+		}
+		db.mu.Lock()
+		if !db.txm.pinned() {
+			return nil
+		}
+		db.mu.Unlock()
+	}
+}
+
+func (db *DB) checkpoint() error {
+	return db.storage.Checkpoint(db)
+}
+
+// needsCheckpoint reports whether the storage engine asks for a checkpoint,
+// or an index created since the last checkpoint holds rows of the data
+// file in memory.
+func (db *DB) needsCheckpoint() bool {
+	if db.storage.NeedsCheckpoint() {
+		return true
+	}
+	for _, table := range db.tables {
+		for _, index := range table.indexes {
+			if table.base != nil && index.paged == nil {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (db *Database) Load() error {
-	return db.persistence.Load(db)
+// Close releases the storage engine's files. Committed changes are already
+// on disk, so no checkpoint is needed first.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.storage.Close()
 }
 
-func (db *Database) Save() error {
-	return db.persistence.Save(db)
+// Exec runs a single statement in a transaction of its own, with args
+// bound to its ? placeholders. Use Begin or a Session to group statements
+// into one transaction.
+func (db *DB) Exec(query string, args ...interface{}) (*Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
 }
 
-func (db *Database) Execute(query string) (*QueryResult, error) {
-	stmt, err := Parse(query)
+// ExecContext is Exec under ctx: the statement stops with an error once
+// ctx is cancelled or the statement timeout runs out.
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (*Result, error) {
+	stmt, err := prepare(query, args)
 	if err != nil {
 		return nil, err
 	}
+	ctx, cancel := withStatementTimeout(ctx, db.timeout)
+	defer cancel()
+	return db.run(ctx, stmt)
+}
+
+// Query runs a single statement like Exec and returns a cursor over
+// its result. The rows of a SELECT are read as the cursor advances.
+func (db *DB) Query(query string, args ...interface{}) (*Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext is Query under ctx: reading from the cursor stops with an
+// error once ctx is cancelled or the statement timeout runs out.
+func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	stmt, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return openCursor(ctx, db.timeout, stmt, db.query, db.run)
+}
+
+// query opens a cursor on a lone SELECT, which reads the latest snapshot.
+func (db *DB) query(ctx context.Context, stmt *SelectStmt) (*Rows, error) {
+	return db.openSelect(db.reader(ctx), stmt)
+}
+
+// reader returns a transaction for a lone read, which needs no state of
+// its own, only the latest snapshot.
+func (db *DB) reader(ctx context.Context) *Tx {
+	return &Tx{db: db, ctx: ctx, state: &txnState{reads: make(map[string]bool)}}
+}
+
+func (db *DB) run(ctx context.Context, stmt Statement) (*Result, error) {
+	switch s := stmt.(type) {
+	case *BeginStmt, *CommitStmt, *RollbackStmt, *SavepointStmt, *ReleaseStmt:
+		return nil, fmt.Errorf("transaction statements need a session")
+	case *SetStmt:
+		return nil, fmt.Errorf("SET needs a session")
+	case *CreateDatabaseStmt, *DropDatabaseStmt, *UseStmt, *RestoreStmt:
+		return nil, fmt.Errorf("database statements need a session of an instance")
+	case *BackupStmt:
+		return db.backup(s)
+	case *VacuumStmt:
+		return db.vacuum(ctx, s)
+	}
+	if at := asOf(stmt); !at.IsZero() {
+		return db.history(ctx, stmt, at)
+	}
+
+	if isReadOnly(stmt) {
+		defer db.latch(stmt)()
+		return db.execute(db.reader(ctx), stmt)
+	}
+
+	tx := db.Begin()
+	result, err := tx.run(ctx, stmt)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// backup needs no latch: it copies the storage engine's files, which
+// commits only append to and checkpoints only replace whole.
+func (db *DB) backup(stmt *BackupStmt) (*Result, error) {
+	wal, ok := db.storage.(*WALStorage)
+	if !ok {
+		return nil, fmt.Errorf("BACKUP needs the wal storage engine")
+	}
+	info, added, err := wal.Backup(stmt.Path, stmt.Incremental)
+	if err != nil {
+		return nil, err
+	}
+	if added == 0 {
+		return &Result{Message: fmt.Sprintf("Backup in %s is up to date at commit %d", stmt.Path, info.lsn())}, nil
+	}
+	return &Result{Message: fmt.Sprintf("Backed up to commit %d in %s", info.lsn(), stmt.Path)}, nil
+}
+
+// vacuum collects garbage now rather than when commits next get to it,
+// reclaims the tombstones of the tables, and checkpoints so that the dead
+// versions in the data file go too. Reclaiming moves rows, so it waits
+// for open cursors to be closed.
+func (db *DB) vacuum(ctx context.Context, stmt *VacuumStmt) (result *Result, err error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	if err := db.lockUnpinned(ctx); err != nil {
+		return nil, err
+	}
+	defer db.mu.Unlock()
+	defer recoverStorage(&err)
+
+	tables := make([]*Table, 0)
+	if stmt.Table != "" {
+		table, exists := db.tables[stmt.Table]
+		if !exists {
+			return nil, &NotFoundError{Kind: "table", Name: stmt.Table}
+		}
+		tables = append(tables, table)
+	} else {
+		for _, table := range db.tables {
+			tables = append(tables, table)
+		}
+	}
+
+	db.collectGarbage()
+	reclaimed := 0
+	for _, table := range tables {
+		reclaimed += table.tombstones
+		for _, v := range table.baseVersions {
+			if v.xmin == abortedTxID {
+				reclaimed++
+			}
+		}
+		table.compact()
+	}
+	if err := db.checkpoint(); err != nil {
+		return nil, err
+	}
+	return &Result{Message: fmt.Sprintf("%d table(s) vacuumed, %d dead row version(s) reclaimed", len(tables), reclaimed)}, nil
+}
+
+// asOf returns the time a query reads the database as of, or zero.
+func asOf(stmt Statement) time.Time {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		return s.AsOf
+	case *ExplainStmt:
+		return asOf(s.Query)
+	}
+	return time.Time{}
+}
+
+// history runs a query AS OF TIMESTAMP on the database as it was at that
+// time. It sees what was committed then, whatever transaction runs it.
+func (db *DB) history(ctx context.Context, stmt Statement, at time.Time) (*Result, error) {
+	wal, ok := db.storage.(*WALStorage)
+	if !ok {
+		return nil, fmt.Errorf("AS OF TIMESTAMP needs the wal storage engine")
+	}
+	db.mu.RLock()
+	past, err := wal.History(at)
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	defer past.latch(stmt)()
+	return past.execute(past.reader(ctx), stmt)
+}
+
+// latch takes the latches stmt needs and returns what releases them: mu
+// exclusive for a statement changing the catalog; otherwise mu shared,
+// then the tables the statement reads shared and the one it changes
+// exclusive.
+func (db *DB) latch(stmt Statement) func() {
+	if isDDL(stmt) {
+		db.mu.Lock()
+		return db.mu.Unlock
+	}
+	db.mu.RLock()
+	exclusive := make(map[string]bool)
+	for _, name := range statementTables(stmt) {
+		exclusive[name] = false
+	}
+	if name := writtenTable(stmt); name != "" {
+		exclusive[name] = true
+	}
+	return db.latchTables(exclusive)
+}
+
+// latchTables latches the named tables, exclusive where the map says so,
+// under mu held shared, and returns what releases them and mu. Tables
+// are latched in name order, so statements latching several never wait
+// for each other in a cycle; names of missing tables are skipped.
+func (db *DB) latchTables(exclusive map[string]bool) func() {
+	names := make([]string, 0, len(exclusive))
+	for name := range exclusive {
+		if _, exists := db.tables[name]; exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	unlock := make([]func(), 0, len(names))
+	for _, name := range names {
+		latch := &db.tables[name].latch
+		if exclusive[name] {
+			latch.Lock()
+			unlock = append(unlock, latch.Unlock)
+		} else {
+			latch.RLock()
+			unlock = append(unlock, latch.RUnlock)
+		}
+	}
+	return func() {
+		for i := len(unlock) - 1; i >= 0; i-- {
+			unlock[i]()
+		}
+		db.mu.RUnlock()
+	}
+}
+
+// execute runs a statement in tx; the caller holds the latches it needs.
+// A statement whose context ran out while it waited for them does not
+// start.
+func (db *DB) execute(tx *Tx, stmt Statement) (result *Result, err error) {
+	defer recoverStorage(&err)
+	if err := interrupted(tx.ctx); err != nil {
+		return nil, err
+	}
 
 	switch s := stmt.(type) {
 	case *CreateTableStmt:
-		return db.executeCreate(s)
+		return db.executeCreate(tx, s)
+	case *CreateTypeStmt:
+		return db.executeCreateType(tx, s)
+	case *CreateIndexStmt:
+		return db.executeCreateIndex(tx, s)
+	case *DropIndexStmt:
+		return db.executeDropIndex(tx, s)
+	case *ExplainStmt:
+		return db.executeExplain(tx, s)
+	case *AnalyzeStmt:
+		return db.executeAnalyze(tx, s)
 	case *InsertStmt:
-		return db.executeInsert(s)
+		return db.executeInsert(tx, s)
 	case *SelectStmt:
-		return db.executeSelect(s)
+		return db.executeSelect(tx, s)
 	case *UpdateStmt:
-		return db.executeUpdate(s)
+		return db.executeUpdate(tx, s)
 	case *DeleteStmt:
-		return db.executeDelete(s)
+		return db.executeDelete(tx, s)
 	default:
 		return nil, fmt.Errorf("unknown statement type")
 	}
 }
 
-func (db *Database) executeCreate(stmt *CreateTableStmt) (*QueryResult, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
+func (db *DB) executeCreate(tx *Tx, stmt *CreateTableStmt) (*Result, error) {
 	if _, exists := db.tables[stmt.Name]; exists {
 		return nil, fmt.Errorf("table %s already exists", stmt.Name)
 	}
 
-	db.tables[stmt.Name] = NewTable(stmt.Name, stmt.Columns)
-	err := db.Save()
+	for _, col := range stmt.Columns {
+		if col.Type == TypeEnum {
+			if _, exists := db.types[col.EnumType]; !exists {
+				return nil, fmt.Errorf("unknown type: %s", col.EnumType)
+			}
+		}
+	}
+
+	table := newTable(stmt.Name, stmt.Columns)
+	table.useTypes(db.types)
+	table.mgr = db.txm
+	db.tables[stmt.Name] = table
+	tx.undo.log(walChange{Op: walCreateTable, Table: stmt.Name, Columns: stmt.Columns}, func() { delete(db.tables, stmt.Name) })
+	return &Result{Message: fmt.Sprintf("Table %s created", stmt.Name)}, nil
+}
+
+func (db *DB) executeCreateType(tx *Tx, stmt *CreateTypeStmt) (*Result, error) {
+	if _, exists := db.types[stmt.Name]; exists {
+		return nil, fmt.Errorf("type %s already exists", stmt.Name)
+	}
+
+	enum, err := NewEnumType(stmt.Name, stmt.Values)
 	if err != nil {
 		return nil, err
 	}
-	return &QueryResult{Message: fmt.Sprintf("Table %s created", stmt.Name)}, nil
-}
 
-func (db *Database) executeInsert(stmt *InsertStmt) (*QueryResult, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	db.types[stmt.Name] = enum
+	tx.undo.log(walChange{Op: walCreateType, Type: enum}, func() { delete(db.types, stmt.Name) })
+	return &Result{Message: fmt.Sprintf("Type %s created", stmt.Name)}, nil
+}
 
+func (db *DB) executeCreateIndex(tx *Tx, stmt *CreateIndexStmt) (*Result, error) {
 	table, exists := db.tables[stmt.Table]
 	if !exists {
-		return nil, fmt.Errorf("table %s does not exist", stmt.Table)
+		return nil, &NotFoundError{Kind: "table", Name: stmt.Table}
+	}
+	if owner := db.indexOwner(stmt.Name); owner != nil {
+		return nil, fmt.Errorf("index %s already exists on table %s", stmt.Name, owner.Name)
 	}
 
-	if err := table.Insert(stmt.Values); err != nil {
+	if err := table.CreateIndex(stmt.Name, stmt.Columns, stmt.Unique, stmt.Kind); err != nil {
 		return nil, err
 	}
+	def := table.indexes[stmt.Name].Def()
+	tx.undo.log(walChange{Op: walCreateIndex, Table: table.Name, Index: &def}, func() { delete(table.indexes, stmt.Name) })
 
-	err := db.Save()
-	if err != nil {
+	return &Result{Message: fmt.Sprintf("Index %s created", stmt.Name)}, nil
+}
+
+func (db *DB) executeDropIndex(tx *Tx, stmt *DropIndexStmt) (*Result, error) {
+	table := db.indexOwner(stmt.Name)
+	if table == nil {
+		return nil, &NotFoundError{Kind: "index", Name: stmt.Name}
+	}
+
+	index := table.indexes[stmt.Name]
+	if err := table.DropIndex(stmt.Name); err != nil {
 		return nil, err
 	}
-	return &QueryResult{Message: "1 row inserted"}, nil
+	tx.undo.log(walChange{Op: walDropIndex, Table: table.Name, Name: stmt.Name}, func() { table.restoreIndex(index) })
+
+	return &Result{Message: fmt.Sprintf("Index %s dropped", stmt.Name)}, nil
+}
+
+// indexOwner returns the table holding the named index. Index names are
+// unique across the database.
+func (db *DB) indexOwner(name string) *Table {
+	for _, table := range db.tables {
+		if _, exists := table.indexes[name]; exists {
+			return table
+		}
+	}
+	return nil
 }
 
-func (db *Database) executeSelect(stmt *SelectStmt) (*QueryResult, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
+func (db *DB) executeAnalyze(tx *Tx, stmt *AnalyzeStmt) (*Result, error) {
+	tables := make([]*Table, 0)
+	if stmt.Table != "" {
+		table, exists := db.tables[stmt.Table]
+		if !exists {
+			return nil, &NotFoundError{Kind: "table", Name: stmt.Table}
+		}
+		tables = append(tables, table)
+	} else {
+		for _, table := range db.tables {
+			tables = append(tables, table)
+		}
+	}
 
+	for _, table := range tables {
+		table.Analyze(tx)
+	}
+
+	return &Result{Message: fmt.Sprintf("%d table(s) analyzed", len(tables))}, nil
+}
+
+func (db *DB) executeInsert(tx *Tx, stmt *InsertStmt) (*Result, error) {
 	table, exists := db.tables[stmt.Table]
 	if !exists {
-		return nil, fmt.Errorf("table %s does not exist", stmt.Table)
+		return nil, &NotFoundError{Kind: "table", Name: stmt.Table}
+	}
+
+	if err := table.lockTable(tx, lockIX); err != nil {
+		return nil, err
+	}
+	if err := table.Insert(tx, stmt.Values); err != nil {
+		return nil, err
 	}
 
-	rows := table.Select(stmt.Columns, stmt.Where)
+	return &Result{Message: "1 row inserted", RowsAffected: 1}, nil
+}
 
-	columns := stmt.Columns
-	if len(columns) == 1 && columns[0] == "*" {
-		columns = make([]string, len(table.Columns))
-		for i, col := range table.Columns {
-			columns[i] = col.Name
+func (db *DB) executeSelect(tx *Tx, stmt *SelectStmt) (*Result, error) {
+	if stmt.Lock != lockNone {
+		if err := db.lockSelected(tx, stmt); err != nil {
+			return nil, err
 		}
 	}
+	plan, columns, err := db.planSelect(tx.ctx, stmt, tx.snapshot())
+	if err != nil {
+		return nil, err
+	}
 
-	return &QueryResult{Columns: columns, Rows: rows}, nil
+	rows, err := runPlan(plan)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Columns: columns, Rows: rows}, nil
 }
 
-func (db *Database) executeUpdate(stmt *UpdateStmt) (*QueryResult, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
+// lockSelected locks the rows a SELECT ... FOR UPDATE or FOR SHARE reads,
+// failing as an UPDATE would if another transaction changed one of them
+// since the snapshot. Every row matching WHERE is locked, even those a
+// LIMIT leaves out.
+func (db *DB) lockSelected(tx *Tx, stmt *SelectStmt) error {
 	table, exists := db.tables[stmt.Table]
 	if !exists {
-		return nil, fmt.Errorf("table %s does not exist", stmt.Table)
+		return &NotFoundError{Kind: "table", Name: stmt.Table}
 	}
-
-	count := table.Update(stmt.Updates, stmt.Where)
-	err := db.Save()
+	for _, col := range stmt.Columns {
+		if _, _, ok := parseAggregate(col); ok {
+			return fmt.Errorf("FOR UPDATE and FOR SHARE are not supported with aggregates")
+		}
+	}
+	positions, err := table.matchingPositions(tx.ctx, tx.snapshot(), stmt.Where)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &QueryResult{Message: fmt.Sprintf("%d row(s) updated", count)}, nil
+	for _, i := range positions {
+		if err := table.lockRow(tx, i, stmt.Lock); err != nil {
+			return err
+		}
+		if err := table.checkWritable(tx, i); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (db *Database) executeDelete(stmt *DeleteStmt) (*QueryResult, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
+func (db *DB) executeUpdate(tx *Tx, stmt *UpdateStmt) (*Result, error) {
 	table, exists := db.tables[stmt.Table]
 	if !exists {
-		return nil, fmt.Errorf("table %s does not exist", stmt.Table)
+		return nil, &NotFoundError{Kind: "table", Name: stmt.Table}
 	}
 
-	count := table.Delete(stmt.Where)
-	err := db.Save()
+	count, err := table.Update(tx, stmt.Updates, stmt.Where)
 	if err != nil {
 		return nil, err
 	}
-	return &QueryResult{Message: fmt.Sprintf("%d row(s) deleted", count)}, nil
+	return &Result{Message: fmt.Sprintf("%d row(s) updated", count), RowsAffected: count}, nil
 }
 
-func (r *QueryResult) Print() {
-	if r.Message != "" {
-		fmt.Println(r.Message)
-		return
-	}
-
-	if len(r.Rows) == 0 {
-		fmt.Println("No results")
-		return
+func (db *DB) executeDelete(tx *Tx, stmt *DeleteStmt) (*Result, error) {
+	table, exists := db.tables[stmt.Table]
+	if !exists {
+		return nil, &NotFoundError{Kind: "table", Name: stmt.Table}
 	}
 
-	// Print header
-	for i, col := range r.Columns {
-		if i > 0 {
-			fmt.Print(" | ")
-		}
-		fmt.Printf("%-15s", col)
+	count, err := table.Delete(tx, stmt.Where)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println()
-	fmt.Println(strings.Repeat("-", len(r.Columns)*18))
+	return &Result{Message: fmt.Sprintf("%d row(s) deleted", count), RowsAffected: count}, nil
+}
 
-	// Print rows
-	for _, row := range r.Rows {
-		for i, col := range r.Columns {
-			if i > 0 {
-				fmt.Print(" | ")
-			}
-			fmt.Printf("%-15v", row[col])
-		}
-		fmt.Println()
-	}
-	fmt.Printf("\n%d row(s)\n", len(r.Rows))
+// Print writes the message, or the rows as a table, to w.
+func (r *Result) Print(w io.Writer) error {
+	return r.cursor().Print(w)
 }
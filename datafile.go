@@ -0,0 +1,405 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// A checkpoint writes the whole database to a new data file: a header page,
+// then for each table its heap pages, the directory of those pages and a
+// pageTree per index, then the catalog describing all of it, and finally a
+// trailer page locating the catalog. Positions in the new file are
+// renumbered from zero, skipping versions no one can see any more.
+
+// dataCatalog is stored as JSON in blob pages. Statistics and index
+// definitions are small; rows never go through it. Time is when the last
+// commit the file holds was logged.
+type dataCatalog struct {
+	Time   time.Time      `json:"time,omitzero"`
+	Types  []*EnumType    `json:"types"`
+	Tables []catalogTable `json:"tables"`
+}
+
+type catalogTable struct {
+	snapshotTable
+	Rows         int               `json:"rows"`
+	Directory    pageID            `json:"directory"`
+	DirectoryLen int               `json:"directory_len"`
+	Trees        map[string]pageID `json:"trees"` // index name -> root page
+}
+
+// Offsets in the header and trailer pages, after the page header.
+const (
+	magicOffset   = pageHeader
+	versionOffset = magicOffset + len(dataFileMagic)
+	lsnOffset     = versionOffset + 4
+	catalogOffset = lsnOffset + 8
+)
+
+// Where a version goes at a checkpoint.
+const (
+	fateDrop  = iota // no one can see it
+	fateBase         // visible to the latest snapshot: written to the data file
+	fateDelta        // only some open transactions see it: kept in memory
+)
+
+// fate decides where the version at position i goes. Versions visible to
+// the latest snapshot move to the data file even if an older snapshot
+// cannot see them yet; their version record then keeps saying so.
+func (t *Table) fate(i int, horizon uint64) int {
+	v := t.version(i)
+	if v.xmin == abortedTxID {
+		return fateDrop
+	}
+	if _, ok := t.mgr.committedAt(v.xmin); !ok {
+		return fateDelta
+	}
+	if v.xmax != 0 {
+		if ts, ok := t.mgr.committedAt(v.xmax); ok {
+			if ts <= horizon {
+				return fateDrop
+			}
+			return fateDelta
+		}
+	}
+	return fateBase
+}
+
+// tableCheckpoint is what a table becomes once the data file written for
+// it is in place. Version records keep their identity, since undo entries
+// of open transactions point at them.
+type tableCheckpoint struct {
+	table        *Table
+	baseVersions map[int]*rowVersion
+	tuples       []rowTuple
+	versions     []*rowVersion
+}
+
+// writeDataFile writes every table of db to w and returns the catalog and
+// how each table splits between the new file and memory. lsn and committed
+// are the last commit it holds. The caller holds mu exclusive.
+func writeDataFile(w io.Writer, db *DB, lsn uint64, committed time.Time) (catalog *dataCatalog, checkpoints []*tableCheckpoint, err error) {
+	defer recoverStorage(&err)
+
+	pw := &pageWriter{w: w}
+	header := newPage(pageFileHeader)
+	copy(header[magicOffset:], dataFileMagic)
+	binary.LittleEndian.PutUint32(header[versionOffset:], dataFileVersion)
+	if _, err := pw.write(header); err != nil {
+		return nil, nil, err
+	}
+
+	catalog = &dataCatalog{Time: committed}
+	for _, enum := range db.types {
+		catalog.Types = append(catalog.Types, enum)
+	}
+	sort.Slice(catalog.Types, func(i, j int) bool { return catalog.Types[i].Name < catalog.Types[j].Name })
+
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	horizon := db.txm.horizon()
+	for _, name := range names {
+		ct, tc, err := writeTable(pw, db.tables[name], horizon)
+		if err != nil {
+			return nil, nil, err
+		}
+		catalog.Tables = append(catalog.Tables, ct)
+		checkpoints = append(checkpoints, tc)
+	}
+
+	body, err := json.Marshal(catalog)
+	if err != nil {
+		return nil, nil, err
+	}
+	first, err := pw.writeBlob(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	trailer := newPage(pageTrailer)
+	copy(trailer[magicOffset:], dataFileMagic)
+	binary.LittleEndian.PutUint32(trailer[versionOffset:], dataFileVersion)
+	binary.LittleEndian.PutUint64(trailer[lsnOffset:], lsn)
+	copy(trailer[catalogOffset:], blobRef(first, len(body)))
+	if _, err := pw.write(trailer); err != nil {
+		return nil, nil, err
+	}
+	return catalog, checkpoints, nil
+}
+
+func writeTable(pw *pageWriter, t *Table, horizon uint64) (catalogTable, *tableCheckpoint, error) {
+	ct := catalogTable{snapshotTable: t.schema(), Trees: make(map[string]pageID)}
+	tc := &tableCheckpoint{table: t, baseVersions: make(map[int]*rowVersion)}
+
+	// removed lists the versions of the old data file that leave it, and
+	// moved gives the new position of each version in memory, or -1
+	oldBase := t.baseRows()
+	var removed []int
+	moved := make([]int, len(t.tuples))
+	heap := &heapWriter{pw: pw}
+	for i := 0; i < t.rowCount(); i++ {
+		v := t.version(i)
+		fate := t.fate(i, horizon)
+		if fate != fateBase {
+			if i < oldBase {
+				removed = append(removed, i)
+			} else {
+				moved[i-oldBase] = -1
+			}
+			if fate == fateDelta {
+				tc.tuples = append(tc.tuples, t.tuple(i))
+				tc.versions = append(tc.versions, v)
+			}
+			continue
+		}
+
+		var tuple []byte
+		var err error
+		if i < oldBase {
+			tuple, err = t.base.tuple(i)
+		} else {
+			tuple, err = encodeTuple(t.tuples[i-oldBase])
+			moved[i-oldBase] = heap.count
+		}
+		if err != nil {
+			return ct, nil, err
+		}
+		if ts, ok := t.mgr.committedAt(v.xmin); !ok || ts > horizon || v.xmax != 0 {
+			tc.baseVersions[heap.count] = v
+		}
+		if err := heap.add(tuple); err != nil {
+			return ct, nil, err
+		}
+	}
+
+	var err error
+	ct.Rows = heap.count
+	if ct.Directory, ct.DirectoryLen, err = heap.finish(); err != nil {
+		return ct, nil, err
+	}
+
+	newPos := func(i int) int {
+		if i >= oldBase {
+			return moved[i-oldBase]
+		}
+		k := sort.SearchInts(removed, i)
+		if k < len(removed) && removed[k] == i {
+			return -1
+		}
+		return i - k
+	}
+	for _, name := range sortedIndexNames(t) {
+		root, err := writeTree(pw, t, t.indexes[name], newPos)
+		if err != nil {
+			return ct, nil, err
+		}
+		ct.Trees[name] = root
+	}
+	return ct, tc, nil
+}
+
+func sortedIndexNames(t *Table) []string {
+	names := make([]string, 0, len(t.indexes))
+	for name := range t.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type treeEntry struct {
+	key []interface{}
+	raw []byte
+	pos int
+}
+
+// writeTree writes the pageTree of index for the new data file. Entries
+// already in the old file's tree come out of it in order; only those in
+// memory need sorting, and the two are merged.
+func writeTree(pw *pageWriter, t *Table, index *tableIndex, newPos func(int) int) (pageID, error) {
+	compare := tupleCompare(index.Columns, t.compare)
+
+	var fresh []treeEntry
+	for i := index.base; i < t.rowCount(); i++ {
+		pos := newPos(i)
+		if pos < 0 {
+			continue
+		}
+		tuple := t.tuple(i)
+		if _, ok := index.key(tuple); !ok && !index.ordered() {
+			continue
+		}
+		key := index.sortKey(tuple)
+		raw, err := encodeTuple(key)
+		if err != nil {
+			return noPage, err
+		}
+		fresh = append(fresh, treeEntry{key: key, raw: raw, pos: pos})
+	}
+	sort.Slice(fresh, func(a, b int) bool {
+		if cmp := compare(fresh[a].key, fresh[b].key); cmp != 0 {
+			return cmp < 0
+		}
+		return fresh[a].pos < fresh[b].pos
+	})
+
+	builder := &treeBuilder{pw: pw}
+	var path treePath
+	if index.paged != nil {
+		path = index.paged.descend(nil, false)
+	}
+	for path != nil || len(fresh) > 0 {
+		if path != nil {
+			key, n, raw := index.paged.entry(path)
+			pos := newPos(n)
+			if pos < 0 {
+				path = index.paged.step(path, false)
+				continue
+			}
+			// Old entries go first among equal keys; their rows come first
+			if len(fresh) == 0 || compare(key, fresh[0].key) <= 0 {
+				if err := builder.add(raw, pos); err != nil {
+					return noPage, err
+				}
+				path = index.paged.step(path, false)
+				continue
+			}
+		}
+		if err := builder.add(fresh[0].raw, fresh[0].pos); err != nil {
+			return noPage, err
+		}
+		fresh = fresh[1:]
+	}
+	return builder.finish()
+}
+
+// readCatalog checks the header and trailer of df and returns its catalog
+// and the log position it was written at.
+func (df *dataFile) readCatalog() (*dataCatalog, uint64, error) {
+	header, err := df.page(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	trailer, err := df.page(pageID(df.pages - 1))
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, p := range []page{header, trailer} {
+		if string(p[magicOffset:versionOffset]) != dataFileMagic {
+			return nil, 0, fmt.Errorf("data file is corrupt: bad magic")
+		}
+		if version := binary.LittleEndian.Uint32(p[versionOffset:]); version > dataFileVersion {
+			return nil, 0, fmt.Errorf("data file has format version %d; this build reads up to %d", version, dataFileVersion)
+		}
+	}
+	if header.kind() != pageFileHeader || trailer.kind() != pageTrailer {
+		return nil, 0, fmt.Errorf("data file is corrupt: missing header or trailer")
+	}
+
+	ref := trailer[catalogOffset:]
+	body, err := df.blob(binary.LittleEndian.Uint32(ref), int(binary.LittleEndian.Uint32(ref[4:])))
+	if err != nil {
+		return nil, 0, err
+	}
+	catalog := &dataCatalog{}
+	if err := unmarshalNumbers(body, catalog); err != nil {
+		return nil, 0, fmt.Errorf("data file is corrupt: bad catalog: %v", err)
+	}
+	return catalog, binary.LittleEndian.Uint64(trailer[lsnOffset:]), nil
+}
+
+// loadDataFile builds the tables described by the catalog of df, leaving
+// their rows on disk, and returns the log position df was written at and
+// when that commit was logged.
+func loadDataFile(db *DB, df *dataFile) (uint64, time.Time, error) {
+	catalog, lsn, err := df.readCatalog()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	for _, enum := range catalog.Types {
+		db.types[enum.Name] = enum
+	}
+
+	for _, ct := range catalog.Tables {
+		columns, err := ct.columns()
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		table := newTable(ct.Name, columns)
+		table.useTypes(db.types)
+		table.mgr = db.txm
+		// Indexes are created while the table looks empty, so nothing is
+		// read to build them
+		for _, def := range ct.Indexes {
+			if err := table.CreateIndex(def.Name, def.Columns, def.Unique, def.Kind); err != nil {
+				return 0, time.Time{}, err
+			}
+		}
+		heap, err := openHeap(df, ct.Directory, ct.DirectoryLen, ct.Rows)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if err := table.attach(heap, ct); err != nil {
+			return 0, time.Time{}, err
+		}
+		table.live = heap.count
+		if ct.Stats != nil {
+			if err := table.decodeStats(ct.Stats); err != nil {
+				return 0, time.Time{}, err
+			}
+		}
+		table.stats = ct.Stats
+		db.tables[ct.Name] = table
+	}
+	return lsn, catalog.Time, nil
+}
+
+// attach makes heap the table's versions on disk and points every index
+// at its tree in the same file.
+func (t *Table) attach(heap *heapFile, ct catalogTable) error {
+	for name := range t.indexes {
+		if _, ok := ct.Trees[name]; !ok {
+			return fmt.Errorf("data file is corrupt: no tree for index %s", name)
+		}
+	}
+	t.base = heap
+	for name, index := range t.indexes {
+		index.paged = &pageTree{file: heap.file, root: ct.Trees[name], compare: tupleCompare(index.Columns, t.compare)}
+		index.base = heap.count
+	}
+	return nil
+}
+
+// installCheckpoint switches every table over to the data file df just
+// written by a checkpoint.
+func (db *DB) installCheckpoint(df *dataFile, catalog *dataCatalog, checkpoints []*tableCheckpoint) error {
+	heaps := make([]*heapFile, len(checkpoints))
+	for i, ct := range catalog.Tables {
+		heap, err := openHeap(df, ct.Directory, ct.DirectoryLen, ct.Rows)
+		if err != nil {
+			return err
+		}
+		heaps[i] = heap
+	}
+
+	for i, tc := range checkpoints {
+		t := tc.table
+		if err := t.attach(heaps[i], catalog.Tables[i]); err != nil {
+			return err
+		}
+		t.baseVersions = tc.baseVersions
+		t.tuples, t.versions = tc.tuples, tc.versions
+		t.tombstones = 0
+		if t.tuples == nil {
+			t.tuples = make([]rowTuple, 0)
+		}
+		t.rebuildIndexes()
+	}
+	return nil
+}
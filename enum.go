@@ -0,0 +1,45 @@
+package minidb
+
+import (
+	"fmt"
+)
+
+// EnumType is a user-defined type created with CREATE TYPE ... AS ENUM.
+// Values sort in declaration order.
+type EnumType struct {
+	Name   string
+	Values []string
+}
+
+func NewEnumType(name string, values []string) (*EnumType, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("enum %s must have at least one value", name)
+	}
+
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if seen[v] {
+			return nil, fmt.Errorf("duplicate value %q in enum %s", v, name)
+		}
+		seen[v] = true
+	}
+
+	return &EnumType{Name: name, Values: values}, nil
+}
+
+func (e *EnumType) Ordinal(val string) int {
+	for i, v := range e.Values {
+		if v == val {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *EnumType) Validate(colName string, val interface{}) error {
+	s, ok := val.(string)
+	if !ok || e.Ordinal(s) < 0 {
+		return fmt.Errorf("invalid value for %s: %v is not one of %v", colName, val, e.Values)
+	}
+	return nil
+}
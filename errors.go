@@ -0,0 +1,72 @@
+package minidb
+
+import "fmt"
+
+// Besides the errors of this file, statements fail with these sentinels,
+// which errors.Is matches: ErrWriteConflict and ErrSerialization when a
+// transaction loses to a concurrent one and should be retried, ErrDeadlock
+// when it was rolled back to break a deadlock, ErrStatementTimeout,
+// ErrReadOnly and ErrTxDone.
+
+// SyntaxError is returned for a statement that cannot be parsed.
+type SyntaxError struct {
+	Query string
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+// NotFoundError is returned for a statement naming a table, column, index,
+// type, database or savepoint that does not exist.
+type NotFoundError struct {
+	Kind  string // "table", "column", "index", "type", "database" or "savepoint"
+	Name  string
+	Table string // of a column, if known
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Table != "" {
+		return fmt.Sprintf("%s %s does not exist in table %s", e.Kind, e.Name, e.Table)
+	}
+	return fmt.Sprintf("%s %s does not exist", e.Kind, e.Name)
+}
+
+// ConstraintError is returned for a write that would break a constraint:
+// a NULL in a NOT NULL column, or a key already in a unique index.
+type ConstraintError struct {
+	Table  string
+	Column string // the NOT NULL column, for a NULL
+	Index  string // the unique index, for a duplicate key
+	msg    string
+}
+
+func (e *ConstraintError) Error() string {
+	return e.msg
+}
+
+func notNullError(t *Table, column string) error {
+	return &ConstraintError{Table: t.Name, Column: column, msg: fmt.Sprintf("column %s cannot be null", column)}
+}
+
+func uniqueError(t *Table, index *tableIndex, tuple rowTuple) error {
+	err := &ConstraintError{Table: t.Name, Index: index.Name}
+	if index.Implicit {
+		err.msg = fmt.Sprintf("duplicate value for %s: %v", index.Columns[0], tuple[index.ords[0]])
+	} else {
+		err.msg = fmt.Sprintf("duplicate key %s violates unique index %s", index.describeKey(tuple), index.Name)
+	}
+	return err
+}
+
+// InUseError is returned for opening a database, other than read-only,
+// that another process has open.
+type InUseError struct {
+	Owner    string // "process PID", or "another process"
+	LockFile string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("database is in use by %s (lock file %s); attach read-only to read it meanwhile", e.Owner, e.LockFile)
+}
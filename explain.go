@@ -0,0 +1,130 @@
+package minidb
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// analyzedNode wraps an operator for EXPLAIN ANALYZE, recording the rows it
+// produces and the time spent in it, including time spent in its inputs.
+type analyzedNode struct {
+	PlanNode
+}
+
+func (n *analyzedNode) Open() error {
+	start := time.Now()
+	err := n.PlanNode.Open()
+	info := n.Info()
+	info.Loops++
+	info.Elapsed += time.Since(start)
+	return err
+}
+
+func (n *analyzedNode) Next() (Row, bool, error) {
+	start := time.Now()
+	row, ok, err := n.PlanNode.Next()
+	info := n.Info()
+	if ok {
+		info.ActualRows++
+	}
+	info.Elapsed += time.Since(start)
+	return row, ok, err
+}
+
+func (n *analyzedNode) Close() {
+	start := time.Now()
+	n.PlanNode.Close()
+	n.Info().Elapsed += time.Since(start)
+}
+
+// instrument wraps every operator in the tree rooted at node.
+func instrument(node PlanNode) PlanNode {
+	switch n := node.(type) {
+	case *filterNode:
+		n.child = instrument(n.child)
+	case *sortNode:
+		n.child = instrument(n.child)
+	case *limitNode:
+		n.child = instrument(n.child)
+	case *projectNode:
+		n.child = instrument(n.child)
+	case *aggregateNode:
+		n.child = instrument(n.child)
+	case *hashJoinNode:
+		n.build = instrument(n.build)
+		n.probe = instrument(n.probe)
+	case *indexNestedLoopJoinNode:
+		n.outer = instrument(n.outer)
+	case *mergeJoinNode:
+		n.left = instrument(n.left)
+		n.right = instrument(n.right)
+	case *nestedLoopJoinNode:
+		n.left = instrument(n.left)
+		n.right = instrument(n.right)
+	}
+	return &analyzedNode{PlanNode: node}
+}
+
+func (db *DB) executeExplain(tx *Tx, stmt *ExplainStmt) (*Result, error) {
+	plan, _, err := db.planSelect(tx.ctx, stmt.Query, tx.snapshot())
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{"operator", "detail", "index", "est_rows", "cost"}
+	var elapsed time.Duration
+	if stmt.Analyze {
+		columns = append(columns, "actual_rows", "loops", "time_ms")
+		start := time.Now()
+		if _, err := runPlan(instrument(plan)); err != nil {
+			return nil, err
+		}
+		elapsed = time.Since(start)
+	}
+
+	rows := explainRows(plan, 0, stmt.Analyze, make([]Row, 0))
+	if stmt.Analyze {
+		total := make(Row, len(columns))
+		for _, col := range columns {
+			total[col] = ""
+		}
+		total["operator"] = "Execution Time"
+		total["time_ms"] = milliseconds(elapsed)
+		rows = append(rows, total)
+	}
+	return &Result{Columns: columns, Rows: rows}, nil
+}
+
+// explainRows flattens the plan into one row per operator, indenting each
+// operator under its parent.
+func explainRows(node PlanNode, depth int, analyze bool, rows []Row) []Row {
+	info := node.Info()
+
+	operator := info.Name
+	if depth > 0 {
+		operator = strings.Repeat("  ", depth-1) + "-> " + info.Name
+	}
+	row := Row{
+		"operator": operator,
+		"detail":   info.Detail,
+		"index":    info.Index,
+		"est_rows": int(math.Round(info.EstRows)),
+		"cost":     math.Round(info.Cost*100) / 100,
+	}
+	if analyze {
+		row["actual_rows"] = info.ActualRows
+		row["loops"] = info.Loops
+		row["time_ms"] = milliseconds(info.Elapsed)
+	}
+	rows = append(rows, row)
+
+	for _, child := range info.Children {
+		rows = explainRows(child, depth+1, analyze, rows)
+	}
+	return rows
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Millisecond)*1000) / 1000
+}
@@ -0,0 +1,263 @@
+package minidb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// scalarExpr is a scalar expression used in SELECT lists, WHERE clauses and
+// UPDATE assignments: a column reference, a literal, a function call or a
+// JSON path operator (-> / ->>).
+type scalarExpr struct {
+	Kind  string // "column", "literal", "call", "->", "->>"
+	Name  string // column or function name
+	Value interface{}
+	Args  []*scalarExpr
+	Text  string
+}
+
+type exprFunc func(args []interface{}, exprs []*scalarExpr) (interface{}, error)
+
+var exprFunctions = map[string]exprFunc{
+	"json_extract":      jsonExtractFunc,
+	"json_array_length": jsonArrayLengthFunc,
+	"json_set":          jsonSetFunc,
+	"json_type":         jsonTypeFunc,
+	"json_valid":        jsonValidFunc,
+}
+
+// exprCacheSize bounds exprCache. Its keys come from query text, so
+// without a bound a client sending ever-different expressions would grow
+// it without end.
+const exprCacheSize = 1024
+
+// exprCache holds compiled expressions by text. Once full it is emptied
+// and starts over.
+var exprCache = struct {
+	sync.RWMutex
+	exprs map[string]*scalarExpr
+}{exprs: make(map[string]*scalarExpr)}
+
+func isFunctionName(tok string) bool {
+	_, ok := exprFunctions[strings.ToLower(tok)]
+	return ok
+}
+
+// isExprText reports whether a column reference needs expression evaluation
+// rather than a plain row lookup.
+func isExprText(s string) bool {
+	if len(s) > 0 && (s[0] == '\'' || s[0] == '"') {
+		return false
+	}
+	return strings.Contains(s, "->") || strings.Contains(s, "(")
+}
+
+func compileExpr(text string) (*scalarExpr, error) {
+	exprCache.RLock()
+	cached, ok := exprCache.exprs[text]
+	exprCache.RUnlock()
+	if ok {
+		return cached, nil
+	}
+
+	p := &exprParser{tokens: lexExpr(text)}
+	expr, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression %s", p.tokens[p.pos], text)
+	}
+	expr.Text = text
+
+	exprCache.Lock()
+	if len(exprCache.exprs) >= exprCacheSize {
+		exprCache.exprs = make(map[string]*scalarExpr)
+	}
+	exprCache.exprs[text] = expr
+	exprCache.Unlock()
+	return expr, nil
+}
+
+// lookupValue resolves a column reference or expression against a row. A
+// column the row lacks is reported as not existing; an expression that
+// does not compile or evaluate is an error.
+func lookupValue(row Row, ref string) (interface{}, bool, error) {
+	if val, exists := row[ref]; exists {
+		return val, true, nil
+	}
+	if !isExprText(ref) {
+		return nil, false, nil
+	}
+
+	expr, err := compileExpr(ref)
+	if err != nil {
+		return nil, false, err
+	}
+	val, err := expr.Eval(row)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+func (e *scalarExpr) Eval(row Row) (interface{}, error) {
+	switch e.Kind {
+	case "column":
+		val, exists := row[e.Name]
+		if !exists {
+			return nil, &NotFoundError{Kind: "column", Name: e.Name}
+		}
+		return val, nil
+	case "literal":
+		return e.Value, nil
+	case "->", "->>":
+		doc, err := e.Args[0].Eval(row)
+		if err != nil {
+			return nil, err
+		}
+		key, err := e.Args[1].Eval(row)
+		if err != nil {
+			return nil, err
+		}
+		return jsonArrow(doc, key, e.Kind == "->>")
+	case "call":
+		fn := exprFunctions[e.Name]
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			val, err := arg.Eval(row)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		return fn(args, e.Args)
+	}
+	return nil, fmt.Errorf("invalid expression %s", e.Text)
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *exprParser) parse() (*scalarExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "->" || p.peek() == "->>" {
+		op := p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		left = &scalarExpr{Kind: op, Args: []*scalarExpr{left, right}}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (*scalarExpr, error) {
+	tok := p.next()
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+
+	if tok[0] == '\'' || tok[0] == '"' {
+		return &scalarExpr{Kind: "literal", Value: parseValue(tok)}, nil
+	}
+	if _, err := strconv.ParseFloat(tok, 64); err == nil {
+		return &scalarExpr{Kind: "literal", Value: parseValue(tok)}, nil
+	}
+	if strings.ToUpper(tok) == "NULL" {
+		return &scalarExpr{Kind: "literal"}, nil
+	}
+
+	if p.peek() == "(" {
+		name := strings.ToLower(tok)
+		if _, ok := exprFunctions[name]; !ok {
+			return nil, fmt.Errorf("unknown function: %s", tok)
+		}
+		p.next()
+
+		call := &scalarExpr{Kind: "call", Name: name}
+		for p.peek() != ")" {
+			arg, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+			if p.peek() == "," {
+				p.next()
+			} else if p.peek() != ")" {
+				return nil, fmt.Errorf("expected , or ) in call to %s", tok)
+			}
+		}
+		p.next() // skip )
+		return call, nil
+	}
+
+	return &scalarExpr{Kind: "column", Name: tok}, nil
+}
+
+func lexExpr(text string) []string {
+	tokens := make([]string, 0)
+	i := 0
+
+	for i < len(text) {
+		ch := text[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == '(' || ch == ')' || ch == ',':
+			tokens = append(tokens, string(ch))
+			i++
+		case strings.HasPrefix(text[i:], "->>"):
+			tokens = append(tokens, "->>")
+			i += 3
+		case strings.HasPrefix(text[i:], "->"):
+			tokens = append(tokens, "->")
+			i += 2
+		case ch == '\'' || ch == '"':
+			j := i + 1
+			for j < len(text) {
+				if text[j] == ch {
+					if j+1 < len(text) && text[j+1] == ch {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			tokens = append(tokens, text[i:min(j+1, len(text))])
+			i = j + 1
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\n\r(),'\"", rune(text[j])) && !strings.HasPrefix(text[j:], "->") {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,349 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Snapshot bodies are JSON. Since format 2 the schema comes first and rows
+// are arrays in column order, so every value is decoded by its column's
+// type: an INT is read back as an int, never as a float64. Format 1 and
+// files without a header keep the older layout of one object per table
+// with rows as maps; they are still read, and rewritten in the current
+// format on load.
+
+// typesKey holds the enum type definitions next to the tables in a
+// format 1 file, and lsnKey the last write-ahead log record it contains.
+const (
+	typesKey = "$types"
+	lsnKey   = "$lsn"
+)
+
+var typeNames = map[DataType]string{
+	TypeInt:    "INT",
+	TypeString: "STRING",
+	TypeFloat:  "FLOAT",
+	TypeJSON:   "JSON",
+	TypeEnum:   "ENUM",
+}
+
+func (d DataType) String() string {
+	return typeNames[d]
+}
+
+func parseDataType(name string) (DataType, bool) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+type snapshotData struct {
+	Version int                        `json:"version"`
+	LSN     uint64                     `json:"lsn,omitempty"`
+	Schema  snapshotSchema             `json:"schema"`
+	Rows    map[string][][]interface{} `json:"rows"`
+}
+
+type snapshotSchema struct {
+	Types  []*EnumType     `json:"types"`
+	Tables []snapshotTable `json:"tables"`
+}
+
+type snapshotTable struct {
+	Name    string           `json:"name"`
+	Columns []snapshotColumn `json:"columns"`
+	Indexes []IndexDef       `json:"indexes"`
+	Stats   *TableStats      `json:"stats,omitempty"`
+}
+
+type snapshotColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	PrimaryKey bool   `json:"primary_key,omitempty"`
+	Unique     bool   `json:"unique,omitempty"`
+	NotNull    bool   `json:"not_null,omitempty"`
+	EnumType   string `json:"enum_type,omitempty"`
+}
+
+// encodeSnapshot returns the snapshot body holding the row versions
+// visible to snap.
+func encodeSnapshot(db *DB, snap snapshot, lsn uint64) ([]byte, error) {
+	data := snapshotData{Version: snapshotVersion, LSN: lsn, Rows: make(map[string][][]interface{})}
+
+	for _, enum := range db.types {
+		data.Schema.Types = append(data.Schema.Types, enum)
+	}
+	sort.Slice(data.Schema.Types, func(i, j int) bool { return data.Schema.Types[i].Name < data.Schema.Types[j].Name })
+
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		table := db.tables[name]
+		data.Schema.Tables = append(data.Schema.Tables, table.schema())
+
+		data.Rows[name] = table.visibleTuples(snap)
+	}
+
+	body, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// schema describes the table for a snapshot or data file catalog.
+func (t *Table) schema() snapshotTable {
+	st := snapshotTable{Name: t.Name, Indexes: t.IndexDefs(), Stats: t.stats}
+	for _, col := range t.Columns {
+		st.Columns = append(st.Columns, snapshotColumn{
+			Name:       col.Name,
+			Type:       col.Type.String(),
+			PrimaryKey: col.PrimaryKey,
+			Unique:     col.Unique,
+			NotNull:    col.NotNull,
+			EnumType:   col.EnumType,
+		})
+	}
+	return st
+}
+
+func (st snapshotTable) columns() ([]Column, error) {
+	columns := make([]Column, len(st.Columns))
+	for i, sc := range st.Columns {
+		dataType, ok := parseDataType(sc.Type)
+		if !ok {
+			return nil, fmt.Errorf("table %s: column %s has unknown type %s", st.Name, sc.Name, sc.Type)
+		}
+		columns[i] = Column{
+			Name:       sc.Name,
+			Type:       dataType,
+			PrimaryKey: sc.PrimaryKey,
+			Unique:     sc.Unique,
+			NotNull:    sc.NotNull,
+			EnumType:   sc.EnumType,
+		}
+	}
+	return columns, nil
+}
+
+// decodeSnapshot loads a current format snapshot body into db and returns
+// the log position it was written at.
+func decodeSnapshot(db *DB, body []byte) (uint64, error) {
+	var data snapshotData
+	if err := unmarshalNumbers(body, &data); err != nil {
+		return 0, fmt.Errorf("failed to decode data: %v", err)
+	}
+
+	for _, enum := range data.Schema.Types {
+		db.types[enum.Name] = enum
+	}
+	for _, st := range data.Schema.Tables {
+		columns, err := st.columns()
+		if err != nil {
+			return 0, err
+		}
+
+		table := newTable(st.Name, columns)
+		table.useTypes(db.types)
+		table.mgr = db.txm
+
+		tuples := make([]rowTuple, len(data.Rows[st.Name]))
+		for i, values := range data.Rows[st.Name] {
+			if len(values) != len(columns) {
+				return 0, fmt.Errorf("table %s: row %d has %d values for %d columns", st.Name, i, len(values), len(columns))
+			}
+			for j, col := range columns {
+				val, err := decodeValue(col, values[j])
+				if err != nil {
+					return 0, fmt.Errorf("table %s: %v", st.Name, err)
+				}
+				values[j] = val
+			}
+			tuples[i] = values
+		}
+		if err := table.restore(tuples, st.Indexes, st.Stats); err != nil {
+			return 0, err
+		}
+		db.tables[st.Name] = table
+	}
+	return data.LSN, nil
+}
+
+// decodeLegacySnapshot loads a format 1 snapshot body, converting values
+// that went through float64 back to their column types.
+func decodeLegacySnapshot(db *DB, body []byte) (uint64, error) {
+	var data map[string]json.RawMessage
+	if err := unmarshalNumbers(body, &data); err != nil {
+		return 0, fmt.Errorf("failed to decode data: %v", err)
+	}
+
+	var lsn uint64
+	if raw, exists := data[typesKey]; exists {
+		if err := json.Unmarshal(raw, &db.types); err != nil {
+			return 0, err
+		}
+		delete(data, typesKey)
+	}
+	if raw, exists := data[lsnKey]; exists {
+		if err := json.Unmarshal(raw, &lsn); err != nil {
+			return 0, err
+		}
+		delete(data, lsnKey)
+	}
+
+	for name, raw := range data {
+		var td struct {
+			Columns []Column
+			Rows    []Row
+			Indexes []IndexDef
+			Stats   *TableStats
+		}
+		if err := unmarshalNumbers(raw, &td); err != nil {
+			return 0, fmt.Errorf("table %s: %v", name, err)
+		}
+
+		table := newTable(name, td.Columns)
+		table.useTypes(db.types)
+		table.mgr = db.txm
+		tuples := make([]rowTuple, len(td.Rows))
+		for i, row := range td.Rows {
+			if err := table.decodeRow(row); err != nil {
+				return 0, err
+			}
+			tuples[i] = table.toTuple(row)
+		}
+		if err := table.restore(tuples, td.Indexes, td.Stats); err != nil {
+			return 0, err
+		}
+		db.tables[name] = table
+	}
+	return lsn, nil
+}
+
+// restore installs rows, indexes and statistics read from disk.
+func (t *Table) restore(tuples []rowTuple, indexes []IndexDef, stats *TableStats) error {
+	t.loadTuples(tuples)
+	t.rebuildIndexes()
+	for _, def := range indexes {
+		if err := t.CreateIndex(def.Name, def.Columns, def.Unique, def.Kind); err != nil {
+			return err
+		}
+	}
+	if stats != nil {
+		if err := t.decodeStats(stats); err != nil {
+			return err
+		}
+	}
+	t.stats = stats
+	return nil
+}
+
+// visibleTuples returns the versions of the table snap sees. It latches
+// the table, since a commit encoding the database runs beside statements
+// on other tables.
+func (t *Table) visibleTuples(snap snapshot) [][]interface{} {
+	t.latch.RLock()
+	defer t.latch.RUnlock()
+	rows := make([][]interface{}, 0, t.rowCount())
+	for i := 0; i < t.rowCount(); i++ {
+		if t.visible(snap, i) {
+			rows = append(rows, t.tuple(i))
+		}
+	}
+	return rows
+}
+
+// unmarshalNumbers decodes JSON keeping numbers as json.Number, so that no
+// integer is rounded through float64 before its column type is known.
+func unmarshalNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// decodeRow converts the values of a row read from disk to the Go types
+// of their columns.
+func (t *Table) decodeRow(row Row) error {
+	for _, col := range t.Columns {
+		val, err := decodeValue(col, row[col.Name])
+		if err != nil {
+			return fmt.Errorf("table %s: %v", t.Name, err)
+		}
+		row[col.Name] = val
+	}
+	return nil
+}
+
+func (t *Table) decodeStats(stats *TableStats) error {
+	for name, cs := range stats.Columns {
+		col, exists := t.column(name)
+		if !exists {
+			continue
+		}
+		var err error
+		if cs.Min, err = decodeValue(col, cs.Min); err != nil {
+			return err
+		}
+		if cs.Max, err = decodeValue(col, cs.Max); err != nil {
+			return err
+		}
+		for i, bound := range cs.Histogram {
+			if cs.Histogram[i], err = decodeValue(col, bound); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeValue(col Column, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+
+	switch col.Type {
+	case TypeInt:
+		switch v := val.(type) {
+		case json.Number:
+			n, err := v.Int64()
+			if err == nil {
+				return int(n), nil
+			}
+			// Format 1 could hold large integers in exponent form
+			if f, ferr := v.Float64(); ferr == nil && f == math.Trunc(f) {
+				return int(f), nil
+			}
+		case float64:
+			if v == math.Trunc(v) {
+				return int(v), nil
+			}
+		case int:
+			return v, nil
+		}
+	case TypeFloat:
+		switch v := val.(type) {
+		case json.Number:
+			if f, err := v.Float64(); err == nil {
+				return f, nil
+			}
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		}
+	default:
+		if s, ok := val.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("column %s: cannot read %v as %s", col.Name, val, col.Type)
+}
@@ -0,0 +1,187 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Rows and index keys are stored as tuples: each value is a tag byte and
+// its encoding, so a tuple can be read without knowing its columns.
+const (
+	tagNull byte = iota
+	tagInt
+	tagFloat
+	tagString
+)
+
+var errCorruptTuple = errors.New("data file is corrupt: bad tuple")
+
+func appendValue(buf []byte, val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case nil:
+		return append(buf, tagNull), nil
+	case int:
+		buf = append(buf, tagInt)
+		return binary.AppendVarint(buf, int64(v)), nil
+	case float64:
+		buf = append(buf, tagFloat)
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v)), nil
+	case string:
+		buf = append(buf, tagString)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		return append(buf, v...), nil
+	}
+	return nil, fmt.Errorf("cannot store value %v of type %T", val, val)
+}
+
+func encodeTuple(values []interface{}) ([]byte, error) {
+	var buf []byte
+	for _, val := range values {
+		var err error
+		if buf, err = appendValue(buf, val); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func decodeTuple(data []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0, 4)
+	for len(data) > 0 {
+		tag := data[0]
+		data = data[1:]
+		switch tag {
+		case tagNull:
+			values = append(values, nil)
+		case tagInt:
+			v, n := binary.Varint(data)
+			if n <= 0 {
+				return nil, errCorruptTuple
+			}
+			values = append(values, int(v))
+			data = data[n:]
+		case tagFloat:
+			if len(data) < 8 {
+				return nil, errCorruptTuple
+			}
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(data)))
+			data = data[8:]
+		case tagString:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return nil, errCorruptTuple
+			}
+			values = append(values, string(data[n:n+int(length)]))
+			data = data[n+int(length):]
+		default:
+			return nil, errCorruptTuple
+		}
+	}
+	return values, nil
+}
+
+// heapFile reads the rows of one table from slotted heap pages. Row i is
+// cell i-first of the page whose first row is first; the directory of
+// pages is small enough to keep in memory.
+type heapFile struct {
+	file  *dataFile
+	pages []heapPage
+	count int
+}
+
+type heapPage struct {
+	id    pageID
+	first int
+}
+
+func openHeap(df *dataFile, dir pageID, dirLen, count int) (*heapFile, error) {
+	h := &heapFile{file: df, count: count}
+	if dirLen == 0 {
+		return h, nil
+	}
+	data, err := df.blob(dir, dirLen)
+	if err != nil {
+		return nil, err
+	}
+	first := 0
+	for off := 0; off+8 <= len(data); off += 8 {
+		h.pages = append(h.pages, heapPage{id: binary.LittleEndian.Uint32(data[off:]), first: first})
+		first += int(binary.LittleEndian.Uint32(data[off+4:]))
+	}
+	if first != count {
+		return nil, fmt.Errorf("data file is corrupt: heap directory holds %d rows, catalog says %d", first, count)
+	}
+	return h, nil
+}
+
+// tuple returns the stored tuple of row i.
+func (h *heapFile) tuple(i int) ([]byte, error) {
+	n := sort.Search(len(h.pages), func(n int) bool { return h.pages[n].first > i }) - 1
+	p, err := h.file.page(h.pages[n].id)
+	if err != nil {
+		return nil, err
+	}
+	slot := i - h.pages[n].first
+	if p.kind() != pageHeap || slot >= p.cellCount() {
+		return nil, fmt.Errorf("data file is corrupt: row %d is not on heap page %d", i, h.pages[n].id)
+	}
+	return h.file.cell(p, slot)
+}
+
+// heapWriter fills heap pages with rows and records them in a directory.
+type heapWriter struct {
+	pw    *pageWriter
+	page  page
+	dir   []byte
+	count int
+}
+
+func (hw *heapWriter) add(tuple []byte) error {
+	if hw.page == nil {
+		hw.page = newPage(pageHeap)
+	}
+	ok, err := hw.pw.addCell(hw.page, tuple)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := hw.flush(); err != nil {
+			return err
+		}
+		hw.page = newPage(pageHeap)
+		if _, err := hw.pw.addCell(hw.page, tuple); err != nil {
+			return err
+		}
+	}
+	hw.count++
+	return nil
+}
+
+func (hw *heapWriter) flush() error {
+	id, err := hw.pw.write(hw.page)
+	if err != nil {
+		return err
+	}
+	hw.dir = binary.LittleEndian.AppendUint32(hw.dir, id)
+	hw.dir = binary.LittleEndian.AppendUint32(hw.dir, uint32(hw.page.cellCount()))
+	hw.page = nil
+	return nil
+}
+
+// finish writes the last page and the directory, returning where the
+// directory is.
+func (hw *heapWriter) finish() (pageID, int, error) {
+	if hw.page != nil {
+		if err := hw.flush(); err != nil {
+			return noPage, 0, err
+		}
+	}
+	if len(hw.dir) == 0 {
+		return noPage, 0, nil
+	}
+	dir, err := hw.pw.writeBlob(hw.dir)
+	return dir, len(hw.dir), err
+}
@@ -0,0 +1,24 @@
+package minidb
+
+import "testing"
+
+// newTestDB returns an empty database kept in memory.
+func newTestDB(t *testing.T, options ...Option) *DB {
+	t.Helper()
+	db := NewDB(append([]Option{WithStorage(NewMemoryStorage())}, options...)...)
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// mustExec runs a statement that is expected to succeed.
+func mustExec(t *testing.T, db *DB, query string, args ...interface{}) *Result {
+	t.Helper()
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return result
+}
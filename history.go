@@ -0,0 +1,429 @@
+package minidb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The database as it was at some moment is rebuilt from a base, a data
+// file holding every commit up to some point, plus the logged commits
+// after it up to that moment. The current data file is one base; with
+// Retention set, a WALStorage keeps each data file a checkpoint replaces
+// in its log archive beside the archived logs, and prunes both once they
+// fall out of the retention window. The empty database before the first
+// commit is a base too.
+
+// timestampLayout is how times are shown in messages.
+const timestampLayout = "2006-01-02 15:04:05.000"
+
+// historyBase is a data file to rebuild history from, holding every commit
+// up to lsn, the last of which was logged at time. The empty database has
+// no path.
+type historyBase struct {
+	path string
+	lsn  uint64
+	time time.Time
+}
+
+// RecoveryPoint is what a point-in-time recovery took a database back to:
+// the last commit logged by the time asked for, and when it was logged.
+type RecoveryPoint struct {
+	LSN  uint64
+	Time time.Time
+}
+
+func (p RecoveryPoint) String() string {
+	return fmt.Sprintf("%s, commit %d", p.Time.Local().Format(timestampLayout), p.LSN)
+}
+
+// historyPlan says how to rebuild the database as of a point in time: the
+// base, then the commits after it up to lsn, logged at time.
+type historyPlan struct {
+	base    historyBase
+	records []walRecord
+	lsn     uint64
+	time    time.Time
+}
+
+// planHistory finds how to rebuild the WAL database at base as it was at
+// the given time: with the last commit logged by then.
+func planHistory(base string, at time.Time) (*historyPlan, error) {
+	// Read the log before the data files, as a backup does, so that a
+	// checkpoint running meanwhile only adds a newer base
+	live, err := readWAL(base + ".wal")
+	if err != nil {
+		return nil, err
+	}
+	archived, err := readArchive(archivePath(base), 0)
+	if err != nil {
+		return nil, err
+	}
+	bases, err := historyBases(base)
+	if err != nil {
+		return nil, err
+	}
+
+	// An archived log may overlap the live one; records of the same
+	// commit are the same
+	logged := make(map[uint64]walRecord)
+	for _, record := range append(archived, live...) {
+		logged[record.LSN] = record
+	}
+
+	plan := &historyPlan{}
+	found := false
+	last := func(lsn uint64, logged time.Time) {
+		if !logged.IsZero() && !logged.After(at) && (!found || lsn > plan.lsn) {
+			plan.lsn, plan.time, found = lsn, logged, true
+		}
+	}
+	for _, record := range logged {
+		last(record.LSN, record.Time)
+	}
+	for _, b := range bases {
+		last(b.lsn, b.time)
+	}
+	if !found {
+		return nil, fmt.Errorf("no history of the database reaches back to %s", at.Local().Format(timestampLayout))
+	}
+
+	// Start from the newest base the log reaches forward from
+	for i := len(bases) - 1; i >= 0; i-- {
+		if bases[i].lsn > plan.lsn {
+			continue
+		}
+		records := make([]walRecord, 0, plan.lsn-bases[i].lsn)
+		for lsn := bases[i].lsn + 1; lsn <= plan.lsn; lsn++ {
+			record, ok := logged[lsn]
+			if !ok {
+				break
+			}
+			records = append(records, record)
+		}
+		if bases[i].lsn+uint64(len(records)) == plan.lsn {
+			plan.base, plan.records = bases[i], records
+			return plan, nil
+		}
+	}
+	return nil, fmt.Errorf("the database as of commit %d is no longer kept; keep history with a retention window", plan.lsn)
+}
+
+// historyBases returns the bases of the WAL database at base by the last
+// commit they hold, starting with the empty database.
+func historyBases(base string) ([]historyBase, error) {
+	bases := []historyBase{{}}
+	files, err := archived(archivePath(base), ".db")
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, archivedFile{path: base + ".db"})
+	for _, file := range files {
+		b, err := readBase(file.path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		bases = append(bases, b)
+	}
+	sort.SliceStable(bases, func(i, j int) bool { return bases[i].lsn < bases[j].lsn })
+	return bases, nil
+}
+
+func readBase(path string) (historyBase, error) {
+	df, err := openDataFile(path, 1)
+	if err != nil {
+		return historyBase{}, err
+	}
+	defer df.close()
+	catalog, lsn, err := df.readCatalog()
+	if err != nil {
+		return historyBase{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return historyBase{path: path, lsn: lsn, time: catalog.Time}, nil
+}
+
+// load builds the database the plan describes. It is read-only.
+func (plan *historyPlan) load() (*DB, error) {
+	db := NewDB(WithStorage(&historyStorage{plan: plan}), ReadOnly())
+	if err := db.Load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// historyStorage is the storage of a database rebuilt as of a point in
+// time. Rows of its base stay on disk; it never writes.
+type historyStorage struct {
+	plan *historyPlan
+	data *dataFile
+}
+
+func (hs *historyStorage) Load(db *DB) error {
+	if hs.plan.base.path != "" {
+		df, err := openDataFile(hs.plan.base.path, 0)
+		if err != nil {
+			return err
+		}
+		hs.data = df
+		if _, _, err := loadDataFile(db, df); err != nil {
+			return err
+		}
+	}
+	deleted := make(map[*Table]map[string][]int)
+	for _, record := range hs.plan.records {
+		if err := db.redo(record, deleted); err != nil {
+			return err
+		}
+	}
+	for _, table := range db.tables {
+		table.vacuum(0)
+	}
+	return nil
+}
+
+func (*historyStorage) Commit(db *DB, snap snapshot, changes []walChange) (int64, error) {
+	return 0, ErrReadOnly
+}
+
+func (*historyStorage) Sync(end int64) error    { return nil }
+func (*historyStorage) Checkpoint(db *DB) error { return ErrReadOnly }
+func (*historyStorage) NeedsCheckpoint() bool   { return false }
+
+func (hs *historyStorage) Close() error {
+	if hs.data == nil {
+		return nil
+	}
+	err := hs.data.close()
+	hs.data = nil
+	return err
+}
+
+func (plan *historyPlan) point() RecoveryPoint {
+	return RecoveryPoint{LSN: plan.lsn, Time: plan.time}
+}
+
+// Recover rebuilds the database name in the data directory dataDir as it
+// was at the given time, from the history it keeps: as the new database
+// into when set, or else in place, discarding the commits after. No
+// process may have the database recovered into open; an Instance recovers
+// its own databases with Instance.Recover.
+func Recover(dataDir, name string, at time.Time, into string) (RecoveryPoint, error) {
+	if into == "" {
+		into = name
+	}
+	if !databaseName.MatchString(into) {
+		return RecoveryPoint{}, fmt.Errorf("invalid database name %q", into)
+	}
+	if into != name {
+		if _, err := os.Stat(filepath.Join(dataDir, into+".db")); err == nil {
+			return RecoveryPoint{}, fmt.Errorf("database %s already exists", into)
+		}
+	}
+	plan, err := recoverDatabase(osFS{}, filepath.Join(dataDir, name), at, filepath.Join(dataDir, into))
+	if err != nil {
+		return RecoveryPoint{}, err
+	}
+	return plan.point(), nil
+}
+
+// recoverDatabase rebuilds the WAL database at base as it was at the given
+// time into the files at into, which must not be open. into may be base
+// itself: then the commits after that time are discarded, from the archive
+// too, so that new commits can take their numbers. The live log is
+// archived first, so an interrupted recovery can be run again. It returns
+// the plan it followed.
+func recoverDatabase(fs fileSystem, base string, at time.Time, into string) (*historyPlan, error) {
+	lock, err := lockDatabase(into + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	plan, err := planHistory(base, at)
+	if err != nil {
+		return nil, err
+	}
+	db, err := plan.load()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if into == base {
+		records, err := readWAL(base + ".wal")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeArchive(fs, archivePath(base), records); err != nil {
+			return nil, err
+		}
+	}
+	if err := replaceFile(fs, into+".wal", func(w io.Writer) error { return nil }); err != nil {
+		return nil, err
+	}
+	if into == base {
+		if err := trimArchive(fs, archivePath(base), plan.lsn); err != nil {
+			return nil, err
+		}
+	} else if err := os.RemoveAll(archivePath(into)); err != nil {
+		return nil, fmt.Errorf("failed to remove %s: %v", archivePath(into), err)
+	}
+
+	err = replaceFile(fs, into+".db", func(w io.Writer) error {
+		_, _, err := writeDataFile(w, db, plan.lsn, plan.time)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(into + ".json"); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// archivedFile is a file of the log archive, named after a commit: the
+// first a log holds, or the last a data file holds.
+type archivedFile struct {
+	path string
+	lsn  uint64
+}
+
+// archived lists the files of the archive in dir with extension ext in
+// the order of their commits.
+func archived(dir, ext string) ([]archivedFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read log archive: %v", err)
+	}
+	var files []archivedFile
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ext)
+		if !ok {
+			continue
+		}
+		lsn, err := strconv.ParseUint(name, 16, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, archivedFile{path: filepath.Join(dir, entry.Name()), lsn: lsn})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].lsn < files[j].lsn })
+	return files, nil
+}
+
+// writeArchive adds a log holding records to the archive in dir, named
+// after its first commit.
+func writeArchive(fs fileSystem, dir string, records []walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create log archive: %v", err)
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%016x.wal", records[0].LSN))
+	return replaceFile(fs, name, func(w io.Writer) error {
+		for _, record := range records {
+			frame, err := encodeFrame(record)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneArchive removes what the archive in dir no longer needs to rebuild
+// the database as of before or later: the bases older than the newest one
+// from before then, and the logs that end before that one.
+func pruneArchive(dir string, before time.Time) error {
+	bases, err := archived(dir, ".db")
+	if err != nil {
+		return err
+	}
+	keep := -1
+	for i, file := range bases {
+		b, err := readBase(file.path)
+		if err != nil {
+			return err
+		}
+		if !b.time.IsZero() && !b.time.After(before) {
+			keep = i
+		}
+	}
+	if keep < 0 {
+		return nil
+	}
+	for _, file := range bases[:keep] {
+		if err := os.Remove(file.path); err != nil {
+			return fmt.Errorf("failed to prune log archive: %v", err)
+		}
+	}
+
+	// A log ends where the next one starts
+	logs, err := archived(dir, ".wal")
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(logs) && logs[i+1].lsn <= bases[keep].lsn+1; i++ {
+		if err := os.Remove(logs[i].path); err != nil {
+			return fmt.Errorf("failed to prune log archive: %v", err)
+		}
+	}
+	return nil
+}
+
+// trimArchive removes the commits after lsn from the archive in dir, with
+// the bases holding them.
+func trimArchive(fs fileSystem, dir string, lsn uint64) error {
+	bases, err := archived(dir, ".db")
+	if err != nil {
+		return err
+	}
+	for _, file := range bases {
+		if file.lsn > lsn {
+			if err := os.Remove(file.path); err != nil {
+				return fmt.Errorf("failed to trim log archive: %v", err)
+			}
+		}
+	}
+
+	logs, err := archived(dir, ".wal")
+	if err != nil {
+		return err
+	}
+	for _, file := range logs {
+		if file.lsn > lsn {
+			if err := os.Remove(file.path); err != nil {
+				return fmt.Errorf("failed to trim log archive: %v", err)
+			}
+			continue
+		}
+		records, err := readWAL(file.path)
+		if err != nil {
+			return err
+		}
+		n := len(records)
+		for n > 0 && records[n-1].LSN > lsn {
+			n--
+		}
+		if n < len(records) {
+			if err := writeArchive(fs, dir, records[:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// historyTestInstance returns an instance keeping an hour of history, with
+// a session on its database shop.
+func historyTestInstance(t *testing.T, dir string) (*Instance, *Session) {
+	t.Helper()
+	instance, err := NewInstance(dir, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance.Configure = func(wal *WALStorage) { wal.Retention = time.Hour }
+	t.Cleanup(func() { instance.Close() })
+	if _, err := instance.Open("shop"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := instance.NewSession("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return instance, session
+}
+
+func sessionExec(t *testing.T, s *Session, query string) *Result {
+	t.Helper()
+	result, err := s.Exec(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return result
+}
+
+func sessionContents(t *testing.T, s *Session, query string) string {
+	t.Helper()
+	contents := ""
+	for _, row := range sessionExec(t, s, query).Rows {
+		contents += fmt.Sprintf("(%v %v)", row["id"], row["name"])
+	}
+	return contents
+}
+
+// historyMoment returns a time after every commit so far and before any
+// commit to come, as a TIMESTAMP literal.
+func historyMoment() string {
+	time.Sleep(5 * time.Millisecond)
+	at := time.Now().Format(time.RFC3339Nano)
+	time.Sleep(5 * time.Millisecond)
+	return "'" + at + "'"
+}
+
+// historyTestDatabase commits in four rounds, all but the last
+// checkpointed into a base the next checkpoint archives, and returns a
+// moment after each.
+func historyTestDatabase(t *testing.T, instance *Instance, s *Session) []string {
+	t.Helper()
+	db, err := instance.Database("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var moments []string
+	for _, round := range [][]string{
+		{"CREATE TABLE items (id INT PRIMARY KEY, name STRING)"},
+		{"INSERT INTO items (id, name) VALUES (1, 'a')"},
+		{
+			"INSERT INTO items (id, name) VALUES (2, 'b')",
+			"UPDATE items SET name = 'c' WHERE id = 1",
+		},
+		{
+			"DELETE FROM items WHERE id = 1",
+			"INSERT INTO items (id, name) VALUES (3, 'd')",
+		},
+	} {
+		for _, query := range round {
+			sessionExec(t, s, query)
+		}
+		moments = append(moments, historyMoment())
+		// The last round stays in the live log
+		if len(moments) < 4 {
+			if err := db.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return moments
+}
+
+var historyTestWant = []string{"", "(1 a)", "(1 c)(2 b)", "(2 b)(3 d)"}
+
+func TestAsOfTimestamp(t *testing.T) {
+	instance, s := historyTestInstance(t, t.TempDir())
+	before := historyMoment()
+	moments := historyTestDatabase(t, instance, s)
+
+	for i, at := range moments {
+		query := "SELECT * FROM items AS OF TIMESTAMP " + at + " ORDER BY id"
+		if got := sessionContents(t, s, query); got != historyTestWant[i] {
+			t.Errorf("as of round %d: got %q, want %q", i+1, got, historyTestWant[i])
+		}
+	}
+	if _, err := s.Exec("SELECT * FROM items AS OF TIMESTAMP " + before); err == nil {
+		t.Error("AS OF a time before the first commit: no error")
+	}
+}
+
+func TestRestoreToTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	instance, s := historyTestInstance(t, dir)
+	moments := historyTestDatabase(t, instance, s)
+
+	// AS leaves the database alone
+	sessionExec(t, s, "RESTORE TO TIMESTAMP "+moments[1]+" AS shop_before")
+	if got := sessionContents(t, s, "SELECT * FROM shop_before.items ORDER BY id"); got != historyTestWant[1] {
+		t.Errorf("shop_before holds %s, want %s", got, historyTestWant[1])
+	}
+	if got := sessionContents(t, s, "SELECT * FROM items ORDER BY id"); got != historyTestWant[3] {
+		t.Errorf("shop holds %s after restoring into another database, want %s", got, historyTestWant[3])
+	}
+
+	// In place the later commits are gone for good, and new commits
+	// follow the ones kept
+	sessionExec(t, s, "RESTORE TO TIMESTAMP "+moments[2])
+	if got := sessionContents(t, s, "SELECT * FROM items ORDER BY id"); got != historyTestWant[2] {
+		t.Errorf("shop holds %s after restoring in place, want %s", got, historyTestWant[2])
+	}
+	sessionExec(t, s, "INSERT INTO items (id, name) VALUES (4, 'e')")
+	if err := instance.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, s = historyTestInstance(t, dir)
+	want := historyTestWant[2] + "(4 e)"
+	if got := sessionContents(t, s, "SELECT * FROM items ORDER BY id"); got != want {
+		t.Errorf("reopened with %s, want %s", got, want)
+	}
+	if got := sessionContents(t, s, "SELECT * FROM items AS OF TIMESTAMP "+moments[3]+" ORDER BY id"); got != historyTestWant[2] {
+		t.Errorf("as of the discarded round: got %s, want %s", got, historyTestWant[2])
+	}
+}
+
+func TestPruneArchive(t *testing.T) {
+	dir := t.TempDir()
+	instance, s := historyTestInstance(t, dir)
+	moments := historyTestDatabase(t, instance, s)
+	base := filepath.Join(dir, "shop")
+	archive := archivePath(base)
+	times := make([]time.Time, len(moments))
+	for i, at := range moments {
+		var err error
+		if times[i], err = ParseTimestamp(strings.Trim(at, "'")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The base of the second round is the newest from before the cutoff,
+	// so the older bases and the logs leading up to it go
+	if err := pruneArchive(archive, times[2]); err != nil {
+		t.Fatal(err)
+	}
+	bases, err := archived(archive, ".db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 1 {
+		t.Fatalf("archive keeps %d bases, want 1", len(bases))
+	}
+	if _, err := planHistory(base, times[0]); err == nil {
+		t.Error("history from before the kept base: no error")
+	}
+	for i := 1; i < len(moments); i++ {
+		query := "SELECT * FROM items AS OF TIMESTAMP " + moments[i] + " ORDER BY id"
+		if got := sessionContents(t, s, query); got != historyTestWant[i] {
+			t.Errorf("as of round %d after pruning: got %q, want %q", i+1, got, historyTestWant[i])
+		}
+	}
+}
+
+// failCreateFS fails to create any file whose name starts with prefix.
+type failCreateFS struct {
+	osFS
+	prefix string
+}
+
+func (f failCreateFS) Create(name string) (syncFile, error) {
+	if strings.HasPrefix(name, f.prefix) {
+		return nil, errors.New("disk full")
+	}
+	return f.osFS.Create(name)
+}
+
+// TestFailedCheckpointArchive fails a checkpoint as it writes the data
+// file and checks that the next one still archives the old data file
+// under the last commit it holds.
+func TestFailedCheckpointArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minidb.db")
+	storage := NewWALStorage(path)
+	storage.Retention = time.Hour
+	db := crashTestDatabase(t, storage)
+	defer db.Close()
+
+	storage.fs = failCreateFS{prefix: path}
+	if err := db.Checkpoint(); err == nil {
+		t.Fatal("checkpoint writing to a full disk: no error")
+	}
+	storage.fs = osFS{}
+	mustExec(t, db, "INSERT INTO items (id, name) VALUES (3, 'after')")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	bases, err := archived(archivePath(storage.base()), ".db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) == 0 {
+		t.Fatal("no data file was archived")
+	}
+	for _, file := range bases {
+		b, err := readBase(file.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.lsn != file.lsn {
+			t.Errorf("%s holds commits up to %d", filepath.Base(file.path), b.lsn)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package minidb
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	IndexHash  = "HASH"
+	IndexBTree = "BTREE"
+)
+
+// tableIndex maps a key built from one or more columns to the positions
+// of the rows holding it. Indexes backing PRIMARY KEY and UNIQUE columns
+// are implicit; the rest come from CREATE INDEX.
+//
+// HASH indexes only answer equality. BTREE indexes keep keys ordered (NULLs
+// first) and also serve range scans, prefix LIKE, MIN/MAX and ORDER BY.
+//
+// Rows stored in the data file are indexed by a pageTree written with
+// them; entries and tree only hold the rows from position base on.
+type tableIndex struct {
+	Name     string
+	Columns  []string
+	Unique   bool
+	Kind     string
+	Implicit bool
+	ords     []int // ordinal of each column in the table's tuples
+	entries  map[interface{}][]int
+	tree     *btree
+	paged    *pageTree
+	base     int
+}
+
+// IndexDef is the persisted description of an index created with
+// CREATE INDEX.
+type IndexDef struct {
+	Name    string
+	Columns []string
+	Unique  bool
+	Kind    string
+}
+
+func newIndex(name string, columns []string, unique bool) *tableIndex {
+	return &tableIndex{
+		Name:    name,
+		Columns: columns,
+		Unique:  unique,
+		Kind:    IndexHash,
+		entries: make(map[interface{}][]int),
+	}
+}
+
+// newBTreeIndex creates an ordered index. compare orders two values of the
+// named column.
+func newBTreeIndex(name string, columns []string, unique bool, compare func(col string, a, b interface{}) int) *tableIndex {
+	idx := &tableIndex{
+		Name:    name,
+		Columns: columns,
+		Unique:  unique,
+		Kind:    IndexBTree,
+	}
+	idx.tree = newBTree(tupleCompare(columns, compare))
+	return idx
+}
+
+// tupleCompare orders keys of the given columns. It compares on the common
+// prefix so partial keys can seek.
+func tupleCompare(columns []string, compare func(col string, a, b interface{}) int) func(a, b []interface{}) int {
+	return func(a, b []interface{}) int {
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if cmp := compare(columns[i], a[i], b[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return 0
+	}
+}
+
+func (idx *tableIndex) Def() IndexDef {
+	return IndexDef{Name: idx.Name, Columns: idx.Columns, Unique: idx.Unique, Kind: idx.Kind}
+}
+
+func (idx *tableIndex) ordered() bool {
+	return idx.Kind == IndexBTree
+}
+
+// key returns the hash key for a row. Rows with a NULL in any indexed
+// column are not indexed.
+func (idx *tableIndex) key(tuple rowTuple) (interface{}, bool) {
+	if len(idx.ords) == 1 {
+		val := tuple[idx.ords[0]]
+		return val, val != nil
+	}
+
+	parts := make([]string, len(idx.ords))
+	for i, ord := range idx.ords {
+		val := tuple[ord]
+		if val == nil {
+			return nil, false
+		}
+		parts[i] = fmt.Sprintf("%T:%v", val, val)
+	}
+	return strings.Join(parts, "\x1f"), true
+}
+
+// sortKey returns the ordered key for a row, NULLs included.
+func (idx *tableIndex) sortKey(tuple rowTuple) []interface{} {
+	key := make([]interface{}, len(idx.ords))
+	for i, ord := range idx.ords {
+		key[i] = tuple[ord]
+	}
+	return key
+}
+
+func (idx *tableIndex) add(tuple rowTuple, rowIdx int) {
+	if idx.ordered() {
+		idx.tree.Insert(idx.sortKey(tuple), rowIdx)
+		return
+	}
+	if key, ok := idx.key(tuple); ok {
+		idx.entries[key] = append(idx.entries[key], rowIdx)
+	}
+}
+
+func (idx *tableIndex) remove(tuple rowTuple, rowIdx int) {
+	if idx.ordered() {
+		idx.tree.Delete(idx.sortKey(tuple), rowIdx)
+		return
+	}
+
+	key, ok := idx.key(tuple)
+	if !ok {
+		return
+	}
+
+	if indices, found := idx.entries[key]; found {
+		newIndices := make([]int, 0)
+		for _, i := range indices {
+			if i != rowIdx {
+				newIndices = append(newIndices, i)
+			}
+		}
+		if len(newIndices) > 0 {
+			idx.entries[key] = newIndices
+		} else {
+			delete(idx.entries, key)
+		}
+	}
+}
+
+// lookup returns the rows whose first indexed column equals val.
+func (idx *tableIndex) lookup(val interface{}) []int {
+	positions := idx.lookupMemory(val)
+	if idx.paged == nil || val == nil {
+		return positions
+	}
+	return append(idx.paged.lookup([]interface{}{val}), positions...)
+}
+
+func (idx *tableIndex) lookupMemory(val interface{}) []int {
+	if !idx.ordered() {
+		return idx.entries[val]
+	}
+	if val == nil {
+		return nil
+	}
+
+	result := make([]int, 0)
+	probe := []interface{}{val}
+	idx.tree.Ascend(probe, func(key []interface{}, rows []int) bool {
+		if idx.tree.compare(key, probe) != 0 {
+			return false
+		}
+		result = append(result, rows...)
+		return true
+	})
+	return result
+}
+
+// conflicts reports whether inserting row would violate this index's
+// uniqueness. Rows at positions for which ignore returns true do not count.
+func (idx *tableIndex) conflicts(tuple rowTuple, ignore func(int) bool) bool {
+	if !idx.Unique {
+		return false
+	}
+	for _, i := range idx.positions(tuple) {
+		if ignore == nil || !ignore(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// positions returns the rows whose key equals row's. Rows with a NULL in
+// an indexed column match nothing.
+func (idx *tableIndex) positions(tuple rowTuple) []int {
+	key, ok := idx.key(tuple)
+	if !ok {
+		return nil
+	}
+
+	existing := idx.entries[key]
+	if idx.ordered() {
+		existing = idx.tree.Get(idx.sortKey(tuple))
+	}
+	if idx.paged == nil {
+		return existing
+	}
+	return append(idx.paged.lookup(idx.sortKey(tuple)), existing...)
+}
+
+// rebuild re-indexes the rows of t that are not in the data file. All
+// rows are indexed even when a unique violation is found; the first
+// violation is returned. Rows for which ignore returns true are indexed
+// but not checked for uniqueness. Aborted and vacuumed versions are left
+// out.
+func (idx *tableIndex) rebuild(t *Table, ignore func(int) bool) error {
+	var err error
+	if idx.ordered() {
+		idx.tree = newBTree(idx.tree.compare)
+	} else {
+		idx.entries = make(map[interface{}][]int)
+	}
+	for i := idx.base; i < t.rowCount(); i++ {
+		if t.version(i).xmin == abortedTxID {
+			continue
+		}
+		tuple := t.tuple(i)
+		if err == nil && (ignore == nil || !ignore(i)) && idx.conflicts(tuple, ignore) {
+			err = fmt.Errorf("could not create unique index %s: duplicate key %v", idx.Name, idx.describeKey(tuple))
+		}
+		idx.add(tuple, i)
+	}
+	return err
+}
+
+// seek returns a cursor on an ordered index at the first key not below
+// from, or for a descending walk the last key not above it. A nil from
+// starts at the first or last key.
+func (idx *tableIndex) seek(from []interface{}, desc bool) indexCursor {
+	var mem btreeCursor
+	switch {
+	case from == nil && desc:
+		mem = idx.tree.last()
+	case from == nil:
+		mem = idx.tree.first()
+	case desc:
+		mem = idx.tree.seekLE(from)
+	default:
+		mem = idx.tree.seekGE(from)
+	}
+	if idx.paged == nil {
+		return &mem
+	}
+	return &mergedCursor{
+		parts:   []indexCursor{idx.paged.seek(from, desc), &mem},
+		compare: idx.tree.compare,
+		desc:    desc,
+	}
+}
+
+// indexCursor walks an ordered index one distinct key at a time.
+type indexCursor interface {
+	valid() bool
+	key() []interface{}
+	rows() []int
+	next()
+	prev()
+}
+
+// mergedCursor walks several cursors over the same keys as one, such as
+// the entries of an index in the data file and those in memory. Like a
+// single cursor it moves in the direction it was opened in.
+type mergedCursor struct {
+	parts   []indexCursor
+	compare func(a, b []interface{}) int
+	desc    bool
+}
+
+func (c *mergedCursor) valid() bool {
+	for _, p := range c.parts {
+		if p.valid() {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the lowest key of the parts, or the highest when walking
+// down.
+func (c *mergedCursor) key() []interface{} {
+	var key []interface{}
+	for _, p := range c.parts {
+		if !p.valid() {
+			continue
+		}
+		if key == nil {
+			key = p.key()
+			continue
+		}
+		cmp := c.compare(p.key(), key)
+		if (cmp < 0 && !c.desc) || (cmp > 0 && c.desc) {
+			key = p.key()
+		}
+	}
+	return key
+}
+
+func (c *mergedCursor) rows() []int {
+	key := c.key()
+	var rows []int
+	for _, p := range c.parts {
+		if p.valid() && c.compare(p.key(), key) == 0 {
+			rows = append(rows, p.rows()...)
+		}
+	}
+	return rows
+}
+
+func (c *mergedCursor) next() {
+	key := c.key()
+	for _, p := range c.parts {
+		if p.valid() && c.compare(p.key(), key) == 0 {
+			p.next()
+		}
+	}
+}
+
+func (c *mergedCursor) prev() {
+	key := c.key()
+	for _, p := range c.parts {
+		if p.valid() && c.compare(p.key(), key) == 0 {
+			p.prev()
+		}
+	}
+}
+
+func (idx *tableIndex) describeKey(tuple rowTuple) string {
+	vals := make([]string, len(idx.ords))
+	for i, ord := range idx.ords {
+		vals[i] = fmt.Sprint(tuple[ord])
+	}
+	return "(" + strings.Join(vals, ", ") + ")"
+}
@@ -0,0 +1,478 @@
+package minidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// databaseName limits names to ones that are safe as file names.
+var databaseName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Instance hosts several databases side by side in one data directory,
+// each in files named after it. Every database has its own storage,
+// transactions and latch, so they are isolated from each other; a Session
+// picks one with USE and can name the tables of another as db.table.
+type Instance struct {
+	dir         string
+	kind        string
+	openStorage func(path string) storageEngine
+
+	// Configure, if set, adjusts the storage of each database kept with
+	// the wal engine before it is loaded.
+	Configure func(*WALStorage)
+
+	// ReadOnly attaches every database read-only, so the instance can run
+	// beside a process that has them open for writing.
+	ReadOnly bool
+
+	// StatementTimeout, if set, stops statements that run longer in any
+	// of the databases; sessions can change it with SET statement_timeout.
+	StatementTimeout time.Duration
+
+	mu        sync.Mutex
+	databases map[string]*DB
+	users     map[*DB]int // sessions using each database
+}
+
+// NewInstance returns an instance keeping its databases in dir with the
+// storage engine named kind. The directory is created if needed.
+func NewInstance(dir, kind string) (*Instance, error) {
+	open, err := storageOpener(kind)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	return &Instance{
+		dir:         dir,
+		kind:        kind,
+		openStorage: open,
+		databases:   make(map[string]*DB),
+		users:       make(map[*DB]int),
+	}, nil
+}
+
+// Open returns the named database, creating it if it does not exist yet.
+func (inst *Instance) Open(name string) (*DB, error) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	db, err := inst.database(name)
+	if err == nil || inst.ReadOnly {
+		return db, err
+	}
+	return inst.create(name)
+}
+
+// Database returns the named database, loading it on first use.
+func (inst *Instance) Database(name string) (*DB, error) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return inst.database(name)
+}
+
+func (inst *Instance) database(name string) (*DB, error) {
+	if db, ok := inst.databases[name]; ok {
+		return db, nil
+	}
+	if !databaseName.MatchString(name) || !inst.exists(name) {
+		return nil, &NotFoundError{Kind: "database", Name: name}
+	}
+	return inst.load(name)
+}
+
+// exists reports whether the named database has files in the directory.
+// A WAL database may so far have only its log, or an old JSON snapshot
+// waiting to be converted.
+func (inst *Instance) exists(name string) bool {
+	var extensions []string
+	switch inst.kind {
+	case "wal":
+		extensions = []string{".db", ".wal", ".json"}
+	case "json":
+		extensions = []string{".json"}
+	}
+	for _, ext := range extensions {
+		if _, err := os.Stat(inst.path(name) + ext); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (inst *Instance) path(name string) string {
+	return filepath.Join(inst.dir, name)
+}
+
+func (inst *Instance) load(name string) (*DB, error) {
+	storage := inst.openStorage(inst.path(name))
+	if wal, ok := storage.(*WALStorage); ok && inst.Configure != nil {
+		inst.Configure(wal)
+	}
+	options := []Option{WithStorage(storage)}
+	if inst.ReadOnly {
+		options = append(options, ReadOnly())
+	}
+	if inst.StatementTimeout > 0 {
+		options = append(options, WithStatementTimeout(inst.StatementTimeout))
+	}
+	db := NewDB(options...)
+	if err := db.Load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load database %s: %v", name, err)
+	}
+	inst.databases[name] = db
+	return db, nil
+}
+
+// Create makes a new, empty database.
+func (inst *Instance) Create(name string) error {
+	if inst.ReadOnly {
+		return ErrReadOnly
+	}
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if _, err := inst.database(name); err == nil {
+		return fmt.Errorf("database %s already exists", name)
+	}
+	_, err := inst.create(name)
+	return err
+}
+
+func (inst *Instance) create(name string) (*DB, error) {
+	if !databaseName.MatchString(name) {
+		return nil, fmt.Errorf("invalid database name %q", name)
+	}
+	db, err := inst.load(name)
+	if err != nil {
+		return nil, err
+	}
+	// Write the empty database out, so it is found after a restart
+	if err := db.Checkpoint(); err != nil {
+		delete(inst.databases, name)
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Drop closes the named database and deletes its files, all but its lock
+// file. A database some session is using cannot be dropped.
+func (inst *Instance) Drop(name string) error {
+	if inst.ReadOnly {
+		return ErrReadOnly
+	}
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	db, err := inst.database(name)
+	if err != nil {
+		return err
+	}
+	if inst.users[db] > 0 {
+		return fmt.Errorf("database %s is being used by %d session(s)", name, inst.users[db])
+	}
+
+	delete(inst.databases, name)
+	if err := db.Close(); err != nil {
+		return err
+	}
+	// The lock file stays, for the reason fileLock.unlock gives
+	for _, ext := range []string{".db", ".db.tmp", ".wal", ".json", ".json.tmp", ".json.bak"} {
+		if err := os.Remove(inst.path(name) + ext); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove database %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Restore replaces a database with the backup in dir: the database it was
+// taken of, or name when set, which need not exist yet. Unless at is zero,
+// only the commits logged by then are restored. No session may be using
+// the database, except s, which then uses the restored one.
+func (inst *Instance) Restore(dir, name string, at time.Time, s *Session) (string, uint64, error) {
+	if inst.ReadOnly {
+		return "", 0, ErrReadOnly
+	}
+	if inst.kind != "wal" {
+		return "", 0, fmt.Errorf("RESTORE needs the wal storage engine")
+	}
+	info, err := readBackupInfo(dir)
+	if err != nil {
+		return "", 0, err
+	}
+	if name == "" {
+		name = info.Database
+	}
+	if !databaseName.MatchString(name) {
+		return "", 0, fmt.Errorf("invalid database name %q", name)
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	var lsn uint64
+	err = inst.replace(name, s, func(path string) error {
+		lsn, err = restoreDatabase(osFS{}, dir, path, at)
+		return err
+	})
+	return name, lsn, err
+}
+
+// Recover rebuilds the named database as it was at the given time, from
+// the history it keeps. Into name, when set, it makes a new database and
+// leaves the original alone; otherwise the commits after that time are
+// discarded, and no session may be using the database except s.
+func (inst *Instance) Recover(source string, at time.Time, name string, s *Session) (string, RecoveryPoint, error) {
+	if inst.ReadOnly {
+		return "", RecoveryPoint{}, ErrReadOnly
+	}
+	if inst.kind != "wal" {
+		return "", RecoveryPoint{}, fmt.Errorf("point-in-time recovery needs the wal storage engine")
+	}
+	if name == "" {
+		name = source
+	}
+	if !databaseName.MatchString(name) {
+		return "", RecoveryPoint{}, fmt.Errorf("invalid database name %q", name)
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	if _, err := inst.database(source); err != nil {
+		return "", RecoveryPoint{}, err
+	}
+	if name != source && inst.exists(name) {
+		return "", RecoveryPoint{}, fmt.Errorf("database %s already exists", name)
+	}
+	var point RecoveryPoint
+	err := inst.replace(name, s, func(path string) error {
+		plan, err := recoverDatabase(osFS{}, inst.path(source), at, path)
+		if err == nil {
+			point = plan.point()
+		}
+		return err
+	})
+	return name, point, err
+}
+
+// replace closes the named database, lets write replace its files, and
+// loads it again. No session may be using it except s, which then uses
+// the new one. The caller holds inst.mu.
+func (inst *Instance) replace(name string, s *Session, write func(path string) error) error {
+	old, open := inst.databases[name]
+	if open {
+		users := inst.users[old]
+		if s != nil && s.db == old {
+			users--
+		}
+		if users > 0 {
+			return fmt.Errorf("database %s is being used by %d session(s)", name, users)
+		}
+		delete(inst.databases, name)
+		if err := old.Close(); err != nil {
+			return err
+		}
+	}
+
+	// Whether or not the files were replaced, reopen the database for the
+	// session that was using it
+	err := write(inst.path(name))
+	if err != nil && !open {
+		return err
+	}
+	db, lerr := inst.load(name)
+	if open {
+		delete(inst.users, old)
+		if s != nil && s.db == old && lerr == nil {
+			inst.users[db]++
+			s.db = db
+		}
+	}
+	if err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// Close closes every open database.
+func (inst *Instance) Close() error {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	var err error
+	for name, db := range inst.databases {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+		delete(inst.databases, name)
+	}
+	return err
+}
+
+// NewSession starts a session using the named database.
+func (inst *Instance) NewSession(name string) (*Session, error) {
+	s := &Session{instance: inst}
+	if err := s.use(name); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// use switches the session to the named database.
+func (s *Session) use(name string) error {
+	inst := s.instance
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	db, err := inst.database(name)
+	if err != nil {
+		return err
+	}
+	if s.db != nil {
+		inst.users[s.db]--
+	}
+	inst.users[db]++
+	s.db, s.name = db, name
+	return nil
+}
+
+// leave stops the session from counting as a user of its database.
+func (s *Session) leave() {
+	if s.instance == nil || s.db == nil {
+		return
+	}
+	s.instance.mu.Lock()
+	s.instance.users[s.db]--
+	s.instance.mu.Unlock()
+	s.db = nil
+}
+
+// manage runs CREATE DATABASE, DROP DATABASE, USE and RESTORE.
+func (s *Session) manage(stmt Statement) (*Result, error) {
+	if s.instance == nil {
+		return nil, fmt.Errorf("database statements need a session of an instance")
+	}
+	if s.tx != nil {
+		return nil, fmt.Errorf("database statements cannot run inside a transaction")
+	}
+
+	switch st := stmt.(type) {
+	case *CreateDatabaseStmt:
+		if err := s.instance.Create(st.Name); err != nil {
+			return nil, err
+		}
+		return &Result{Message: fmt.Sprintf("Database %s created", st.Name)}, nil
+	case *DropDatabaseStmt:
+		if st.Name == s.name {
+			return nil, fmt.Errorf("cannot drop the database in use")
+		}
+		if err := s.instance.Drop(st.Name); err != nil {
+			return nil, err
+		}
+		return &Result{Message: fmt.Sprintf("Database %s dropped", st.Name)}, nil
+	case *UseStmt:
+		if err := s.use(st.Name); err != nil {
+			return nil, err
+		}
+		return &Result{Message: fmt.Sprintf("Using database %s", st.Name)}, nil
+	case *RestoreStmt:
+		if st.Path == "" {
+			name, point, err := s.instance.Recover(s.name, st.To, st.Name, s)
+			if err != nil {
+				return nil, err
+			}
+			return &Result{Message: fmt.Sprintf("Database %s recovered as of %s", name, point)}, nil
+		}
+		name, lsn, err := s.instance.Restore(st.Path, st.Name, st.To, s)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Message: fmt.Sprintf("Database %s restored to commit %d", name, lsn)}, nil
+	}
+	return nil, fmt.Errorf("unknown statement type")
+}
+
+// target picks the database a statement runs in: the session's own, or
+// the one its table names are qualified with. The qualifier is removed.
+func (s *Session) target(stmt Statement) (*DB, error) {
+	name, err := unqualify(stmt, s.name)
+	if err != nil || name == s.name {
+		return s.db, err
+	}
+	if s.instance == nil {
+		return nil, &NotFoundError{Kind: "database", Name: name}
+	}
+	db, err := s.instance.Database(name)
+	if err != nil {
+		return nil, err
+	}
+	if s.tx != nil && db != s.tx.db {
+		return nil, fmt.Errorf("a transaction cannot span databases; it is in database %s", s.name)
+	}
+	return db, nil
+}
+
+// unqualify strips the database from db.table names in stmt, and from
+// db.table.column join columns, returning that database; names without
+// one are in current. All names must agree, since a statement runs in one
+// database.
+func unqualify(stmt Statement, current string) (string, error) {
+	var names []*string
+	var columns []*string
+	switch s := stmt.(type) {
+	case *CreateTableStmt:
+		names = append(names, &s.Name)
+	case *CreateIndexStmt:
+		names = append(names, &s.Table)
+	case *DropIndexStmt:
+		names = append(names, &s.Name)
+	case *AnalyzeStmt:
+		names = append(names, &s.Table)
+	case *VacuumStmt:
+		names = append(names, &s.Table)
+	case *InsertStmt:
+		names = append(names, &s.Table)
+	case *UpdateStmt:
+		names = append(names, &s.Table)
+	case *DeleteStmt:
+		names = append(names, &s.Table)
+	case *ExplainStmt:
+		return unqualify(s.Query, current)
+	case *SelectStmt:
+		names = append(names, &s.Table)
+		if s.Join != nil {
+			names = append(names, &s.Join.Table)
+			columns = append(columns, &s.Join.LeftCol, &s.Join.RightCol)
+		}
+	}
+
+	database, seen := current, false
+	use := func(db string) error {
+		if seen && db != database {
+			return fmt.Errorf("a statement cannot use tables of both %s and %s", database, db)
+		}
+		database, seen = db, true
+		return nil
+	}
+	for _, name := range names {
+		db := current
+		if strings.Contains(*name, ".") {
+			db, *name, _ = strings.Cut(*name, ".")
+		}
+		if err := use(db); err != nil {
+			return "", err
+		}
+	}
+	for _, column := range columns {
+		if strings.Count(*column, ".") == 2 {
+			var db string
+			db, *column, _ = strings.Cut(*column, ".")
+			if err := use(db); err != nil {
+				return "", err
+			}
+		}
+	}
+	return database, nil
+}
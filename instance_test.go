@@ -0,0 +1,91 @@
+package minidb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQualifiedNames(t *testing.T) {
+	instance, err := NewInstance(t.TempDir(), "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	if _, err := instance.Open("minidb"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := instance.NewSession("minidb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	for _, query := range []string{
+		"CREATE DATABASE shop",
+		"CREATE TABLE shop.items (id INT PRIMARY KEY, name STRING)",
+		"CREATE TABLE shop.stock (item_id INT PRIMARY KEY, qty INT)",
+		"INSERT INTO shop.items (id, name) VALUES (1, 'pen')",
+		"INSERT INTO shop.stock (item_id, qty) VALUES (1, 5)",
+		"CREATE TABLE items (id INT PRIMARY KEY)",
+	} {
+		if _, err := session.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	result, err := session.Exec("SELECT * FROM shop.items JOIN shop.stock ON shop.items.id = shop.stock.item_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 1 {
+		t.Errorf("join within shop returned %d rows, want 1", len(result.Rows))
+	}
+
+	// A statement stays within one database
+	_, err = session.Exec("SELECT * FROM items JOIN shop.items ON items.id = shop.items.id")
+	if err == nil || !strings.Contains(err.Error(), "both minidb and shop") {
+		t.Errorf("join across databases: got %v, want an error naming both", err)
+	}
+}
+
+// TestDropAndReopen drops a database and creates one of the same name,
+// which starts out empty, keeps the lock file and survives a restart.
+func TestDropAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	instance, s := backupTestInstance(t, dir)
+	lockPath := filepath.Join(dir, "shop.lock")
+	if _, err := instance.Open("minidb"); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionExec(t, s, "USE minidb")
+	sessionExec(t, s, "DROP DATABASE shop")
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Fatalf("dropping shop removed its lock file: %v", err)
+	}
+	sessionExec(t, s, "CREATE DATABASE shop")
+	sessionExec(t, s, "CREATE TABLE shop.items (id INT PRIMARY KEY, name STRING)")
+	if got := sessionContents(t, s, "SELECT * FROM shop.items"); got != "" {
+		t.Fatalf("recreated shop holds %s, want nothing", got)
+	}
+	sessionExec(t, s, "INSERT INTO shop.items (id, name) VALUES (5, 'new')")
+	if err := instance.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance can lock the database again
+	instance, err := NewInstance(dir, "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+	db, err := instance.Database("shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := crashTestContents(t, db); got != "(5 new)" {
+		t.Errorf("reopened shop holds %s, want (5 new)", got)
+	}
+}
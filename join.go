@@ -0,0 +1,68 @@
+package minidb
+
+import (
+	"strings"
+)
+
+// joinIndexOn returns any index that can look up rows by colName.
+func (t *Table) joinIndexOn(colName string) *tableIndex {
+	if index := t.indexOn(colName); index != nil {
+		return index
+	}
+	return t.orderedIndexOn(colName)
+}
+
+// mergeCompatible reports whether both join columns sort the same way, so
+// that their ordered indexes can be merged.
+func mergeCompatible(left, right *Table, leftCol, rightCol string) bool {
+	lc, lok := left.column(leftCol)
+	rc, rok := right.column(rightCol)
+	if !lok || !rok || lc.Type == TypeEnum || rc.Type == TypeEnum {
+		return false
+	}
+	return lc.Type == rc.Type || (isNumericType(lc.Type) && isNumericType(rc.Type))
+}
+
+func isNumericType(t DataType) bool {
+	return t == TypeInt || t == TypeFloat
+}
+
+// mergeJoinRows combines a pair of joined rows. Every column is available
+// as table.column, and also unqualified when the name is not ambiguous.
+func (t *Table) mergeJoinRows(right *Table, leftRow, rightRow Row) Row {
+	merged := make(Row, 2*(len(leftRow)+len(rightRow)))
+	for k, v := range leftRow {
+		merged[t.Name+"."+k] = v
+		if _, clash := right.column(k); !clash {
+			merged[k] = v
+		}
+	}
+	for k, v := range rightRow {
+		merged[right.Name+"."+k] = v
+		if _, clash := t.column(k); !clash {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// joinColumns lists the qualified column names produced by SELECT * over a
+// join.
+func joinColumns(left, right *Table) []string {
+	columns := make([]string, 0, len(left.Columns)+len(right.Columns))
+	for _, col := range left.Columns {
+		columns = append(columns, left.Name+"."+col.Name)
+	}
+	for _, col := range right.Columns {
+		columns = append(columns, right.Name+"."+col.Name)
+	}
+	return columns
+}
+
+// splitQualified splits "table.column" into its parts.
+func splitQualified(name string) (string, string) {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
@@ -0,0 +1,114 @@
+package minidb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// joinResults runs every plan the planner considers for a join query and
+// returns the pairs of ids each one produced, sorted, by operator name.
+func joinResults(t *testing.T, db *DB, query string) map[string]string {
+	t.Helper()
+	stmt, err := prepare(query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := stmt.(*SelectStmt)
+	joins, _, err := joinPlans(context.Background(), db.tables[sel.Table], db.tables[sel.Join.Table], sel, db.txm.latest())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(map[string]string)
+	for _, node := range joins {
+		rows, err := runPlan(node)
+		if err != nil {
+			t.Fatalf("%s: %v", node.Info().Name, err)
+		}
+		pairs := make([]string, len(rows))
+		for i, row := range rows {
+			pairs[i] = fmt.Sprintf("(%v %v)", row["l.id"], row["r.id"])
+		}
+		sort.Strings(pairs)
+		name := node.Info().Name
+		if node.Info().Index != "" {
+			name += " on " + node.Info().Index
+		}
+		results[name] = strings.Join(pairs, "")
+	}
+	return results
+}
+
+// TestJoinStrategies checks that every join algorithm finds the same
+// pairs, including none for NULL keys and for an empty input, whichever
+// kind of index the join column has.
+func TestJoinStrategies(t *testing.T) {
+	lRows := []string{
+		"INSERT INTO l (id, k) VALUES (1, 1)",
+		"INSERT INTO l (id, k) VALUES (2, 2)",
+		"INSERT INTO l (id, k) VALUES (3, 2)",
+		"INSERT INTO l (id, k) VALUES (4, NULL)",
+		"INSERT INTO l (id, k) VALUES (5, 3)",
+	}
+	rRows := []string{
+		"INSERT INTO r (id, k) VALUES (10, 2)",
+		"INSERT INTO r (id, k) VALUES (11, 2)",
+		"INSERT INTO r (id, k) VALUES (12, NULL)",
+		"INSERT INTO r (id, k) VALUES (13, 4)",
+		"INSERT INTO r (id, k) VALUES (14, 1)",
+	}
+	for _, kind := range []string{"BTREE", "HASH"} {
+		for _, tc := range []struct {
+			name  string
+			left  []string
+			right []string
+			where string
+			want  string
+		}{
+			{name: "null keys", left: lRows, right: rRows, want: "(1 14)(2 10)(2 11)(3 10)(3 11)"},
+			{name: "filtered", left: lRows, right: rRows, where: " WHERE r.id > 10", want: "(2 11)(3 11)(1 14)"},
+			{name: "empty right", left: lRows},
+			{name: "empty left", right: rRows},
+		} {
+			t.Run(kind+"/"+tc.name, func(t *testing.T) {
+				db := newTestDB(t)
+				mustExec(t, db, "CREATE TABLE l (id INT PRIMARY KEY, k INT)")
+				mustExec(t, db, "CREATE TABLE r (id INT PRIMARY KEY, k INT)")
+				mustExec(t, db, "CREATE INDEX l_k ON l USING "+kind+" (k)")
+				mustExec(t, db, "CREATE INDEX r_k ON r USING "+kind+" (k)")
+				for _, query := range append(tc.left, tc.right...) {
+					mustExec(t, db, query)
+				}
+
+				results := joinResults(t, db, "SELECT * FROM l JOIN r ON l.k = r.k"+tc.where)
+				for _, name := range []string{"Nested Loop Join", "Hash Join", "Index Nested Loop Join on l_k", "Index Nested Loop Join on r_k"} {
+					if _, ok := results[name]; !ok {
+						t.Errorf("no %s was considered", name)
+					}
+				}
+				if _, ok := results["Merge Join"]; !ok && kind == "BTREE" {
+					t.Error("no Merge Join was considered")
+				}
+				want := sortedPairs(tc.want)
+				for name, got := range results {
+					if got != want {
+						t.Errorf("%s found %s, want %s", name, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// sortedPairs sorts the "(a b)" pairs in s.
+func sortedPairs(s string) string {
+	if s == "" {
+		return ""
+	}
+	pairs := strings.SplitAfter(s, ")")
+	sort.Strings(pairs)
+	return strings.Join(pairs, "")
+}
@@ -0,0 +1,430 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSON column values are stored as compact JSON text. Paths use the
+// $.key.sub[0] syntax; a bare key or integer is accepted on the right-hand
+// side of -> and ->>.
+
+type jsonPathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func normalizeJSON(val interface{}) (string, error) {
+	text, ok := val.(string)
+	if !ok {
+		data, err := json.Marshal(val)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(text)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func decodeJSON(text string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("malformed JSON: %v", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("malformed JSON: trailing data")
+	}
+	return doc, nil
+}
+
+func encodeJSON(doc interface{}) string {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSON path must start with $: %s", path)
+	}
+
+	steps := make([]jsonPathStep, 0)
+	i := 1
+	for i < len(path) {
+		switch path[i] {
+		case '.':
+			i++
+			if i < len(path) && path[i] == '"' {
+				end := strings.IndexByte(path[i+1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("unterminated key in JSON path: %s", path)
+				}
+				steps = append(steps, jsonPathStep{key: path[i+1 : i+1+end]})
+				i += end + 2
+				continue
+			}
+			j := i
+			for j < len(path) && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("empty key in JSON path: %s", path)
+			}
+			steps = append(steps, jsonPathStep{key: path[i:j]})
+			i = j
+		case '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in JSON path: %s", path)
+			}
+			idx, err := strconv.Atoi(path[i+1 : i+end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index in JSON path: %s", path)
+			}
+			steps = append(steps, jsonPathStep{index: idx, isIndex: true})
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("invalid JSON path: %s", path)
+		}
+	}
+
+	return steps, nil
+}
+
+func jsonLookup(doc interface{}, steps []jsonPathStep) (interface{}, bool) {
+	current := doc
+	for _, step := range steps {
+		if step.isIndex {
+			arr, ok := current.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			idx := step.index
+			if idx < 0 {
+				idx += len(arr)
+			}
+			if idx < 0 || idx >= len(arr) {
+				return nil, false
+			}
+			current = arr[idx]
+		} else {
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			val, exists := obj[step.key]
+			if !exists {
+				return nil, false
+			}
+			current = val
+		}
+	}
+	return current, true
+}
+
+func jsonAssign(doc interface{}, steps []jsonPathStep, val interface{}) (interface{}, error) {
+	if len(steps) == 0 {
+		return val, nil
+	}
+
+	step := steps[0]
+	if step.isIndex {
+		arr, ok := doc.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("json_set: cannot index into non-array")
+		}
+		idx := step.index
+		if idx < 0 {
+			idx += len(arr)
+		}
+		if idx < 0 || idx > len(arr) {
+			return nil, fmt.Errorf("json_set: array index %d out of range", step.index)
+		}
+		if idx == len(arr) {
+			arr = append(arr, nil)
+		}
+		child, err := jsonAssign(arr[idx], steps[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		arr[idx] = child
+		return arr, nil
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		if doc != nil {
+			return nil, fmt.Errorf("json_set: cannot set key %s on non-object", step.key)
+		}
+		obj = make(map[string]interface{})
+	}
+	child, err := jsonAssign(obj[step.key], steps[1:], val)
+	if err != nil {
+		return nil, err
+	}
+	obj[step.key] = child
+	return obj, nil
+}
+
+// jsonToSQL converts a decoded JSON value into the value a query sees:
+// scalars become INT/FLOAT/STRING, booleans become 1/0, and objects and
+// arrays stay as JSON text.
+func jsonToSQL(val interface{}) interface{} {
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case json.Number:
+		if i, err := strconv.Atoi(v.String()); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case string:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	default:
+		return encodeJSON(v)
+	}
+}
+
+func jsonTypeName(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		if _, err := strconv.Atoi(v.String()); err == nil {
+			return "integer"
+		}
+		return "real"
+	case string:
+		return "text"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func jsonArgDoc(arg interface{}) (interface{}, error) {
+	text, ok := arg.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected JSON text, got %v", arg)
+	}
+	return decodeJSON(text)
+}
+
+func jsonArgPath(arg interface{}) ([]jsonPathStep, error) {
+	path, ok := arg.(string)
+	if !ok {
+		return nil, fmt.Errorf("expected JSON path, got %v", arg)
+	}
+	return parseJSONPath(path)
+}
+
+// jsonArrow implements doc->key and doc->>key. The key may be a full path,
+// an object key or an array index.
+func jsonArrow(docVal, keyVal interface{}, unquote bool) (interface{}, error) {
+	if docVal == nil {
+		return nil, nil
+	}
+	doc, err := jsonArgDoc(docVal)
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []jsonPathStep
+	switch k := keyVal.(type) {
+	case int:
+		steps = []jsonPathStep{{index: k, isIndex: true}}
+	case string:
+		if strings.HasPrefix(k, "$") {
+			steps, err = parseJSONPath(k)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			steps = []jsonPathStep{{key: k}}
+		}
+	default:
+		return nil, fmt.Errorf("invalid JSON key: %v", keyVal)
+	}
+
+	val, found := jsonLookup(doc, steps)
+	if !found {
+		return nil, nil
+	}
+	if unquote {
+		return jsonToSQL(val), nil
+	}
+	return encodeJSON(val), nil
+}
+
+func jsonExtractFunc(args []interface{}, _ []*scalarExpr) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("json_extract requires a document and a path")
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	doc, err := jsonArgDoc(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]interface{}, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		steps, err := jsonArgPath(arg)
+		if err != nil {
+			return nil, err
+		}
+		val, found := jsonLookup(doc, steps)
+		if !found {
+			val = nil
+		}
+		results = append(results, val)
+	}
+
+	// A single path returns the SQL value, several paths return a JSON array
+	if len(results) == 1 {
+		return jsonToSQL(results[0]), nil
+	}
+	return encodeJSON(results), nil
+}
+
+func jsonArrayLengthFunc(args []interface{}, _ []*scalarExpr) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("json_array_length takes a document and an optional path")
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	doc, err := jsonArgDoc(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 2 {
+		steps, err := jsonArgPath(args[1])
+		if err != nil {
+			return nil, err
+		}
+		val, found := jsonLookup(doc, steps)
+		if !found {
+			return nil, nil
+		}
+		doc = val
+	}
+
+	if arr, ok := doc.([]interface{}); ok {
+		return len(arr), nil
+	}
+	return 0, nil
+}
+
+func jsonSetFunc(args []interface{}, exprs []*scalarExpr) (interface{}, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return nil, fmt.Errorf("json_set requires a document followed by path/value pairs")
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	doc, err := jsonArgDoc(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		steps, err := jsonArgPath(args[i])
+		if err != nil {
+			return nil, err
+		}
+
+		val := args[i+1]
+		// Values produced by other JSON expressions are embedded as JSON
+		// rather than as a quoted string.
+		if text, ok := val.(string); ok && producesJSON(exprs[i+1]) {
+			if val, err = decodeJSON(text); err != nil {
+				return nil, err
+			}
+		}
+
+		if doc, err = jsonAssign(doc, steps, val); err != nil {
+			return nil, err
+		}
+	}
+
+	return encodeJSON(doc), nil
+}
+
+func jsonTypeFunc(args []interface{}, _ []*scalarExpr) (interface{}, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("json_type takes a document and an optional path")
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	doc, err := jsonArgDoc(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 2 {
+		steps, err := jsonArgPath(args[1])
+		if err != nil {
+			return nil, err
+		}
+		val, found := jsonLookup(doc, steps)
+		if !found {
+			return nil, nil
+		}
+		doc = val
+	}
+
+	return jsonTypeName(doc), nil
+}
+
+func jsonValidFunc(args []interface{}, _ []*scalarExpr) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("json_valid takes exactly one argument")
+	}
+	if text, ok := args[0].(string); ok && json.Valid([]byte(text)) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func producesJSON(e *scalarExpr) bool {
+	if e == nil {
+		return false
+	}
+	switch e.Kind {
+	case "->":
+		return true
+	case "call":
+		return e.Name == "json_set"
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrReadOnly is returned for writes to a database attached read-only.
+var ErrReadOnly = errors.New("database is attached read-only")
+
+// errLocked is what tryLock returns when another process holds the lock.
+var errLocked = errors.New("lock is held by another process")
+
+// fileLock is an exclusive advisory lock on a file beside the database
+// files, held for as long as a process may write the database. The lock
+// file itself holds the process id of its owner, for error messages.
+type fileLock struct {
+	file *os.File
+}
+
+// lockDatabase takes the lock at path without waiting. If another process
+// holds it, the error says which one and how to attach read-only instead.
+func lockDatabase(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := tryLock(file); err != nil {
+		file.Close()
+		if !errors.Is(err, errLocked) {
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		owner := "another process"
+		if pid, err := os.ReadFile(path); err == nil && len(pid) > 0 {
+			owner = "process " + strings.TrimSpace(string(pid))
+		}
+		return nil, &InUseError{Owner: owner, LockFile: path}
+	}
+
+	if err := file.Truncate(0); err == nil {
+		fmt.Fprintf(file, "%d\n", os.Getpid())
+	}
+	return &fileLock{file: file}, nil
+}
+
+// unlock releases the lock. The file stays, since removing it could let
+// two processes lock different files of the same name.
+func (l *fileLock) unlock() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,22 @@
+//go:build solaris || aix
+
+package minidb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive fcntl lock on file where flock is missing,
+// failing with errLocked rather than waiting if another process holds one.
+// Closing the file releases it. Unlike flock, fcntl locks belong to the
+// process, so they only keep other processes out.
+func tryLock(file *os.File) error {
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK} // the whole file
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return errLocked
+	}
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !unix && !windows
+
+package minidb
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// tryLock fails where there is no way to lock files: without a lock two
+// processes could write the same database, so only read-only attaches are
+// allowed there.
+func tryLock(file *os.File) error {
+	return fmt.Errorf("files cannot be locked on %s; attach read-only instead", runtime.GOOS)
+}
@@ -0,0 +1,19 @@
+//go:build unix && !solaris && !aix
+
+package minidb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on file, failing with errLocked rather
+// than waiting if another process holds one. Closing the file releases it.
+func tryLock(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLocked
+	}
+	return err
+}
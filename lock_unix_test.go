@@ -0,0 +1,38 @@
+//go:build unix && !solaris && !aix
+
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minidb.lock")
+	lock, err := lockDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flock locks belong to the open file, so a second open conflicts even
+	// within one process
+	var inUse *InUseError
+	if _, err := lockDatabase(path); !errors.As(err, &inUse) {
+		t.Fatalf("second lock: got %v, want an InUseError", err)
+	}
+	if want := fmt.Sprintf("process %d", os.Getpid()); inUse.Owner != want {
+		t.Errorf("owner is %q, want %q", inUse.Owner, want)
+	}
+
+	if err := lock.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	relocked, err := lockDatabase(path)
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	relocked.unlock()
+}
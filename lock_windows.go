@@ -0,0 +1,34 @@
+//go:build windows
+
+package minidb
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errLockViolation syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+// tryLock takes an exclusive LockFileEx lock on file, failing with
+// errLocked rather than waiting if another process holds one. Closing the
+// file releases it. The byte locked lies far past the process id the file
+// holds, so that other processes can still read it.
+func tryLock(file *os.File) error {
+	overlapped := syscall.Overlapped{OffsetHigh: 1}
+	ok, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if err == errLockViolation {
+		return errLocked
+	}
+	return err
+}
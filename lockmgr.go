@@ -0,0 +1,373 @@
+package minidb
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Transactions lock the rows they change, and those SELECT ... FOR UPDATE
+// or FOR SHARE reads, until they end; plain reads take no locks, since a
+// snapshot already keeps them apart from writers. A row is locked shared
+// or exclusive, after an intention lock on its table, so that a lock on a
+// whole table meets the locks on its rows in the table's entry. Once a
+// transaction holds lockEscalation row locks in a table, it locks the
+// table instead.
+//
+// A request that conflicts with the holders of a lock, or with requests
+// queued before it, waits in the lock's queue. The lock manager keeps the
+// wait-for graph this way; a wait that would close a cycle picks the
+// youngest transaction on it as the victim, which is aborted.
+
+// lockEscalation is how many rows of one table a transaction locks before
+// it locks the table instead.
+const lockEscalation = 1024
+
+var ErrDeadlock = errors.New("deadlock detected; the transaction was rolled back")
+
+type lockMode int
+
+const (
+	lockNone lockMode = iota
+	lockIS            // intends to lock rows shared
+	lockIX            // intends to lock rows exclusive
+	lockS
+	lockSIX // S on the table and IX: reads it all, changes some rows
+	lockX
+)
+
+// lockCompatible tells which modes different transactions can hold at
+// once.
+var lockCompatible = [...][6]bool{
+	lockNone: {true, true, true, true, true, true},
+	lockIS:   {true, true, true, true, true, false},
+	lockIX:   {true, true, true, false, false, false},
+	lockS:    {true, true, false, true, false, false},
+	lockSIX:  {true, true, false, false, false, false},
+	lockX:    {true, false, false, false, false, false},
+}
+
+// join returns the weakest mode covering both m and o: what a transaction
+// holding m holds once it also gets o.
+func (m lockMode) join(o lockMode) lockMode {
+	switch {
+	case m == o || o == lockNone:
+		return m
+	case m == lockNone || m == lockIS:
+		return o
+	case o == lockIS:
+		return m
+	case m == lockX || o == lockX:
+		return lockX
+	}
+	// What is left is S, IX and SIX, two of them different
+	return lockSIX
+}
+
+// lockID names a table, or a row of one by its rowKey.
+type lockID struct {
+	table string
+	row   string
+}
+
+type lockEntry struct {
+	holders map[uint64]lockMode
+	queue   []*lockRequest
+}
+
+// lockRequest is a transaction waiting for a lock. done receives nil once
+// the lock is granted, or ErrDeadlock if the transaction is the victim of
+// a deadlock.
+type lockRequest struct {
+	tx   uint64
+	id   lockID
+	mode lockMode // joined with what tx already holds
+	done chan error
+}
+
+// lockWait is the error of a statement that has to wait for a lock. The
+// statement is undone and gives up its latches, waits, and runs again.
+type lockWait struct {
+	req *lockRequest
+}
+
+func (w *lockWait) Error() string {
+	return "waiting for a lock"
+}
+
+// lockGrant records a lock granted to a transaction and the mode it held
+// before, so the grant can be taken back.
+type lockGrant struct {
+	id   lockID
+	prev lockMode
+}
+
+type lockManager struct {
+	mu      sync.Mutex
+	entries map[lockID]*lockEntry
+	held    map[uint64][]lockGrant    // in the order they were granted
+	rows    map[uint64]map[string]int // row locks held, by table
+	waiting map[uint64]*lockRequest
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		entries: make(map[lockID]*lockEntry),
+		held:    make(map[uint64][]lockGrant),
+		rows:    make(map[uint64]map[string]int),
+		waiting: make(map[uint64]*lockRequest),
+	}
+}
+
+// lockTable locks a table in mode for tx. It returns a request to wait on
+// if the lock is not free.
+func (lm *lockManager) lockTable(tx uint64, table string, mode lockMode) (*lockRequest, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return lm.acquire(tx, lockID{table: table}, mode)
+}
+
+// lockRow locks a row of table, lockS or lockX, for tx. It takes the
+// intention lock on the table first, or the table itself in mode once tx
+// has locked lockEscalation of its rows.
+func (lm *lockManager) lockRow(tx uint64, table, key string, mode lockMode) (*lockRequest, error) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+
+	tableID := lockID{table: table}
+	held := lm.holding(tx, tableID)
+	if held.join(mode) == held {
+		return nil, nil
+	}
+	if lm.rows[tx][table] >= lockEscalation {
+		return lm.acquire(tx, tableID, mode)
+	}
+	intent := lockIS
+	if mode == lockX {
+		intent = lockIX
+	}
+	if req, err := lm.acquire(tx, tableID, intent); req != nil || err != nil {
+		return req, err
+	}
+	return lm.acquire(tx, lockID{table: table, row: key}, mode)
+}
+
+func (lm *lockManager) holding(tx uint64, id lockID) lockMode {
+	if entry, ok := lm.entries[id]; ok {
+		return entry.holders[tx]
+	}
+	return lockNone
+}
+
+// acquire grants id to tx in mode, or queues a request for it. A request
+// to strengthen a lock tx already holds goes ahead of the others queued,
+// which could otherwise never be granted before it.
+func (lm *lockManager) acquire(tx uint64, id lockID, mode lockMode) (*lockRequest, error) {
+	entry, ok := lm.entries[id]
+	if !ok {
+		entry = &lockEntry{holders: make(map[uint64]lockMode)}
+		lm.entries[id] = entry
+	}
+	held := entry.holders[tx]
+	want := held.join(mode)
+	if want == held {
+		return nil, nil
+	}
+	upgrade := held != lockNone
+	if (upgrade || len(entry.queue) == 0) && entry.grantable(tx, want) {
+		lm.grant(entry, tx, id, want)
+		return nil, nil
+	}
+
+	req := &lockRequest{tx: tx, id: id, mode: want, done: make(chan error, 1)}
+	if upgrade {
+		entry.queue = append([]*lockRequest{req}, entry.queue...)
+	} else {
+		entry.queue = append(entry.queue, req)
+	}
+	lm.waiting[tx] = req
+
+	if cycle := lm.cycle(tx); cycle != nil {
+		victim := cycle[0]
+		for _, t := range cycle {
+			victim = max(victim, t)
+		}
+		aborted := lm.waiting[victim]
+		lm.dequeue(aborted)
+		if victim == tx {
+			return nil, ErrDeadlock
+		}
+		aborted.done <- ErrDeadlock
+	}
+	return req, nil
+}
+
+// grantable reports whether tx can hold mode beside the other holders.
+func (e *lockEntry) grantable(tx uint64, mode lockMode) bool {
+	for holder, held := range e.holders {
+		if holder != tx && !lockCompatible[held][mode] {
+			return false
+		}
+	}
+	return true
+}
+
+func (lm *lockManager) grant(entry *lockEntry, tx uint64, id lockID, mode lockMode) {
+	lm.held[tx] = append(lm.held[tx], lockGrant{id: id, prev: entry.holders[tx]})
+	if entry.holders[tx] == lockNone {
+		if id.row != "" {
+			if lm.rows[tx] == nil {
+				lm.rows[tx] = make(map[string]int)
+			}
+			lm.rows[tx][id.table]++
+		}
+	}
+	entry.holders[tx] = mode
+}
+
+// dequeue takes a waiting request out of its queue, leaving it in waiting
+// for whoever signals it. The requests behind it may be grantable now.
+func (lm *lockManager) dequeue(req *lockRequest) {
+	entry := lm.entries[req.id]
+	for i, r := range entry.queue {
+		if r == req {
+			entry.queue = append(entry.queue[:i], entry.queue[i+1:]...)
+			break
+		}
+	}
+	delete(lm.waiting, req.tx)
+	lm.wake(req.id, entry)
+}
+
+// wake grants queued requests in order until one has to keep waiting.
+func (lm *lockManager) wake(id lockID, entry *lockEntry) {
+	for len(entry.queue) > 0 {
+		req := entry.queue[0]
+		if !entry.grantable(req.tx, req.mode) {
+			break
+		}
+		entry.queue = entry.queue[1:]
+		delete(lm.waiting, req.tx)
+		lm.grant(entry, req.tx, id, req.mode)
+		req.done <- nil
+	}
+	if len(entry.holders) == 0 && len(entry.queue) == 0 {
+		delete(lm.entries, id)
+	}
+}
+
+// waitsFor lists the transactions tx waits for: those holding its lock
+// in a conflicting mode, and those queued before it for a conflicting one.
+func (lm *lockManager) waitsFor(tx uint64) []uint64 {
+	req := lm.waiting[tx]
+	if req == nil {
+		return nil
+	}
+	entry := lm.entries[req.id]
+	blockers := make([]uint64, 0)
+	for holder, held := range entry.holders {
+		if holder != tx && !lockCompatible[held][req.mode] {
+			blockers = append(blockers, holder)
+		}
+	}
+	for _, r := range entry.queue {
+		if r == req {
+			break
+		}
+		if r.tx != tx && !lockCompatible[r.mode][req.mode] {
+			blockers = append(blockers, r.tx)
+		}
+	}
+	return blockers
+}
+
+// cycle returns the transactions on a cycle of the wait-for graph through
+// tx, or nil if there is none.
+func (lm *lockManager) cycle(tx uint64) []uint64 {
+	visited := map[uint64]bool{tx: true}
+	path := make([]uint64, 0)
+	var visit func(t uint64) bool
+	visit = func(t uint64) bool {
+		path = append(path, t)
+		for _, next := range lm.waitsFor(t) {
+			if next == tx {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				if visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(tx) {
+		return path
+	}
+	return nil
+}
+
+// wait blocks until req is granted. If ctx ends first the request is
+// withdrawn; a lock granted meanwhile is kept until the transaction ends.
+func (lm *lockManager) wait(ctx context.Context, req *lockRequest) error {
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+	}
+
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if lm.waiting[req.tx] == req {
+		lm.dequeue(req)
+	}
+	return interrupted(ctx)
+}
+
+// releaseAll gives up every lock tx holds, and any request it has queued.
+func (lm *lockManager) releaseAll(tx uint64) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	if req := lm.waiting[tx]; req != nil {
+		lm.dequeue(req)
+	}
+	for _, g := range lm.held[tx] {
+		if entry, ok := lm.entries[g.id]; ok {
+			delete(entry.holders, tx)
+			lm.wake(g.id, entry)
+		}
+	}
+	delete(lm.held, tx)
+	delete(lm.rows, tx)
+}
+
+// mark returns how many locks tx was granted so far, for releaseTo.
+func (lm *lockManager) mark(tx uint64) int {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	return len(lm.held[tx])
+}
+
+// releaseTo takes back the locks granted to tx since mark, latest first,
+// leaving it the modes it held then.
+func (lm *lockManager) releaseTo(tx uint64, mark int) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	held := lm.held[tx]
+	for i := len(held) - 1; i >= mark; i-- {
+		g := held[i]
+		entry := lm.entries[g.id]
+		if g.prev != lockNone {
+			entry.holders[tx] = g.prev
+		} else {
+			delete(entry.holders, tx)
+			if g.id.row != "" {
+				lm.rows[tx][g.id.table]--
+			}
+		}
+		lm.wake(g.id, entry)
+	}
+	lm.held[tx] = held[:mark]
+}
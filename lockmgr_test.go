@@ -0,0 +1,190 @@
+package minidb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func lockTestDB(t *testing.T, options ...Option) *DB {
+	t.Helper()
+	db := newTestDB(t, options...)
+	mustExec(t, db, "CREATE TABLE a (id INT PRIMARY KEY, v INT)")
+	mustExec(t, db, "INSERT INTO a (id, v) VALUES (1, 0)")
+	mustExec(t, db, "INSERT INTO a (id, v) VALUES (2, 0)")
+	return db
+}
+
+// lockQueued reports whether tx has a lock request queued.
+func lockQueued(db *DB, tx *Tx) bool {
+	db.locks.mu.Lock()
+	defer db.locks.mu.Unlock()
+	_, waiting := db.locks.waiting[tx.state.id]
+	for _, entry := range db.locks.entries {
+		for _, req := range entry.queue {
+			if req.tx == tx.state.id {
+				waiting = true
+			}
+		}
+	}
+	return waiting
+}
+
+// waitForLock returns once tx has a lock request queued.
+func waitForLock(t *testing.T, db *DB, tx *Tx) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(time.Millisecond) {
+		if lockQueued(db, tx) {
+			return
+		}
+	}
+	t.Fatal("the transaction never waited for a lock")
+}
+
+// execAsync runs a statement of tx in the background.
+func execAsync(tx *Tx, query string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := tx.Exec(query)
+		done <- err
+	}()
+	return done
+}
+
+func TestDeadlock(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		youngerLast bool // the younger transaction closes the cycle
+	}{
+		{"younger closes the cycle", true},
+		{"older closes the cycle", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := lockTestDB(t)
+			older, younger := db.Begin(), db.Begin()
+			if _, err := older.Exec("UPDATE a SET v = 1 WHERE id = 1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := younger.Exec("UPDATE a SET v = 2 WHERE id = 2"); err != nil {
+				t.Fatal(err)
+			}
+
+			var olderDone, youngerDone chan error
+			if tc.youngerLast {
+				olderDone = execAsync(older, "UPDATE a SET v = 1 WHERE id = 2")
+				waitForLock(t, db, older)
+				youngerDone = execAsync(younger, "UPDATE a SET v = 2 WHERE id = 1")
+			} else {
+				youngerDone = execAsync(younger, "UPDATE a SET v = 2 WHERE id = 1")
+				waitForLock(t, db, younger)
+				olderDone = execAsync(older, "UPDATE a SET v = 1 WHERE id = 2")
+			}
+
+			within(t, func() {
+				if err := <-youngerDone; !errors.Is(err, ErrDeadlock) {
+					t.Errorf("younger transaction: got %v, want ErrDeadlock", err)
+				}
+				if err := <-olderDone; err != nil {
+					t.Errorf("older transaction: %v", err)
+				}
+			})
+			if err := younger.Commit(); !errors.Is(err, ErrTxDone) {
+				t.Errorf("committing the victim: got %v, want ErrTxDone", err)
+			}
+			if err := older.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range mustExec(t, db, "SELECT * FROM a").Rows {
+				if row["v"] != 1 {
+					t.Errorf("row %v has v = %v, want the older transaction's 1", row["id"], row["v"])
+				}
+			}
+		})
+	}
+}
+
+func TestSelectForUpdateBlocksUpdate(t *testing.T) {
+	db := lockTestDB(t)
+	locker := db.Begin()
+	if _, err := locker.Exec("SELECT * FROM a WHERE id = 1 FOR UPDATE"); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := db.Begin()
+	done := execAsync(writer, "UPDATE a SET v = 5 WHERE id = 1")
+	waitForLock(t, db, writer)
+	select {
+	case err := <-done:
+		t.Fatalf("UPDATE of a row locked FOR UPDATE finished early: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := locker.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, func() {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if rows := mustExec(t, db, "SELECT v FROM a WHERE id = 1").Rows; rows[0]["v"] != 5 {
+		t.Errorf("v is %v, want 5", rows[0]["v"])
+	}
+}
+
+// TestLockWaitEnds ends a lock wait by cancelling it and by a statement
+// timeout, and checks that the request leaves the queue while the
+// transaction stays usable.
+func TestLockWaitEnds(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options []Option
+		cancel  bool
+		want    error
+	}{
+		{name: "cancel", cancel: true, want: context.Canceled},
+		{name: "statement timeout", options: []Option{WithStatementTimeout(20 * time.Millisecond)}, want: ErrStatementTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := lockTestDB(t, tc.options...)
+			holder := db.Begin()
+			if _, err := holder.Exec("UPDATE a SET v = 1 WHERE id = 1"); err != nil {
+				t.Fatal(err)
+			}
+
+			waiter := db.Begin()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				go func() {
+					for !lockQueued(db, waiter) {
+						time.Sleep(time.Millisecond)
+					}
+					cancel()
+				}()
+			}
+			within(t, func() {
+				if _, err := waiter.ExecContext(ctx, "UPDATE a SET v = 2 WHERE id = 1"); !errors.Is(err, tc.want) {
+					t.Errorf("got %v, want %v", err, tc.want)
+				}
+			})
+			if lockQueued(db, waiter) {
+				t.Fatal("the request is still queued after the wait ended")
+			}
+
+			if err := holder.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := waiter.Exec("UPDATE a SET v = 2 WHERE id = 2"); err != nil {
+				t.Fatalf("transaction after its wait ended: %v", err)
+			}
+			if err := waiter.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
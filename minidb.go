@@ -0,0 +1,43 @@
+// Package minidb is a relational database that runs inside a Go program.
+//
+// Open a database with Open, run statements with Exec and Query, and group
+// them into a transaction with Begin:
+//
+//	db, err := minidb.Open("data/shop")
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//
+//	rows, err := db.Query("SELECT id, name FROM users WHERE age > ?", 30)
+//	if err != nil {
+//		return err
+//	}
+//	defer rows.Close()
+//	for rows.Next() {
+//		var id int
+//		var name string
+//		if err := rows.Scan(&id, &name); err != nil {
+//			return err
+//		}
+//	}
+//	return rows.Err()
+//
+// A DB is safe to use from many goroutines. An Instance keeps several
+// databases in one directory, and a Session runs the statements of one
+// client with USE and SET, as the minidb command does for its REPL.
+package minidb
+
+// Open opens the database kept in files starting with path, path.db and
+// path.wal, creating it if there are none yet, and loads it. Options such
+// as ReadOnly and WithStatementTimeout apply as for NewDB; WithStorage
+// replaces the WAL storage engine on path with another one.
+func Open(path string, options ...Option) (*DB, error) {
+	options = append([]Option{WithStorage(NewWALStorage(path + ".db"))}, options...)
+	db := NewDB(options...)
+	if err := db.Load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
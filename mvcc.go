@@ -0,0 +1,499 @@
+package minidb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+)
+
+// IsolationLevel controls which committed changes a transaction sees.
+type IsolationLevel int
+
+const (
+	// ReadCommitted gives every statement a fresh snapshot.
+	ReadCommitted IsolationLevel = iota
+	// RepeatableRead keeps the snapshot taken by the first statement.
+	RepeatableRead
+	// Serializable is RepeatableRead plus a commit-time check that no
+	// table the transaction read was changed by a concurrent commit.
+	Serializable
+)
+
+var isolationNames = map[IsolationLevel]string{
+	ReadCommitted:  "READ COMMITTED",
+	RepeatableRead: "REPEATABLE READ",
+	Serializable:   "SERIALIZABLE",
+}
+
+func (l IsolationLevel) String() string {
+	return isolationNames[l]
+}
+
+// parseIsolationLevel accepts a level name such as "REPEATABLE READ".
+func parseIsolationLevel(name string) (IsolationLevel, bool) {
+	for level, n := range isolationNames {
+		if strings.EqualFold(n, name) {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+var (
+	ErrWriteConflict = errors.New("could not serialize access due to concurrent update")
+	ErrSerialization = errors.New("could not serialize access due to read/write dependencies among transactions")
+)
+
+// gcThreshold is how many versions may become obsolete before a commit
+// collects them.
+const gcThreshold = 256
+
+// abortedTxID marks versions created by a change that was rolled back.
+// Versions created by transaction 0 are visible to everyone.
+const abortedTxID = math.MaxUint64
+
+type txStatus int
+
+const (
+	txActive txStatus = iota
+	txCommitted
+	txAborted
+)
+
+type txnState struct {
+	id       uint64
+	status   txStatus
+	commitTS uint64
+	level    IsolationLevel
+	snapshot uint64 // REPEATABLE READ and up: fixed by the first statement
+	reads    map[string]bool
+	writes   map[string]bool
+}
+
+// rowVersion records the transactions that created and deleted one version
+// of a row. xmax is 0 while the version is current.
+type rowVersion struct {
+	xmin uint64
+	xmax uint64
+}
+
+// txManager hands out transaction IDs and commit timestamps from a single
+// clock and remembers the outcome of every transaction that row versions
+// may still refer to. Its mutex guards all of that and the states it
+// keeps, since statements on different tables consult it at once.
+type txManager struct {
+	mu      sync.RWMutex
+	clock   uint64
+	txns    map[uint64]*txnState
+	commits []*txnState // recent commits, checked by SERIALIZABLE transactions
+	garbage int
+	kept    int            // commits an open snapshot kept at the last collection
+	cursors map[uint64]int // open cursors by the timestamp of their snapshot
+	idle    chan struct{}  // closed when the last open cursor closes
+}
+
+func newTxManager() *txManager {
+	return &txManager{txns: make(map[uint64]*txnState), cursors: make(map[uint64]int)}
+}
+
+func (m *txManager) begin(level IsolationLevel) *txnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock++
+	state := &txnState{
+		id:     m.clock,
+		level:  level,
+		reads:  make(map[string]bool),
+		writes: make(map[string]bool),
+	}
+	m.txns[state.id] = state
+	return state
+}
+
+// committedAt returns the commit timestamp of a transaction and whether it
+// has committed. Transactions no longer tracked committed before every
+// open snapshot.
+func (m *txManager) committedAt(id uint64) (uint64, bool) {
+	switch id {
+	case 0:
+		return 0, true
+	case abortedTxID:
+		return 0, false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	state, ok := m.txns[id]
+	if !ok {
+		return 0, true
+	}
+	return state.commitTS, state.status == txCommitted
+}
+
+// horizon is the oldest snapshot any open transaction still reads from.
+// Versions deleted before it are invisible to everyone.
+func (m *txManager) horizon() uint64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	h := m.clock
+	for _, state := range m.txns {
+		if state.status == txActive && state.snapshot != 0 && state.snapshot < h {
+			h = state.snapshot
+		}
+	}
+	for ts := range m.cursors {
+		h = min(h, ts)
+	}
+	return h
+}
+
+// pin registers a cursor opening on a snapshot taken at ts. A cursor holds
+// no latches between batches, so the horizon stays at its snapshot and the
+// positions it walks must stay put: while any cursor is open, garbage
+// collection leaves tombstones where they are and checkpoints wait.
+func (m *txManager) pin(ts uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cursors[ts]++
+}
+
+// unpin registers the cursor pinned at ts closing.
+func (m *txManager) unpin(ts uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cursors[ts]--; m.cursors[ts] == 0 {
+		delete(m.cursors, ts)
+	}
+	if len(m.cursors) == 0 && m.idle != nil {
+		close(m.idle)
+		m.idle = nil
+	}
+}
+
+// pinned reports whether any cursor is open.
+func (m *txManager) pinned() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.cursors) > 0
+}
+
+// unpinned waits until no cursor is open, or ctx is done.
+func (m *txManager) unpinned(ctx context.Context) error {
+	m.mu.Lock()
+	if len(m.cursors) == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	if m.idle == nil {
+		m.idle = make(chan struct{})
+	}
+	idle := m.idle
+	m.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return interrupted(ctx)
+	}
+}
+
+// latest is a snapshot of everything committed so far.
+func (m *txManager) latest() snapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return snapshot{mgr: m, ts: m.clock}
+}
+
+// addGarbage counts a version that became obsolete.
+func (m *txManager) addGarbage() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.garbage++
+}
+
+// garbageDue reports whether enough versions became obsolete, or enough
+// commits piled up since the last collection, for a commit to collect
+// garbage.
+func (m *txManager) garbageDue() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.garbage >= gcThreshold || len(m.commits)-m.kept >= gcThreshold
+}
+
+// forget drops an active transaction that ends without leaving versions
+// behind, and marks it with status.
+func (m *txManager) forget(state *txnState, status txStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state.status = status
+	delete(m.txns, state.id)
+}
+
+// snapshot decides which row versions a statement sees: those committed
+// at or before ts, plus the reading transaction's own changes.
+type snapshot struct {
+	mgr  *txManager
+	ts   uint64
+	self uint64
+}
+
+func (s snapshot) committed(id uint64) bool {
+	if id == s.self && id != 0 {
+		return true
+	}
+	ts, ok := s.mgr.committedAt(id)
+	return ok && ts <= s.ts
+}
+
+func (s snapshot) sees(v *rowVersion) bool {
+	return s.committed(v.xmin) && (v.xmax == 0 || !s.committed(v.xmax))
+}
+
+// frozenVersion describes every base version missing from baseVersions:
+// visible to everyone and deleted by no one. It is shared, so it must
+// never change; ownVersion gives a base version one of its own first.
+var frozenVersion = &rowVersion{}
+
+// version returns the version record of position i.
+func (t *Table) version(i int) *rowVersion {
+	n := t.baseRows()
+	if i >= n {
+		return t.versions[i-n]
+	}
+	if v, ok := t.baseVersions[i]; ok {
+		return v
+	}
+	return frozenVersion
+}
+
+// ownVersion returns the version record of position i for changing it.
+func (t *Table) ownVersion(i int) *rowVersion {
+	v := t.version(i)
+	if v == frozenVersion {
+		v = &rowVersion{}
+		t.baseVersions[i] = v
+	}
+	return v
+}
+
+// visible reports whether the version at position i is in the snapshot.
+func (t *Table) visible(snap snapshot, i int) bool {
+	return snap.sees(t.version(i))
+}
+
+// mayBeLive reports whether the version at position i exists, or will
+// again if an open transaction rolls back. Unique constraints hold across
+// all such versions, whatever the snapshot.
+func (t *Table) mayBeLive(i int, self uint64) bool {
+	v := t.version(i)
+	if v.xmin == abortedTxID {
+		return false
+	}
+	if v.xmax == 0 {
+		return true
+	}
+	if v.xmax == self {
+		return false
+	}
+	_, committed := t.mgr.committedAt(v.xmax)
+	return !committed
+}
+
+// appendVersion adds a row version created by tx and indexes it.
+func (t *Table) appendVersion(tx *Tx, tuple rowTuple) {
+	i := t.rowCount()
+	v := &rowVersion{xmin: tx.state.id}
+	t.tuples = append(t.tuples, tuple)
+	t.versions = append(t.versions, v)
+	t.live++
+	for _, index := range t.indexes {
+		index.add(tuple, i)
+	}
+
+	tx.state.writes[t.Name] = true
+	tx.undo.log(walChange{Op: walInsert, Table: t.Name, Row: t.toRow(tuple)}, func() {
+		v.xmin = abortedTxID
+		t.live--
+		t.mgr.addGarbage()
+	})
+}
+
+// checkWritable fails if another transaction already changed the version
+// at position i. The first transaction to change a row wins.
+func (t *Table) checkWritable(tx *Tx, i int) error {
+	if v := t.version(i); v.xmax != 0 && v.xmax != tx.state.id {
+		return ErrWriteConflict
+	}
+	return nil
+}
+
+// lockRow locks the row at position i for tx in mode, lockS or lockX,
+// until tx ends. Rows are locked by content, so a lock outlives the row
+// moving to another position.
+func (t *Table) lockRow(tx *Tx, i int, mode lockMode) error {
+	req, err := tx.db.locks.lockRow(tx.state.id, t.Name, rowKey(t.tuple(i)), mode)
+	if req != nil {
+		return &lockWait{req: req}
+	}
+	return err
+}
+
+// lockTable locks the whole table for tx in mode until tx ends.
+func (t *Table) lockTable(tx *Tx, mode lockMode) error {
+	req, err := tx.db.locks.lockTable(tx.state.id, t.Name, mode)
+	if req != nil {
+		return &lockWait{req: req}
+	}
+	return err
+}
+
+// deleteVersion marks the version at position i as deleted by tx.
+func (t *Table) deleteVersion(tx *Tx, i int) error {
+	if err := t.checkWritable(tx, i); err != nil {
+		return err
+	}
+	v := t.ownVersion(i)
+	if v.xmax == tx.state.id {
+		return nil
+	}
+
+	v.xmax = tx.state.id
+	t.live--
+	t.mgr.addGarbage()
+	tx.state.writes[t.Name] = true
+	tx.undo.log(walChange{Op: walDelete, Table: t.Name, Row: t.row(i)}, func() {
+		v.xmax = 0
+		t.live++
+	})
+	return nil
+}
+
+// loadTuples installs rows read from disk as versions visible to everyone.
+func (t *Table) loadTuples(tuples []rowTuple) {
+	t.tuples = tuples
+	t.versions = make([]*rowVersion, len(tuples))
+	t.live = len(tuples)
+	for i := range tuples {
+		t.versions[i] = &rowVersion{}
+	}
+}
+
+// tombstone is the version record of a position whose version is gone. It
+// is shared, so it must never change.
+var tombstone = &rowVersion{xmin: abortedTxID}
+
+// vacuum drops versions no open transaction can see and freezes versions
+// every snapshot sees, so their transactions can be forgotten. Positions
+// are row IDs and do not move: a dead version in memory leaves a tombstone
+// in its place, and its index entries are removed one by one, so vacuuming
+// a deleted row costs the same however large the table. Versions in the
+// data file are only marked as aborted. compact reclaims the tombstones
+// once they make up half the rows in memory and no cursor is open; a
+// checkpoint reclaims both.
+func (t *Table) vacuum(horizon uint64) {
+	for i, v := range t.baseVersions {
+		if v.xmin == abortedTxID {
+			continue
+		}
+		if v.xmax != 0 {
+			if ts, ok := t.mgr.committedAt(v.xmax); ok && ts <= horizon {
+				v.xmin = abortedTxID
+				t.unindex(i)
+			}
+			continue
+		}
+		if ts, ok := t.mgr.committedAt(v.xmin); ok && ts <= horizon {
+			delete(t.baseVersions, i)
+		}
+	}
+
+	n := t.baseRows()
+	for i, v := range t.versions {
+		if v == tombstone {
+			continue
+		}
+		dead := v.xmin == abortedTxID
+		if !dead && v.xmax != 0 {
+			ts, ok := t.mgr.committedAt(v.xmax)
+			dead = ok && ts <= horizon
+		}
+		if dead {
+			t.unindex(n + i)
+			t.tuples[i], t.versions[i] = nil, tombstone
+			t.tombstones++
+			continue
+		}
+		if ts, ok := t.mgr.committedAt(v.xmin); ok && ts <= horizon {
+			v.xmin = 0
+		}
+	}
+
+	if t.tombstones > 0 && t.tombstones*2 >= len(t.tuples) && !t.mgr.pinned() {
+		t.compact()
+	}
+}
+
+// unindex removes the version at position i from the indexes held in
+// memory. Entries in the data file stay until the next checkpoint; scans
+// skip them, as they skip every version they cannot see.
+func (t *Table) unindex(i int) {
+	var tuple rowTuple
+	for _, index := range t.indexes {
+		if i < index.base {
+			continue
+		}
+		if tuple == nil {
+			tuple = t.tuple(i)
+		}
+		index.remove(tuple, i)
+	}
+}
+
+// compact reclaims the tombstones in memory. The versions after each one
+// move down, so the indexes in memory are rebuilt; waiting until half the
+// rows are tombstones keeps the cost per deleted row constant.
+func (t *Table) compact() {
+	if t.tombstones == 0 {
+		return
+	}
+	tuples := make([]rowTuple, 0, len(t.tuples)-t.tombstones)
+	versions := make([]*rowVersion, 0, len(tuples))
+	for i, v := range t.versions {
+		if v != tombstone {
+			tuples = append(tuples, t.tuples[i])
+			versions = append(versions, v)
+		}
+	}
+	t.tuples, t.versions = tuples, versions
+	t.tombstones = 0
+	t.rebuildIndexes()
+}
+
+// collectGarbage vacuums every table and forgets transactions that no row
+// version or open snapshot refers to any more. The caller has the
+// database to itself.
+func (db *DB) collectGarbage() {
+	m := db.txm
+	horizon := m.horizon()
+	for _, table := range db.tables {
+		table.vacuum(horizon)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, state := range m.txns {
+		if state.status == txCommitted && state.commitTS <= horizon {
+			delete(m.txns, id)
+		}
+	}
+
+	commits := m.commits[:0]
+	for _, c := range m.commits {
+		if c.commitTS > horizon {
+			commits = append(commits, c)
+		}
+	}
+	m.commits = commits
+	m.garbage, m.kept = 0, len(commits)
+}
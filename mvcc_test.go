@@ -0,0 +1,182 @@
+package minidb
+
+import (
+	"errors"
+	"testing"
+)
+
+// txValue returns v of the row id of a as tx sees it, or nil if it sees no
+// such row.
+func txValue(t *testing.T, tx *Tx, id int) interface{} {
+	t.Helper()
+	result, err := tx.Exec("SELECT v FROM a WHERE id = ?", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) == 0 {
+		return nil
+	}
+	return result.Rows[0]["v"]
+}
+
+// TestIsolationVisibility checks which changes of other transactions a
+// transaction sees at each level: never those not yet committed, and
+// those committed after its first statement only under READ COMMITTED.
+func TestIsolationVisibility(t *testing.T) {
+	for _, tc := range []struct {
+		level       IsolationLevel
+		seesCommits bool
+	}{
+		{ReadCommitted, true},
+		{RepeatableRead, false},
+		{Serializable, false},
+	} {
+		t.Run(tc.level.String(), func(t *testing.T) {
+			db := lockTestDB(t)
+			reader := db.BeginTx(tc.level)
+			if v := txValue(t, reader, 1); v != 0 {
+				t.Fatalf("v is %v before any change, want 0", v)
+			}
+
+			writer := db.Begin()
+			if _, err := writer.Exec("UPDATE a SET v = 1 WHERE id = 1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writer.Exec("INSERT INTO a (id, v) VALUES (3, 3)"); err != nil {
+				t.Fatal(err)
+			}
+			if v := txValue(t, reader, 1); v != 0 {
+				t.Errorf("reader sees v = %v before the writer commits, want 0", v)
+			}
+			if v := txValue(t, reader, 3); v != nil {
+				t.Errorf("reader sees row 3 with v = %v before the writer commits", v)
+			}
+			if err := writer.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			wantV, wantNew := interface{}(0), interface{}(nil)
+			if tc.seesCommits {
+				wantV, wantNew = 1, 3
+			}
+			if v := txValue(t, reader, 1); v != wantV {
+				t.Errorf("after the writer commits reader sees v = %v, want %v", v, wantV)
+			}
+			if v := txValue(t, reader, 3); v != wantNew {
+				t.Errorf("after the writer commits reader sees row 3 as %v, want %v", v, wantNew)
+			}
+
+			// A transaction always sees its own changes
+			if _, err := reader.Exec("UPDATE a SET v = 7 WHERE id = 2"); err != nil {
+				t.Fatal(err)
+			}
+			if v := txValue(t, reader, 2); v != 7 {
+				t.Errorf("reader sees its own change as v = %v, want 7", v)
+			}
+			reader.Rollback()
+		})
+	}
+}
+
+// TestWriteConflict changes a row another transaction changed and
+// committed after the snapshot was taken, either before the change or
+// while it waited for the row's lock. Under REPEATABLE READ and up the
+// first writer wins; under READ COMMITTED the second change applies on
+// top of the first.
+func TestWriteConflict(t *testing.T) {
+	for _, level := range []IsolationLevel{ReadCommitted, RepeatableRead, Serializable} {
+		for _, waits := range []bool{false, true} {
+			name := level.String() + "/committed first"
+			if waits {
+				name = level.String() + "/waits for the lock"
+			}
+			t.Run(name, func(t *testing.T) {
+				db := lockTestDB(t)
+				tx := db.BeginTx(level)
+				txValue(t, tx, 1) // takes the snapshot
+
+				first := db.Begin()
+				if _, err := first.Exec("UPDATE a SET v = 1 WHERE id = 1"); err != nil {
+					t.Fatal(err)
+				}
+				var err error
+				if waits {
+					done := execAsync(tx, "UPDATE a SET v = 10 WHERE id = 1")
+					waitForLock(t, db, tx)
+					if err := first.Commit(); err != nil {
+						t.Fatal(err)
+					}
+					within(t, func() { err = <-done })
+				} else {
+					if err := first.Commit(); err != nil {
+						t.Fatal(err)
+					}
+					_, err = tx.Exec("UPDATE a SET v = 10 WHERE id = 1")
+				}
+
+				if level == ReadCommitted {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if err := tx.Commit(); err != nil {
+						t.Fatal(err)
+					}
+					if v := mustExec(t, db, "SELECT v FROM a WHERE id = 1").Rows[0]["v"]; v != 10 {
+						t.Errorf("v is %v, want the second writer's 10", v)
+					}
+					return
+				}
+				if !errors.Is(err, ErrWriteConflict) {
+					t.Fatalf("got %v, want ErrWriteConflict", err)
+				}
+				tx.Rollback()
+				if v := mustExec(t, db, "SELECT v FROM a WHERE id = 1").Rows[0]["v"]; v != 1 {
+					t.Errorf("v is %v, want the first writer's 1", v)
+				}
+			})
+		}
+	}
+}
+
+// TestSerializationFailure runs two transactions that each read both rows
+// and change a different one. Neither change conflicts with the other, so
+// REPEATABLE READ commits both; SERIALIZABLE fails the second commit,
+// since no serial order explains what both read.
+func TestSerializationFailure(t *testing.T) {
+	for _, level := range []IsolationLevel{RepeatableRead, Serializable} {
+		t.Run(level.String(), func(t *testing.T) {
+			db := lockTestDB(t)
+			first, second := db.BeginTx(level), db.BeginTx(level)
+			for _, step := range []struct {
+				tx    *Tx
+				query string
+			}{
+				{first, "SELECT * FROM a"},
+				{second, "SELECT * FROM a"},
+				{first, "UPDATE a SET v = 1 WHERE id = 1"},
+				{second, "UPDATE a SET v = 1 WHERE id = 2"},
+			} {
+				if _, err := step.tx.Exec(step.query); err != nil {
+					t.Fatalf("%s: %v", step.query, err)
+				}
+			}
+			if err := first.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			err := second.Commit()
+			want := "(1 1)(2 1)"
+			if level == Serializable {
+				if !errors.Is(err, ErrSerialization) {
+					t.Fatalf("second commit: got %v, want ErrSerialization", err)
+				}
+				want = "(1 1)(2 0)"
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := lockTestContents(t, db); got != want {
+				t.Errorf("committed %s, want %s", got, want)
+			}
+		})
+	}
+}
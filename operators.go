@@ -0,0 +1,681 @@
+package minidb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// PlanNode is an operator in a query plan. The executor opens the root and
+// pulls rows with Next until it reports no more; each operator pulls from
+// its children the same way.
+type PlanNode interface {
+	Open() error
+	Next() (Row, bool, error)
+	Close()
+	Info() *PlanInfo
+}
+
+// PlanInfo describes an operator for EXPLAIN and carries the planner's
+// estimates. EXPLAIN ANALYZE fills in the actual figures.
+type PlanInfo struct {
+	Name     string
+	Detail   string
+	Index    string
+	EstRows  float64
+	Cost     float64
+	Children []PlanNode
+
+	ActualRows int
+	Loops      int
+	Elapsed    time.Duration
+}
+
+func (p *PlanInfo) Info() *PlanInfo {
+	return p
+}
+
+// runPlan executes a plan and collects every row it produces.
+func runPlan(root PlanNode) ([]Row, error) {
+	if err := root.Open(); err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	rows := make([]Row, 0)
+	for {
+		row, ok, err := root.Next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return rows, nil
+		}
+		rows = append(rows, row)
+	}
+}
+
+// seqScanNode reads every row of a table and keeps those matching filter,
+// a batch at a time. Only the rows it returns are built into Row maps.
+type seqScanNode struct {
+	PlanInfo
+	ctx    context.Context
+	table  *Table
+	snap   snapshot
+	filter *predicate
+	latch  scanLatch
+	pos    int
+	batch  []rowTuple
+	next   int
+}
+
+func (n *seqScanNode) Open() error {
+	n.pos, n.batch, n.next = 0, nil, 0
+	return nil
+}
+
+func (n *seqScanNode) Next() (Row, bool, error) {
+	for n.next >= len(n.batch) {
+		ok, err := n.read()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+	}
+	tuple := n.batch[n.next]
+	n.next++
+	return n.table.toRow(tuple), true, nil
+}
+
+// read reads the next batch, and reports false once there is none.
+func (n *seqScanNode) read() (bool, error) {
+	defer n.latch.hold()()
+	count := n.table.rowCount()
+	if n.pos >= count {
+		return false, nil
+	}
+	if err := interrupted(n.ctx); err != nil {
+		return false, err
+	}
+	to := min(n.pos+scanBatchRows, count)
+	batch, err := n.table.scanBatch(n.snap, n.filter, n.pos, to, n.batch)
+	if err != nil {
+		return false, err
+	}
+	n.batch, n.next = batch, 0
+	n.pos = to
+	return true, nil
+}
+
+func (n *seqScanNode) Close() {}
+
+// indexScanNode reaches rows through an index and keeps those matching
+// filter.
+type indexScanNode struct {
+	PlanInfo
+	interrupter
+	table  *Table
+	snap   snapshot
+	path   accessPath
+	filter *predicate
+	latch  scanLatch
+	it     *indexIterator
+}
+
+func (n *indexScanNode) Open() error {
+	n.it = n.table.newIndexIterator(n.path)
+	return nil
+}
+
+func (n *indexScanNode) Next() (Row, bool, error) {
+	defer n.latch.hold()()
+	if n.latch != nil {
+		// The index may have changed since the last call
+		n.it.resume()
+	}
+	for {
+		idx, ok := n.it.next()
+		if !ok {
+			return nil, false, nil
+		}
+		if err := n.check(); err != nil {
+			return nil, false, err
+		}
+		if !n.table.visible(n.snap, idx) {
+			continue
+		}
+		tuple := n.table.tuple(idx)
+		ok, err := n.filter.matches(tuple)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return n.table.toRow(tuple), true, nil
+		}
+	}
+}
+
+func (n *indexScanNode) Close() {}
+
+// filterNode drops rows that do not match where.
+type filterNode struct {
+	PlanInfo
+	child PlanNode
+	table *Table
+	where *WhereClause
+}
+
+func (n *filterNode) Open() error {
+	return n.child.Open()
+}
+
+func (n *filterNode) Next() (Row, bool, error) {
+	for {
+		row, ok, err := n.child.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		ok, err = n.table.matchesWhere(row, n.where)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return row, true, nil
+		}
+	}
+}
+
+func (n *filterNode) Close() {
+	n.child.Close()
+}
+
+// sortNode materializes its input and sorts it.
+type sortNode struct {
+	PlanInfo
+	child   PlanNode
+	table   *Table
+	orderBy []OrderByItem
+	rows    []Row
+	pos     int
+}
+
+func (n *sortNode) Open() error {
+	rows, err := runPlan(n.child)
+	if err != nil {
+		return err
+	}
+	if _, err := n.table.sortRows(rows, n.orderBy); err != nil {
+		return err
+	}
+	n.rows = rows
+	n.pos = 0
+	return nil
+}
+
+func (n *sortNode) Next() (Row, bool, error) {
+	if n.pos >= len(n.rows) {
+		return nil, false, nil
+	}
+	row := n.rows[n.pos]
+	n.pos++
+	return row, true, nil
+}
+
+func (n *sortNode) Close() {
+	n.rows = nil
+}
+
+// limitNode stops pulling from its input after limit rows.
+type limitNode struct {
+	PlanInfo
+	child PlanNode
+	limit int
+	count int
+}
+
+func (n *limitNode) Open() error {
+	n.count = 0
+	return n.child.Open()
+}
+
+func (n *limitNode) Next() (Row, bool, error) {
+	if n.count >= n.limit {
+		return nil, false, nil
+	}
+	row, ok, err := n.child.Next()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	n.count++
+	return row, true, nil
+}
+
+func (n *limitNode) Close() {
+	n.child.Close()
+}
+
+// projectNode evaluates the select list for each row.
+type projectNode struct {
+	PlanInfo
+	child   PlanNode
+	table   *Table
+	columns []string
+}
+
+func (n *projectNode) Open() error {
+	return n.child.Open()
+}
+
+func (n *projectNode) Next() (Row, bool, error) {
+	row, ok, err := n.child.Next()
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if row, err = n.table.projectRow(row, n.columns); err != nil {
+		return nil, false, err
+	}
+	return row, true, nil
+}
+
+func (n *projectNode) Close() {
+	n.child.Close()
+}
+
+// aggregateNode folds its whole input into one row of MIN/MAX values. With
+// partial set, its input rows already hold values folded by item.
+type aggregateNode struct {
+	PlanInfo
+	child   PlanNode
+	table   *Table
+	items   []string
+	partial bool
+	done    bool
+}
+
+func (n *aggregateNode) Open() error {
+	n.done = false
+	return n.child.Open()
+}
+
+func (n *aggregateNode) Next() (Row, bool, error) {
+	if n.done {
+		return nil, false, nil
+	}
+	n.done = true
+
+	result := make(Row)
+	for _, item := range n.items {
+		result[item] = nil
+	}
+
+	for {
+		row, ok, err := n.child.Next()
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return result, true, nil
+		}
+		for _, item := range n.items {
+			fn, col, _ := parseAggregate(item)
+			val := row[col]
+			if n.partial {
+				val = row[item]
+			}
+			if val == nil {
+				continue
+			}
+			cmp := n.table.compare(col, val, result[item])
+			if result[item] == nil || (fn == "MAX" && cmp > 0) || (fn == "MIN" && cmp < 0) {
+				result[item] = val
+			}
+		}
+	}
+}
+
+func (n *aggregateNode) Close() {
+	n.child.Close()
+}
+
+// joinSides carries what every join operator needs to merge a pair of rows
+// into a joined row, and to stop when its statement's context is cancelled.
+type joinSides struct {
+	interrupter
+	left, right       *Table
+	leftCol, rightCol string
+}
+
+func (j joinSides) merge(leftRow, rightRow Row) Row {
+	return j.left.mergeJoinRows(j.right, leftRow, rightRow)
+}
+
+// hashJoinNode builds a hash table over one input and probes it with the
+// other.
+type hashJoinNode struct {
+	PlanInfo
+	joinSides
+	build, probe PlanNode
+	buildLeft    bool
+	hashed       map[interface{}][]Row
+	probeRow     Row
+	matches      []Row
+}
+
+func (n *hashJoinNode) Open() error {
+	buildCol := n.rightCol
+	if n.buildLeft {
+		buildCol = n.leftCol
+	}
+
+	rows, err := runPlan(n.build)
+	if err != nil {
+		return err
+	}
+	n.hashed = make(map[interface{}][]Row)
+	for _, row := range rows {
+		if val := row[buildCol]; val != nil {
+			n.hashed[val] = append(n.hashed[val], row)
+		}
+	}
+	n.matches = nil
+	return n.probe.Open()
+}
+
+func (n *hashJoinNode) Next() (Row, bool, error) {
+	probeCol := n.leftCol
+	if n.buildLeft {
+		probeCol = n.rightCol
+	}
+
+	if err := n.check(); err != nil {
+		return nil, false, err
+	}
+	for len(n.matches) == 0 {
+		row, ok, err := n.probe.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if val := row[probeCol]; val != nil {
+			n.probeRow = row
+			n.matches = n.hashed[val]
+		}
+	}
+
+	match := n.matches[0]
+	n.matches = n.matches[1:]
+	if n.buildLeft {
+		return n.merge(match, n.probeRow), true, nil
+	}
+	return n.merge(n.probeRow, match), true, nil
+}
+
+func (n *hashJoinNode) Close() {
+	n.probe.Close()
+	n.hashed = nil
+}
+
+// indexNestedLoopJoinNode looks up each outer row's key in an index on the
+// inner table.
+type indexNestedLoopJoinNode struct {
+	PlanInfo
+	joinSides
+	outer       PlanNode
+	inner       *Table
+	snap        snapshot
+	index       *tableIndex
+	innerFilter *predicate
+	innerLatch  scanLatch
+	innerLeft   bool
+	outerRow    Row
+	matches     []int
+}
+
+func (n *indexNestedLoopJoinNode) Open() error {
+	n.matches = nil
+	return n.outer.Open()
+}
+
+func (n *indexNestedLoopJoinNode) Next() (Row, bool, error) {
+	outerCol, innerCol := n.leftCol, n.rightCol
+	if n.innerLeft {
+		outerCol, innerCol = n.rightCol, n.leftCol
+	}
+	innerOrd := n.inner.ordinal(innerCol)
+
+	for {
+		match, err := n.nextMatch(innerOrd, n.outerRow[outerCol])
+		if err != nil {
+			return nil, false, err
+		}
+		if match != nil {
+			if n.innerLeft {
+				return n.merge(match, n.outerRow), true, nil
+			}
+			return n.merge(n.outerRow, match), true, nil
+		}
+
+		row, ok, err := n.outer.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if val := row[outerCol]; val != nil {
+			n.outerRow = row
+			n.matches = n.lookup(val)
+		}
+	}
+}
+
+// nextMatch returns the next inner row among matches that joins key, or
+// nil once there are none left.
+func (n *indexNestedLoopJoinNode) nextMatch(innerOrd int, key interface{}) (Row, error) {
+	if len(n.matches) == 0 {
+		return nil, nil
+	}
+	defer n.innerLatch.hold()()
+	for len(n.matches) > 0 {
+		if err := n.check(); err != nil {
+			return nil, err
+		}
+		pos := n.matches[0]
+		n.matches = n.matches[1:]
+		if !n.inner.visible(n.snap, pos) {
+			continue
+		}
+		tuple := n.inner.tuple(pos)
+		if tuple[innerOrd] != key {
+			continue
+		}
+		ok, err := n.innerFilter.matches(tuple)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return n.inner.toRow(tuple), nil
+		}
+	}
+	return nil, nil
+}
+
+func (n *indexNestedLoopJoinNode) lookup(key interface{}) []int {
+	defer n.innerLatch.hold()()
+	return n.index.lookup(key)
+}
+
+func (n *indexNestedLoopJoinNode) Close() {
+	n.outer.Close()
+}
+
+// mergeJoinNode merges two inputs that both arrive sorted on the join key.
+type mergeJoinNode struct {
+	PlanInfo
+	joinSides
+	left, right PlanNode
+	leftRow     Row
+	rightRow    Row
+	leftOK      bool
+	rightOK     bool
+	pairs       []Row
+}
+
+func (n *mergeJoinNode) Open() error {
+	if err := n.left.Open(); err != nil {
+		return err
+	}
+	if err := n.right.Open(); err != nil {
+		return err
+	}
+	n.pairs = nil
+	var err error
+	if n.leftRow, n.leftOK, err = n.nextKeyed(n.left, n.leftCol); err != nil {
+		return err
+	}
+	n.rightRow, n.rightOK, err = n.nextKeyed(n.right, n.rightCol)
+	return err
+}
+
+// nextKeyed skips rows with a NULL join key.
+func (n *mergeJoinNode) nextKeyed(child PlanNode, col string) (Row, bool, error) {
+	for {
+		row, ok, err := child.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		if row[col] != nil {
+			return row, true, nil
+		}
+	}
+}
+
+func (n *mergeJoinNode) Next() (Row, bool, error) {
+	for len(n.pairs) == 0 {
+		if !n.leftOK || !n.rightOK {
+			return nil, false, nil
+		}
+		if err := n.check(); err != nil {
+			return nil, false, err
+		}
+
+		lk, rk := n.leftRow[n.leftCol], n.rightRow[n.rightCol]
+		cmp := compareValues(lk, rk)
+		var err error
+		if cmp < 0 {
+			n.leftRow, n.leftOK, err = n.nextKeyed(n.left, n.leftCol)
+		} else if cmp > 0 {
+			n.rightRow, n.rightOK, err = n.nextKeyed(n.right, n.rightCol)
+		} else {
+			err = n.mergeGroup(lk, rk)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	row := n.pairs[0]
+	n.pairs = n.pairs[1:]
+	return row, true, nil
+}
+
+// mergeGroup gathers the run of equal keys on each side and pairs them up.
+func (n *mergeJoinNode) mergeGroup(lk, rk interface{}) error {
+	var err error
+	leftGroup := make([]Row, 0)
+	for n.leftOK && compareValues(n.leftRow[n.leftCol], lk) == 0 {
+		leftGroup = append(leftGroup, n.leftRow)
+		if n.leftRow, n.leftOK, err = n.nextKeyed(n.left, n.leftCol); err != nil {
+			return err
+		}
+	}
+	rightGroup := make([]Row, 0)
+	for n.rightOK && compareValues(n.rightRow[n.rightCol], rk) == 0 {
+		rightGroup = append(rightGroup, n.rightRow)
+		if n.rightRow, n.rightOK, err = n.nextKeyed(n.right, n.rightCol); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range leftGroup {
+		for _, r := range rightGroup {
+			if err := n.check(); err != nil {
+				return err
+			}
+			if l[n.leftCol] == r[n.rightCol] {
+				n.pairs = append(n.pairs, n.merge(l, r))
+			}
+		}
+	}
+	return nil
+}
+
+func (n *mergeJoinNode) Close() {
+	n.left.Close()
+	n.right.Close()
+}
+
+// nestedLoopJoinNode compares every outer row with every inner row.
+type nestedLoopJoinNode struct {
+	PlanInfo
+	joinSides
+	left, right PlanNode
+	inner       []Row
+	leftRow     Row
+	pos         int
+}
+
+func (n *nestedLoopJoinNode) Open() error {
+	rows, err := runPlan(n.right)
+	if err != nil {
+		return err
+	}
+	n.inner = rows
+	n.pos = len(rows)
+	return n.left.Open()
+}
+
+func (n *nestedLoopJoinNode) Next() (Row, bool, error) {
+	for {
+		for n.pos < len(n.inner) {
+			if err := n.check(); err != nil {
+				return nil, false, err
+			}
+			r := n.inner[n.pos]
+			n.pos++
+			if lv := n.leftRow[n.leftCol]; lv != nil && lv == r[n.rightCol] {
+				return n.merge(n.leftRow, r), true, nil
+			}
+		}
+
+		row, ok, err := n.left.Next()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		n.leftRow = row
+		n.pos = 0
+	}
+}
+
+func (n *nestedLoopJoinNode) Close() {
+	n.left.Close()
+	n.inner = nil
+}
+
+func describeWhere(where *WhereClause) string {
+	parts := ""
+	for i, w := range conjuncts(where) {
+		if i > 0 {
+			parts += " AND "
+		}
+		switch w.Op {
+		case "BETWEEN":
+			parts += fmt.Sprintf("%s BETWEEN %v AND %v", w.Column, formatLiteral(w.Value), formatLiteral(w.Value2))
+		default:
+			parts += fmt.Sprintf("%s %s %v", w.Column, w.Op, formatLiteral(w.Value))
+		}
+	}
+	return parts
+}
+
+func formatLiteral(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return "'" + s + "'"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,277 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// The data file is a sequence of fixed-size pages. Page 0 identifies the
+// file, the last page is a trailer pointing at the catalog, and everything
+// in between is heap, index or blob pages. A data file is written once, by
+// a checkpoint, and only read afterwards.
+const (
+	pageSize = 4096
+
+	dataFileMagic   = "MINIDBPG"
+	dataFileVersion = 1
+)
+
+// Every page starts with the CRC-32C of the rest of the page and its type.
+// Slotted pages follow with their cell count, where the cell area starts
+// and a link to the next page of a chain, then a slot of offset and length
+// for each cell. Cells fill the page from the end.
+const (
+	pageHeader  = 13
+	slotSize    = 4
+	noPage      = 0
+	overflowLen = 0xFFFF // slot length marking a cell that moved to blob pages
+)
+
+const (
+	pageFileHeader byte = iota + 1
+	pageHeap
+	pageBlob
+	pageLeaf
+	pageInternal
+	pageTrailer
+)
+
+type pageID = uint32
+
+// page wraps the bytes of one page.
+type page []byte
+
+func newPage(kind byte) page {
+	p := make(page, pageSize)
+	p[4] = kind
+	p.setCellStart(pageSize)
+	return p
+}
+
+func (p page) kind() byte            { return p[4] }
+func (p page) cellCount() int        { return int(binary.LittleEndian.Uint16(p[5:])) }
+func (p page) cellStart() int        { return int(binary.LittleEndian.Uint16(p[7:])) }
+func (p page) nextPage() pageID      { return binary.LittleEndian.Uint32(p[9:]) }
+func (p page) setNextPage(id pageID) { binary.LittleEndian.PutUint32(p[9:], id) }
+func (p page) setCellStart(off int)  { binary.LittleEndian.PutUint16(p[7:], uint16(off)) }
+
+func (p page) freeSpace() int {
+	return p.cellStart() - pageHeader - p.cellCount()*slotSize
+}
+
+// addSlot appends a cell, returning false if the page is full. length is
+// the cell's length, or overflowLen if the cell is a blob reference.
+func (p page) addSlot(cell []byte, length int) bool {
+	if len(cell)+slotSize > p.freeSpace() {
+		return false
+	}
+	start := p.cellStart() - len(cell)
+	copy(p[start:], cell)
+
+	n := p.cellCount()
+	slot := pageHeader + n*slotSize
+	binary.LittleEndian.PutUint16(p[slot:], uint16(start))
+	binary.LittleEndian.PutUint16(p[slot+2:], uint16(length))
+	binary.LittleEndian.PutUint16(p[5:], uint16(n+1))
+	p.setCellStart(start)
+	return true
+}
+
+// cell returns the bytes of cell i and whether they moved to blob pages,
+// in which case they hold a reference to them.
+func (p page) cell(i int) ([]byte, bool) {
+	slot := pageHeader + i*slotSize
+	off := int(binary.LittleEndian.Uint16(p[slot:]))
+	length := int(binary.LittleEndian.Uint16(p[slot+2:]))
+	if length == overflowLen {
+		return p[off : off+blobRefSize], true
+	}
+	return p[off : off+length], false
+}
+
+// seal stores the checksum; it must be the last change to the page.
+func (p page) seal() {
+	binary.LittleEndian.PutUint32(p, crc32.Checksum(p[4:], walCRC))
+}
+
+func (p page) verify() bool {
+	return binary.LittleEndian.Uint32(p) == crc32.Checksum(p[4:], walCRC)
+}
+
+// maxCell is the largest cell stored inline; larger ones go to blob pages
+// so that every heap page holds several rows.
+const maxCell = pageSize / 4
+
+// Blob pages hold data too large for a cell, such as big rows and the
+// catalog, as a chain linked by next page. The cell count field holds how
+// many bytes of data the page carries.
+const (
+	blobHeader  = pageHeader
+	blobRefSize = 8 // first page and total length
+)
+
+// pageWriter appends pages to a file being built.
+type pageWriter struct {
+	w    io.Writer
+	next pageID
+}
+
+func (pw *pageWriter) write(p page) (pageID, error) {
+	p.seal()
+	if _, err := pw.w.Write(p); err != nil {
+		return noPage, err
+	}
+	id := pw.next
+	pw.next++
+	return id, nil
+}
+
+// writeBlob stores data in a chain of blob pages and returns the first.
+// The pages are written in order, so each links to the one after it.
+func (pw *pageWriter) writeBlob(data []byte) (pageID, error) {
+	first := pw.next
+	for {
+		p := newPage(pageBlob)
+		n := copy(p[blobHeader:], data)
+		binary.LittleEndian.PutUint16(p[5:], uint16(n))
+		data = data[n:]
+		if len(data) > 0 {
+			p.setNextPage(pw.next + 1)
+		}
+		if _, err := pw.write(p); err != nil {
+			return noPage, err
+		}
+		if len(data) == 0 {
+			return first, nil
+		}
+	}
+}
+
+func blobRef(first pageID, length int) []byte {
+	ref := make([]byte, blobRefSize)
+	binary.LittleEndian.PutUint32(ref, first)
+	binary.LittleEndian.PutUint32(ref[4:], uint32(length))
+	return ref
+}
+
+// addCell appends data to p as a cell, moving it to blob pages first if it
+// is too large to store inline. It returns false if p is full; data then
+// fits on an empty page.
+func (pw *pageWriter) addCell(p page, data []byte) (bool, error) {
+	if len(data) <= maxCell {
+		return p.addSlot(data, len(data)), nil
+	}
+	if p.freeSpace() < blobRefSize+slotSize {
+		return false, nil
+	}
+	first, err := pw.writeBlob(data)
+	if err != nil {
+		return false, err
+	}
+	return p.addSlot(blobRef(first, len(data)), overflowLen), nil
+}
+
+// storageError carries a failure to read the data file out of code that
+// has no error to return, such as an index cursor. Statement execution
+// recovers it and fails the statement.
+type storageError struct {
+	err error
+}
+
+// recoverStorage turns a storageError panic into *err.
+func recoverStorage(err *error) {
+	if r := recover(); r != nil {
+		se, ok := r.(storageError)
+		if !ok {
+			panic(r)
+		}
+		*err = se.err
+	}
+}
+
+// dataFile reads pages of a data file through a buffer pool.
+type dataFile struct {
+	file  *os.File
+	pages int
+	pool  *bufferPool
+}
+
+func openDataFile(path string, cachePages int) (*dataFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size()%pageSize != 0 || info.Size() < 2*pageSize {
+		file.Close()
+		return nil, fmt.Errorf("data file %s is corrupt: size %d is not a whole number of pages", path, info.Size())
+	}
+
+	df := &dataFile{file: file, pages: int(info.Size() / pageSize)}
+	df.pool = newBufferPool(cachePages, df.readPage)
+	return df, nil
+}
+
+func (df *dataFile) readPage(id pageID) (page, error) {
+	if int(id) >= df.pages {
+		return nil, fmt.Errorf("data file is corrupt: page %d is past the end", id)
+	}
+	p := make(page, pageSize)
+	if _, err := df.file.ReadAt(p, int64(id)*pageSize); err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %v", id, err)
+	}
+	if !p.verify() {
+		return nil, fmt.Errorf("data file is corrupt: checksum mismatch on page %d", id)
+	}
+	return p, nil
+}
+
+func (df *dataFile) size() int64 {
+	return int64(df.pages) * pageSize
+}
+
+// page returns a page, from the buffer pool when it is cached.
+func (df *dataFile) page(id pageID) (page, error) {
+	return df.pool.get(id)
+}
+
+// blob reads data written by writeBlob.
+func (df *dataFile) blob(first pageID, length int) ([]byte, error) {
+	data := make([]byte, 0, length)
+	for id := first; len(data) < length; {
+		if id == noPage {
+			return nil, fmt.Errorf("data file is corrupt: blob at page %d ends early", first)
+		}
+		p, err := df.page(id)
+		if err != nil {
+			return nil, err
+		}
+		if p.kind() != pageBlob {
+			return nil, fmt.Errorf("data file is corrupt: page %d is not a blob page", id)
+		}
+		data = append(data, p[blobHeader:blobHeader+p.cellCount()]...)
+		id = p.nextPage()
+	}
+	return data, nil
+}
+
+// cell returns the data of cell i of p, following it to blob pages if it
+// moved there.
+func (df *dataFile) cell(p page, i int) ([]byte, error) {
+	data, overflow := p.cell(i)
+	if !overflow {
+		return data, nil
+	}
+	return df.blob(binary.LittleEndian.Uint32(data), int(binary.LittleEndian.Uint32(data[4:])))
+}
+
+func (df *dataFile) close() error {
+	return df.file.Close()
+}
@@ -0,0 +1,302 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+var errCorruptTree = errors.New("data file is corrupt: bad index page")
+
+// pageTree is a B+tree of index entries stored in the data file. Leaf
+// cells hold a row position followed by the row's key; internal cells hold
+// a child page followed by the first key under it. A checkpoint builds each
+// tree bottom-up from entries in key order, and it never changes after
+// that, so pages are full and need no sibling links: cursors keep the path
+// from the root instead.
+type pageTree struct {
+	file    *dataFile
+	root    pageID
+	compare func(a, b []interface{}) int
+}
+
+type treeFrame struct {
+	page page
+	slot int
+}
+
+// treePath leads from the root to one leaf entry. A nil path is past
+// either end of the tree.
+type treePath []treeFrame
+
+func (pt *pageTree) read(id pageID) page {
+	p, err := pt.file.page(id)
+	if err != nil {
+		panic(storageError{err})
+	}
+	if p.kind() != pageLeaf && p.kind() != pageInternal {
+		panic(storageError{errCorruptTree})
+	}
+	return p
+}
+
+// cell returns the number and key bytes of a cell.
+func (pt *pageTree) cell(p page, slot int) (uint32, []byte) {
+	data, err := pt.file.cell(p, slot)
+	if err != nil {
+		panic(storageError{err})
+	}
+	if len(data) < 4 {
+		panic(storageError{errCorruptTree})
+	}
+	return binary.LittleEndian.Uint32(data), data[4:]
+}
+
+func (pt *pageTree) key(p page, slot int) []interface{} {
+	_, raw := pt.cell(p, slot)
+	return decodeKey(raw)
+}
+
+func decodeKey(raw []byte) []interface{} {
+	key, err := decodeTuple(raw)
+	if err != nil {
+		panic(storageError{err})
+	}
+	return key
+}
+
+// entry returns the key, row position and encoded key at the end of path.
+func (pt *pageTree) entry(path treePath) ([]interface{}, int, []byte) {
+	leaf := path[len(path)-1]
+	n, raw := pt.cell(leaf.page, leaf.slot)
+	return decodeKey(raw), int(n), raw
+}
+
+// descend returns the path to the first entry not below from or, when le
+// is set, the last entry not above it. A nil from means the first or last
+// entry of the tree.
+func (pt *pageTree) descend(from []interface{}, le bool) treePath {
+	if pt.root == noPage {
+		return nil
+	}
+	var path treePath
+	for id := pt.root; ; {
+		p := pt.read(id)
+		n := p.cellCount()
+		var slot int
+		switch {
+		case from == nil && le:
+			slot = n - 1
+		case from == nil:
+			slot = 0
+		case le:
+			slot = sort.Search(n, func(i int) bool { return pt.compare(pt.key(p, i), from) > 0 }) - 1
+		default:
+			slot = sort.Search(n, func(i int) bool { return pt.compare(pt.key(p, i), from) >= 0 })
+		}
+
+		if p.kind() == pageLeaf {
+			return pt.settle(append(path, treeFrame{page: p, slot: slot}), le)
+		}
+
+		// Equal keys may continue from the end of the child before the
+		// first one whose first key is not below from
+		if from != nil && !le {
+			slot--
+		}
+		if slot < 0 {
+			slot = 0
+		}
+		path = append(path, treeFrame{page: p, slot: slot})
+		child, _ := pt.cell(p, slot)
+		id = child
+	}
+}
+
+// step moves path one entry forward, or backward if back is set.
+func (pt *pageTree) step(path treePath, back bool) treePath {
+	if path == nil {
+		return nil
+	}
+	path = append(treePath(nil), path...)
+	if back {
+		path[len(path)-1].slot--
+	} else {
+		path[len(path)-1].slot++
+	}
+	return pt.settle(path, back)
+}
+
+// settle moves a path whose leaf slot ran off its page to the first entry
+// of the next leaf, or the last entry of the previous one if back is set.
+func (pt *pageTree) settle(path treePath, back bool) treePath {
+	level := len(path) - 1
+	for path[level].slot < 0 || path[level].slot >= path[level].page.cellCount() {
+		if level == 0 {
+			return nil
+		}
+		level--
+		if back {
+			path[level].slot--
+		} else {
+			path[level].slot++
+		}
+	}
+	for ; level < len(path)-1; level++ {
+		id, _ := pt.cell(path[level].page, path[level].slot)
+		child := pt.read(id)
+		slot := 0
+		if back {
+			slot = child.cellCount() - 1
+		}
+		path[level+1] = treeFrame{page: child, slot: slot}
+	}
+	return path
+}
+
+// seek returns a cursor on the first key not below from, or for a
+// descending walk the last key not above it.
+func (pt *pageTree) seek(from []interface{}, desc bool) *pageTreeCursor {
+	c := &pageTreeCursor{tree: pt}
+	if desc {
+		c.groupBackward(pt.descend(from, true))
+	} else {
+		c.groupForward(pt.descend(from, false))
+	}
+	return c
+}
+
+// lookup returns the positions of the entries whose key starts with probe.
+func (pt *pageTree) lookup(probe []interface{}) []int {
+	var positions []int
+	for c := pt.seek(probe, false); c.valid() && pt.compare(c.key(), probe) == 0; c.next() {
+		positions = append(positions, c.rows()...)
+	}
+	return positions
+}
+
+// pageTreeCursor walks a pageTree one distinct key at a time, like a
+// btreeCursor: lo and hi are the first and last entry holding the key.
+type pageTreeCursor struct {
+	tree   *pageTree
+	lo, hi treePath
+	k      []interface{}
+	pos    []int
+}
+
+func (c *pageTreeCursor) groupForward(path treePath) {
+	c.lo, c.hi, c.pos = path, path, nil
+	if path == nil {
+		return
+	}
+	key, n, _ := c.tree.entry(path)
+	c.k, c.pos = key, []int{n}
+	for next := c.tree.step(path, false); next != nil; next = c.tree.step(next, false) {
+		key, n, _ := c.tree.entry(next)
+		if c.tree.compare(key, c.k) != 0 {
+			break
+		}
+		c.hi = next
+		c.pos = append(c.pos, n)
+	}
+}
+
+func (c *pageTreeCursor) groupBackward(path treePath) {
+	c.lo, c.hi, c.pos = path, path, nil
+	if path == nil {
+		return
+	}
+	key, n, _ := c.tree.entry(path)
+	c.k, c.pos = key, []int{n}
+	for prev := c.tree.step(path, true); prev != nil; prev = c.tree.step(prev, true) {
+		key, n, _ := c.tree.entry(prev)
+		if c.tree.compare(key, c.k) != 0 {
+			break
+		}
+		c.lo = prev
+		c.pos = append(c.pos, n)
+	}
+	// Keep positions ascending, as a forward walk finds them
+	for i, j := 0, len(c.pos)-1; i < j; i, j = i+1, j-1 {
+		c.pos[i], c.pos[j] = c.pos[j], c.pos[i]
+	}
+}
+
+func (c *pageTreeCursor) valid() bool        { return len(c.pos) > 0 }
+func (c *pageTreeCursor) key() []interface{} { return c.k }
+func (c *pageTreeCursor) rows() []int        { return c.pos }
+func (c *pageTreeCursor) next()              { c.groupForward(c.tree.step(c.hi, false)) }
+func (c *pageTreeCursor) prev()              { c.groupBackward(c.tree.step(c.lo, true)) }
+
+// treeBuilder writes a pageTree from entries added in key order. Each
+// level keeps one page open; a full page is written and its first key
+// moves up to the level above.
+type treeBuilder struct {
+	pw     *pageWriter
+	levels []*treeLevel
+}
+
+type treeLevel struct {
+	page  page
+	first []byte // key of the page's first cell
+}
+
+func treeCell(n uint32, key []byte) []byte {
+	cell := make([]byte, 4, 4+len(key))
+	binary.LittleEndian.PutUint32(cell, n)
+	return append(cell, key...)
+}
+
+func (b *treeBuilder) add(key []byte, pos int) error {
+	return b.addCell(0, treeCell(uint32(pos), key), key)
+}
+
+func (b *treeBuilder) addCell(level int, cell, key []byte) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, &treeLevel{})
+	}
+	l := b.levels[level]
+	if l.page == nil {
+		kind := pageLeaf
+		if level > 0 {
+			kind = pageInternal
+		}
+		l.page, l.first = newPage(kind), key
+	}
+	ok, err := b.pw.addCell(l.page, cell)
+	if err != nil || ok {
+		return err
+	}
+	if err := b.flush(level); err != nil {
+		return err
+	}
+	return b.addCell(level, cell, key)
+}
+
+func (b *treeBuilder) flush(level int) error {
+	l := b.levels[level]
+	id, err := b.pw.write(l.page)
+	if err != nil {
+		return err
+	}
+	l.page = nil
+	return b.addCell(level+1, treeCell(id, l.first), l.first)
+}
+
+// finish writes the open pages and returns the root, or noPage if the
+// tree is empty.
+func (b *treeBuilder) finish() (pageID, error) {
+	for level := 0; level < len(b.levels); level++ {
+		l := b.levels[level]
+		if l.page == nil {
+			continue
+		}
+		if level == len(b.levels)-1 {
+			return b.pw.write(l.page)
+		}
+		if err := b.flush(level); err != nil {
+			return noPage, err
+		}
+	}
+	return noPage, nil
+}
@@ -0,0 +1,296 @@
+package minidb
+
+import (
+	"container/heap"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Full scans work through a table a batch of positions at a time: the
+// versions of a batch that the snapshot sees are gathered, then the WHERE
+// clause is tested against the whole batch, one term after another. A
+// table large enough to keep several cores busy is split across worker
+// goroutines, each taking the next batch in turn. The workers read under
+// the statement's latches, or those of each batch for a cursor, so a scan
+// stops them all before it closes.
+
+const (
+	scanBatchRows    = 1024      // positions a scan reads at a time
+	parallelScanRows = 64 * 1024 // fewest rows worth a worker of their own
+	scanAhead        = 4         // batches per worker read ahead of the consumer
+)
+
+// scanWorkers returns how many workers a full scan of rows splits across,
+// up to GOMAXPROCS.
+func scanWorkers(rows int) int {
+	return max(1, min(runtime.GOMAXPROCS(0), rows/parallelScanRows))
+}
+
+// scanBatch gathers the versions at positions from up to to that snap sees
+// and filter keeps, reusing batch.
+func (t *Table) scanBatch(snap snapshot, filter *predicate, from, to int, batch []rowTuple) ([]rowTuple, error) {
+	batch = batch[:0]
+	for i := from; i < to; i++ {
+		if t.visible(snap, i) {
+			batch = append(batch, t.tuple(i))
+		}
+	}
+	return filter.filter(batch)
+}
+
+// parallelSeqScanNode is a seqScanNode split across workers. Rows come out
+// in the order of their positions, as from a single scan. With orderBy
+// set, each worker sorts the batches it reads and the node merges them;
+// with aggregate set, each batch is folded into one row of partial MIN and
+// MAX values, keyed by item, for an aggregateNode to finish.
+type parallelSeqScanNode struct {
+	PlanInfo
+	ctx       context.Context
+	table     *Table
+	snap      snapshot
+	filter    *predicate
+	workers   int
+	orderBy   []OrderByItem
+	aggregate []aggregateItem
+	latch     scanLatch
+
+	results []chan scanResult // one per batch, in position order
+	tokens  chan struct{}     // bounds the batches read ahead
+	done    chan struct{}
+	wg      sync.WaitGroup
+	next    int // batch to return rows from next
+	rows    []Row
+	pos     int
+}
+
+type scanResult struct {
+	rows []Row
+	keys []sortKey // of rows, when sorted
+	err  error
+}
+
+func (n *parallelSeqScanNode) Open() error {
+	count := n.rowCount()
+	batches := (count + scanBatchRows - 1) / scanBatchRows
+	n.results = make([]chan scanResult, batches)
+	for i := range n.results {
+		n.results[i] = make(chan scanResult, 1)
+	}
+	n.done = make(chan struct{})
+	n.next, n.rows, n.pos = 0, nil, 0
+
+	// A sort reads every batch before it returns a row, so only the other
+	// modes hold the workers back
+	n.tokens = nil
+	if n.orderBy == nil {
+		n.tokens = make(chan struct{}, n.workers*scanAhead)
+	}
+
+	var claimed atomic.Int64
+	for w := 0; w < n.workers; w++ {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			var buf []rowTuple
+			for {
+				if n.tokens != nil {
+					select {
+					case n.tokens <- struct{}{}:
+					case <-n.done:
+						return
+					}
+				}
+				b := int(claimed.Add(1)) - 1
+				if b >= batches {
+					return
+				}
+				var result scanResult
+				buf, result = n.scan(b, count, buf)
+				n.results[b] <- result
+			}
+		}()
+	}
+
+	if n.orderBy != nil {
+		runs := make([]sortedRun, batches)
+		for b, results := range n.results {
+			result := <-results
+			if result.err != nil {
+				n.Close()
+				return result.err
+			}
+			runs[b] = sortedRun{rows: result.rows, keys: result.keys, rank: b}
+		}
+		n.rows = n.table.mergeRuns(runs, n.orderBy)
+		n.next = batches
+	}
+	return nil
+}
+
+// scan reads batch b of a table of count positions.
+func (n *parallelSeqScanNode) scan(b, count int, buf []rowTuple) (_ []rowTuple, result scanResult) {
+	defer recoverStorage(&result.err)
+	if result.err = interrupted(n.ctx); result.err != nil {
+		return buf, result
+	}
+	from := b * scanBatchRows
+	if buf, result.err = n.read(from, min(from+scanBatchRows, count), buf); result.err != nil {
+		return buf, result
+	}
+	if n.aggregate != nil {
+		result.rows = []Row{n.table.foldBatch(n.aggregate, buf)}
+		return buf, result
+	}
+	result.rows = make([]Row, len(buf))
+	for i, tuple := range buf {
+		result.rows[i] = n.table.toRow(tuple)
+	}
+	if n.orderBy != nil {
+		result.keys, result.err = n.table.sortRows(result.rows, n.orderBy)
+	}
+	return buf, result
+}
+
+func (n *parallelSeqScanNode) rowCount() int {
+	defer n.latch.hold()()
+	return n.table.rowCount()
+}
+
+// read gathers the versions of a batch into buf, the latch held only as
+// long as it takes.
+func (n *parallelSeqScanNode) read(from, to int, buf []rowTuple) ([]rowTuple, error) {
+	defer n.latch.hold()()
+	return n.table.scanBatch(n.snap, n.filter, from, to, buf)
+}
+
+func (n *parallelSeqScanNode) Next() (Row, bool, error) {
+	for n.pos >= len(n.rows) {
+		if n.next >= len(n.results) {
+			return nil, false, nil
+		}
+		result := <-n.results[n.next]
+		n.next++
+		if n.tokens != nil {
+			<-n.tokens
+		}
+		if result.err != nil {
+			return nil, false, result.err
+		}
+		n.rows, n.pos = result.rows, 0
+	}
+	row := n.rows[n.pos]
+	n.pos++
+	return row, true, nil
+}
+
+func (n *parallelSeqScanNode) Close() {
+	if n.done != nil {
+		close(n.done)
+		n.wg.Wait()
+		n.done = nil
+	}
+	n.results, n.rows = nil, nil
+}
+
+// aggregateItem is a MIN or MAX of the select list, reading its column by
+// ordinal.
+type aggregateItem struct {
+	item string
+	fn   string
+	ord  int
+}
+
+func aggregateItems(t *Table, items []string) []aggregateItem {
+	result := make([]aggregateItem, len(items))
+	for i, item := range items {
+		fn, col, _ := parseAggregate(item)
+		result[i] = aggregateItem{item: item, fn: fn, ord: t.ordinal(col)}
+	}
+	return result
+}
+
+// foldBatch folds a batch into one row holding each item's value over it,
+// or NULL if the batch has none.
+func (t *Table) foldBatch(items []aggregateItem, batch []rowTuple) Row {
+	result := make(Row, len(items))
+	for _, item := range items {
+		col := t.Columns[item.ord].Name
+		var best interface{}
+		for _, tuple := range batch {
+			val := tuple[item.ord]
+			if val == nil {
+				continue
+			}
+			cmp := t.compare(col, val, best)
+			if best == nil || (item.fn == "MAX" && cmp > 0) || (item.fn == "MIN" && cmp < 0) {
+				best = val
+			}
+		}
+		result[item.item] = best
+	}
+	return result
+}
+
+// mergeRuns merges runs each sorted by orderBy into one. Rows that compare
+// equal keep the order of their runs, so the result is what a stable sort
+// of the runs laid end to end gives.
+func (t *Table) mergeRuns(runs []sortedRun, orderBy []OrderByItem) []Row {
+	total := 0
+	h := &runHeap{table: t, orderBy: orderBy}
+	for _, run := range runs {
+		if len(run.rows) > 0 {
+			h.runs = append(h.runs, run)
+			total += len(run.rows)
+		}
+	}
+	heap.Init(h)
+
+	merged := make([]Row, 0, total)
+	for h.Len() > 0 {
+		run := &h.runs[0]
+		merged = append(merged, run.rows[0])
+		run.keys = run.keys[1:]
+		if run.rows = run.rows[1:]; len(run.rows) == 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return merged
+}
+
+// sortedRun is what is left of one run being merged, with the sort keys
+// of its rows; rank is its place among the runs.
+type sortedRun struct {
+	rows []Row
+	keys []sortKey
+	rank int
+}
+
+// runHeap orders runs by their first rows, ties going to the earlier run.
+type runHeap struct {
+	table   *Table
+	orderBy []OrderByItem
+	runs    []sortedRun
+}
+
+func (h *runHeap) Len() int { return len(h.runs) }
+
+func (h *runHeap) Less(i, j int) bool {
+	if cmp := h.table.compareKeys(h.runs[i].keys[0], h.runs[j].keys[0], h.orderBy); cmp != 0 {
+		return cmp < 0
+	}
+	return h.runs[i].rank < h.runs[j].rank
+}
+
+func (h *runHeap) Swap(i, j int) { h.runs[i], h.runs[j] = h.runs[j], h.runs[i] }
+
+func (h *runHeap) Push(x interface{}) { h.runs = append(h.runs, x.(sortedRun)) }
+
+func (h *runHeap) Pop() interface{} {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
@@ -0,0 +1,50 @@
+package minidb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTrailingTokens(t *testing.T) {
+	for _, query := range []string{
+		"DELETE FROM p WHERE id = 1 OR id = 2",
+		"DELETE FROM p id = 1",
+		"UPDATE p SET name = 'x' WHERE id = 1 OR id = 2",
+		"UPDATE p SET name = 'x' WHERE id = 1 LIMIT 1",
+		"SELECT * FROM p WHERE id = 1 OR id = 2",
+	} {
+		var syntax *SyntaxError
+		if _, err := Parse(query); !errors.As(err, &syntax) {
+			t.Errorf("%s: got %v, want a syntax error", query, err)
+		}
+	}
+
+	for _, query := range []string{
+		"DELETE FROM p",
+		"DELETE FROM p WHERE id = 1 AND name = 'x'",
+		"UPDATE p SET name = 'x'",
+		"UPDATE p SET name = 'x', id = 2 WHERE id BETWEEN 1 AND 3 AND name != 'y'",
+	} {
+		if _, err := Parse(query); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestDeleteWithUnsupportedOr(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE p (id INT PRIMARY KEY, name STRING)")
+	mustExec(t, db, "INSERT INTO p (id, name) VALUES (1, 'a')")
+	mustExec(t, db, "INSERT INTO p (id, name) VALUES (2, 'b')")
+
+	if _, err := db.Exec("DELETE FROM p WHERE id = 1 OR id = 2"); err == nil {
+		t.Fatal("DELETE with OR: no error")
+	}
+	if _, err := db.Exec("UPDATE p SET name = 'c' WHERE id = 1 OR id = 2"); err == nil {
+		t.Fatal("UPDATE with OR: no error")
+	}
+	rows := mustExec(t, db, "SELECT * FROM p ORDER BY id").Rows
+	if len(rows) != 2 || rows[0]["name"] != "a" || rows[1]["name"] != "b" {
+		t.Errorf("failed statements changed the table: %v", rows)
+	}
+}
@@ -1,95 +1,362 @@
-package main
+package minidb
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
-type PersistenceManager struct {
-	filepath string
-	mu       sync.RWMutex
+// maxCheckpointSize caps how far the write-ahead log may grow for a large
+// data file. Every checkpoint rewrites the whole file, so the log may grow
+// to an eighth of it first, but what it holds is also kept in memory.
+const maxCheckpointSize = 64 << 20
+
+// WALStorage keeps a paged data file plus a write-ahead log of the commits
+// made since it was written. Only rows changed since the last checkpoint
+// are held in memory; the rest are read from the data file as needed.
+// Databases from before the data file existed kept a JSON snapshot
+// instead; Load converts it.
+type WALStorage struct {
+	filepath     string
+	snapshotPath string
+	walPath      string
+	lockPath     string
+	lock         *fileLock
+	fs           fileSystem
+	mu           sync.RWMutex
+	wal          *writeAheadLog
+	data         *dataFile
+	lsn          uint64
+	time         time.Time // when commit lsn was logged
+	history      *DB       // the database History last rebuilt
+
+	// GroupCommit lets concurrent commits share one fsync of the log. Each
+	// batch waits this long for more commits to join. A commit becomes
+	// visible to other transactions just before it is durable; if the
+	// fsync fails it stays committed, and every later commit fails.
+	GroupCommit time.Duration
+
+	// CachePages is how many pages of the data file the buffer pool keeps
+	// in memory; 0 means DefaultCachePages.
+	CachePages int
+
+	// ArchiveLog keeps the log of each checkpoint in a .archive directory
+	// instead of discarding it, so incremental backups can always reach
+	// back to the previous one.
+	ArchiveLog bool
+
+	// Retention keeps the history of this long, so the database can be
+	// read or recovered as of any time within it. It archives the log as
+	// ArchiveLog does, and also each data file a checkpoint replaces;
+	// both are pruned once they fall out of the window, so incremental
+	// backups must be taken at least this often.
+	Retention time.Duration
+}
+
+func NewWALStorage(path string) *WALStorage {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	return &WALStorage{
+		filepath:     path,
+		snapshotPath: base + ".json",
+		fs:           osFS{},
+		walPath:      base + ".wal",
+		lockPath:     base + ".lock",
+	}
+}
+
+// openLog opens the write-ahead log if Load has not already.
+func (pm *WALStorage) openLog() ([]walRecord, error) {
+	if pm.wal != nil {
+		return nil, nil
+	}
+	wal, records, err := openWAL(pm.walPath)
+	if err != nil {
+		return nil, err
+	}
+	wal.groupCommit = pm.GroupCommit
+	if wal.lsn < pm.lsn {
+		wal.lsn, wal.time = pm.lsn, pm.time
+	}
+	pm.wal = wal
+	return records, nil
+}
+
+// Commit appends the changes of a committing transaction to the
+// write-ahead log. Unless GroupCommit is set they are on disk when Commit
+// returns; otherwise it returns the log size after them and the caller
+// finishes with Sync.
+func (pm *WALStorage) Commit(db *DB, snap snapshot, changes []walChange) (int64, error) {
+	if _, err := pm.openLog(); err != nil {
+		return 0, err
+	}
+	end, err := pm.wal.write(changes)
+	if err != nil {
+		return 0, err
+	}
+	if pm.GroupCommit == 0 {
+		return 0, pm.wal.sync(end)
+	}
+	return end, nil
 }
 
-func NewPersistenceManager(filepath string) *PersistenceManager {
-	return &PersistenceManager{filepath: filepath}
+// Sync waits until the write-ahead log is on disk up to end.
+func (pm *WALStorage) Sync(end int64) error {
+	return pm.wal.sync(end)
 }
 
-func (pm *PersistenceManager) Save(db *Database) error {
+// NeedsCheckpoint reports whether the log has grown enough to be folded
+// into the data file.
+func (pm *WALStorage) NeedsCheckpoint() bool {
+	limit := int64(checkpointSize)
+	if pm.data != nil {
+		limit = max(limit, min(pm.data.size()/8, maxCheckpointSize))
+	}
+	pm.wal.mu.Lock()
+	defer pm.wal.mu.Unlock()
+	return pm.wal.size >= limit
+}
+
+// Checkpoint writes a new data file holding everything committed, then
+// empties the log. If the file cannot be written the log is left as it is.
+// The caller holds mu exclusive.
+func (pm *WALStorage) Checkpoint(db *DB) error {
+	if _, err := pm.openLog(); err != nil {
+		return err
+	}
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
+	pm.wal.mu.Lock()
+	lsn, logged := pm.wal.lsn, pm.wal.time
+	pm.wal.mu.Unlock()
 
-	data := make(map[string]interface{})
-	for name, table := range db.tables {
-		data[name] = map[string]interface{}{
-			"columns": table.Columns,
-			"rows":    table.Rows,
+	// Archive the log before the data file that replaces it exists, so a
+	// backup that sees the new data file also finds the log in the archive
+	if pm.ArchiveLog || pm.Retention > 0 {
+		if err := pm.archiveLog(); err != nil {
+			return err
+		}
+	}
+	if pm.Retention > 0 && pm.data != nil {
+		if err := pm.archiveBase(pm.lsn); err != nil {
+			return err
 		}
 	}
 
-	file, err := os.Create(pm.filepath)
+	var catalog *dataCatalog
+	var checkpoints []*tableCheckpoint
+	err := replaceFile(pm.fs, pm.filepath, func(w io.Writer) error {
+		var err error
+		catalog, checkpoints, err = writeDataFile(w, db, lsn, logged)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create file: %v", err)
+		return err
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
+	// Only now does the data file hold lsn. A checkpoint failing before
+	// this leaves pm.lsn describing the file still in place, which the
+	// next one archives under it
+	pm.lsn, pm.time = lsn, logged
 
-		}
-	}(file)
+	df, err := openDataFile(pm.filepath, pm.CachePages)
+	if err != nil {
+		return err
+	}
+	if err := db.installCheckpoint(df, catalog, checkpoints); err != nil {
+		df.close()
+		return err
+	}
+	if pm.data != nil {
+		pm.data.close()
+	}
+	pm.data = df
+	if err := pm.wal.reset(); err != nil {
+		return err
+	}
+	if pm.Retention > 0 {
+		return pruneArchive(archivePath(pm.base()), time.Now().Add(-pm.Retention))
+	}
+	return nil
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(data)
+// archiveLog copies the log into the archive, named after its first
+// commit. The caller holds mu exclusive, so no commit is appended
+// meanwhile.
+func (pm *WALStorage) archiveLog() error {
+	records, err := readWAL(pm.walPath)
+	if err != nil {
+		return err
+	}
+	return writeArchive(pm.fs, archivePath(pm.base()), records)
 }
 
-func (pm *PersistenceManager) Load(db *Database) error {
-	pm.mu.RLock()
-	defer pm.mu.RUnlock()
+// archiveBase keeps the data file a checkpoint is about to replace in the
+// archive, named after the last commit it holds. Data files are never
+// changed once written, so a hard link does unless there are none.
+func (pm *WALStorage) archiveBase(lsn uint64) error {
+	dir := archivePath(pm.base())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create log archive: %v", err)
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%016x.db", lsn))
+	if _, err := os.Stat(name); err == nil {
+		return nil // kept by a checkpoint that failed later on
+	}
+	if err := os.Link(pm.filepath, name); err == nil {
+		return nil
+	}
+	return replaceFile(pm.fs, name, func(w io.Writer) error {
+		_, err := io.Copy(w, io.NewSectionReader(pm.data.file, 0, pm.data.size()))
+		return err
+	})
+}
 
-	file, err := os.Open(pm.filepath)
+// History returns the database as it was at the given time, rebuilt from
+// the data files and logs kept. It is read-only. The caller holds the
+// latch, so no checkpoint prunes the archive meanwhile.
+func (pm *WALStorage) History(at time.Time) (*DB, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	plan, err := planHistory(pm.base(), at)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		return nil, err
+	}
+	if pm.history != nil {
+		if hs := pm.history.storage.(*historyStorage); hs.plan.lsn == plan.lsn {
+			return pm.history, nil
 		}
-		return fmt.Errorf("failed to open file: %v", err)
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
+	// The database rebuilt before is left to the garbage collector, since
+	// a query may still be reading it
+	if pm.history, err = plan.load(); err != nil {
+		return nil, err
+	}
+	return pm.history, nil
+}
+
+// base returns the path of the database files without an extension.
+func (pm *WALStorage) base() string {
+	return strings.TrimSuffix(pm.filepath, filepath.Ext(pm.filepath))
+}
 
+// Backup copies the database into the backup directory dir, or with
+// incremental adds the commits made since the backup in dir was taken.
+// It runs beside commits and checkpoints without stopping them.
+func (pm *WALStorage) Backup(dir string, incremental bool) (*backupInfo, int, error) {
+	return backupDatabase(pm.fs, pm.base(), dir, incremental)
+}
+
+func (pm *WALStorage) Close() error {
+	var err error
+	if pm.history != nil {
+		err = pm.history.Close()
+		pm.history = nil
+	}
+	if pm.data != nil {
+		if derr := pm.data.close(); err == nil {
+			err = derr
+		}
+		pm.data = nil
+	}
+	if pm.wal != nil {
+		if werr := pm.wal.close(); err == nil {
+			err = werr
 		}
-	}(file)
+		pm.wal = nil
+	}
+	if lerr := pm.lock.unlock(); err == nil {
+		err = lerr
+	}
+	pm.lock = nil
+	return err
+}
 
-	var data map[string]interface{}
-	if err := json.NewDecoder(file).Decode(&data); err != nil {
-		return fmt.Errorf("failed to decode data: %v", err)
+// Load opens the data file and replays the write-ahead log. Without a data
+// file, a JSON snapshot left by an older version is loaded instead, written
+// out as a data file, and kept as a .bak file.
+func (pm *WALStorage) Load(db *DB) error {
+	converted, err := pm.load(db)
+	if err != nil || !converted || db.readOnly {
+		return err
+	}
+	if err := pm.Checkpoint(db); err != nil {
+		return err
+	}
+	if err := os.Rename(pm.snapshotPath, pm.snapshotPath+".bak"); err != nil {
+		return fmt.Errorf("failed to set aside %s after converting it: %v", pm.snapshotPath, err)
 	}
+	return nil
+}
 
-	for name, tableData := range data {
-		td := tableData.(map[string]interface{})
+func (pm *WALStorage) load(db *DB) (bool, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
 
-		var columns []Column
-		colData, _ := json.Marshal(td["columns"])
-		err := json.Unmarshal(colData, &columns)
-		if err != nil {
-			return err
+	// A read-only database reads the log before the data file. Another
+	// process may checkpoint meanwhile, but that only makes the data file
+	// newer than the log, and replay skips what it already holds.
+	var records []walRecord
+	var err error
+	if db.readOnly {
+		if records, err = readWAL(pm.walPath); err != nil {
+			return false, err
 		}
+	} else if pm.lock, err = lockDatabase(pm.lockPath); err != nil {
+		return false, err
+	}
 
-		table := NewTable(name, columns)
-
-		var rows []Row
-		rowData, _ := json.Marshal(td["rows"])
-		err = json.Unmarshal(rowData, &rows)
-		if err != nil {
-			return err
+	converted := false
+	df, err := openDataFile(pm.filepath, pm.CachePages)
+	switch {
+	case err == nil:
+		pm.data = df
+		if pm.lsn, pm.time, err = loadDataFile(db, df); err != nil {
+			return false, err
 		}
-		table.Rows = rows
+	case os.IsNotExist(err):
+		if pm.lsn, converted, err = loadSnapshot(db, pm.snapshotPath); err != nil {
+			return false, err
+		}
+	default:
+		return false, err
+	}
 
-		table.rebuildIndexes()
-		db.tables[name] = table
+	// Replay the commits made after the snapshot was written
+	if !db.readOnly {
+		if records, err = pm.openLog(); err != nil {
+			return false, err
+		}
+	}
+	deleted := make(map[*Table]map[string][]int)
+	for _, record := range records {
+		if record.LSN <= pm.lsn {
+			continue
+		}
+		if err := db.redo(record, deleted); err != nil {
+			return false, err
+		}
+	}
+	for _, table := range db.tables {
+		table.vacuum(0)
 	}
+	return converted, nil
+}
 
-	return nil
+// loadSnapshot reads the JSON snapshot at path, of any format version, and
+// returns its LSN and whether there was one.
+func loadSnapshot(db *DB, path string) (uint64, bool, error) {
+	body, version, err := readSnapshot(path)
+	if body == nil || err != nil {
+		return 0, false, err
+	}
+	var lsn uint64
+	if version < snapshotVersion {
+		lsn, err = decodeLegacySnapshot(db, body)
+	} else {
+		lsn, err = decodeSnapshot(db, body)
+	}
+	return lsn, true, err
 }
@@ -0,0 +1,506 @@
+package minidb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Cost units are roughly "rows touched": reading a row through an index is
+// dearer than reading it in a sequential scan, and hashing or sorting adds
+// per-row work on top.
+const (
+	seqRowCost   = 1.0
+	indexRowCost = 1.5
+	hashRowCost  = 1.5
+	sortRowCost  = 0.5
+)
+
+// probeCost is the cost of locating the first key in an index.
+func probeCost(index *tableIndex, rows float64) float64 {
+	if !index.ordered() {
+		return 1
+	}
+	return math.Log2(rows + 2)
+}
+
+func sortCost(rows float64) float64 {
+	return sortRowCost * rows * math.Log2(rows+2)
+}
+
+// estimateRows estimates how many rows satisfy every predicate in conj.
+func (t *Table) estimateRows(conj []*WhereClause) float64 {
+	rows := float64(t.liveRows())
+	for _, pred := range conj {
+		rows *= t.selectivity(pred)
+	}
+	return rows
+}
+
+// bestAccessPath costs every way of reaching the rows matching conj and
+// returns the cheapest, with its estimated output rows and cost. The cost
+// includes sorting for orderBy when the path does not already produce rows
+// in that order, and accounts for a LIMIT that can stop an ordered scan
+// early.
+func (t *Table) bestAccessPath(conj []*WhereClause, orderBy []OrderByItem, limit int) (accessPath, float64, float64) {
+	n := float64(t.rowCount())
+	outRows := t.estimateRows(conj)
+
+	finish := func(path accessPath, cost float64) float64 {
+		if len(orderBy) > 0 && !path.ordered {
+			return cost + sortCost(outRows)
+		}
+		if limit >= 0 && outRows > float64(limit) {
+			cost *= math.Max(float64(limit), 1) / outRows
+		}
+		return cost
+	}
+
+	best := accessPath{}
+	bestCost := finish(best, n*seqRowCost)
+	consider := func(path accessPath, cost float64) {
+		if cost = finish(path, cost); cost < bestCost {
+			best, bestCost = path, cost
+		}
+	}
+
+	for _, pred := range conj {
+		if pred.Op == "=" {
+			if index := t.indexOn(pred.Column); index != nil && !index.ordered() {
+				scanned := n * t.selectivity(pred)
+				consider(accessPath{index: index, pred: pred}, probeCost(index, n)+scanned*indexRowCost)
+			}
+		}
+		if _, ok := t.boundsFor(pred); !ok {
+			continue
+		}
+		index := t.orderedIndexOn(pred.Column)
+		if index == nil {
+			continue
+		}
+		scanned := n * t.selectivity(pred)
+		path := accessPath{index: index, pred: pred}
+		path.ordered, path.desc = indexOrders(index, orderBy)
+		consider(path, probeCost(index, n)+scanned*indexRowCost)
+	}
+
+	// A full walk of an index can stand in for a sort
+	if len(orderBy) > 0 {
+		for _, index := range t.indexes {
+			if ordered, desc := indexOrders(index, orderBy); ordered {
+				consider(accessPath{index: index, ordered: true, desc: desc}, probeCost(index, n)+n*indexRowCost)
+			}
+		}
+	}
+
+	return best, outRows, bestCost
+}
+
+// indexOrders reports whether walking index produces rows in orderBy order,
+// and in which direction.
+func indexOrders(index *tableIndex, orderBy []OrderByItem) (bool, bool) {
+	if !index.ordered() || len(orderBy) == 0 || len(orderBy) > len(index.Columns) {
+		return false, false
+	}
+	for i, item := range orderBy {
+		if item.Column != index.Columns[i] || item.Desc != orderBy[0].Desc {
+			return false, false
+		}
+	}
+	return true, orderBy[0].Desc
+}
+
+// scanNode builds the operator reading table through path and keeping the
+// rows filter matches.
+func scanNode(ctx context.Context, t *Table, snap snapshot, path accessPath, filter *predicate, estRows, cost float64) PlanNode {
+	if workers := scanWorkers(t.rowCount()); path.index == nil && workers > 1 {
+		return &parallelSeqScanNode{
+			PlanInfo: PlanInfo{Name: "Parallel Seq Scan", Detail: fmt.Sprintf("%s (%d workers)", scanDetail(t, filter.where), workers), EstRows: estRows, Cost: cost},
+			ctx:      ctx,
+			table:    t,
+			snap:     snap,
+			filter:   filter,
+			workers:  workers,
+		}
+	}
+	if path.index == nil {
+		return &seqScanNode{
+			PlanInfo: PlanInfo{Name: "Seq Scan", Detail: scanDetail(t, filter.where), EstRows: estRows, Cost: cost},
+			ctx:      ctx,
+			table:    t,
+			snap:     snap,
+			filter:   filter,
+		}
+	}
+	return &indexScanNode{
+		PlanInfo:    PlanInfo{Name: "Index Scan", Detail: scanDetail(t, filter.where), Index: path.index.Name, EstRows: estRows, Cost: cost},
+		interrupter: interrupter{ctx: ctx},
+		table:       t,
+		snap:        snap,
+		path:        path,
+		filter:      filter,
+	}
+}
+
+func scanDetail(t *Table, where *WhereClause) string {
+	if where == nil {
+		return "on " + t.Name
+	}
+	return fmt.Sprintf("on %s where %s", t.Name, describeWhere(where))
+}
+
+// chainWhere links predicates back into an AND chain.
+func chainWhere(preds []*WhereClause) *WhereClause {
+	var head *WhereClause
+	for i := len(preds) - 1; i >= 0; i-- {
+		p := *preds[i]
+		p.Next = head
+		head = &p
+	}
+	return head
+}
+
+// planSelect builds the operator tree for a SELECT and returns it with the
+// result's column names. Its scans and joins stop once ctx is cancelled.
+func (db *DB) planSelect(ctx context.Context, stmt *SelectStmt, snap snapshot) (PlanNode, []string, error) {
+	table, exists := db.tables[stmt.Table]
+	if !exists {
+		return nil, nil, &NotFoundError{Kind: "table", Name: stmt.Table}
+	}
+
+	aggregate := false
+	for _, item := range stmt.Columns {
+		if _, _, ok := parseAggregate(item); ok {
+			aggregate = true
+		}
+	}
+
+	var root PlanNode
+	var columns []string
+	var err error
+	if stmt.Join != nil {
+		root, columns, err = db.planJoin(ctx, table, stmt, snap)
+	} else {
+		root, columns, err = planTableSelect(ctx, table, stmt, snap, aggregate)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if aggregate {
+		for _, item := range stmt.Columns {
+			_, col, ok := parseAggregate(item)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s must appear in an aggregate function", item)
+			}
+			if stmt.Join == nil {
+				if _, exists := table.column(col); !exists {
+					return nil, nil, &NotFoundError{Kind: "column", Name: col}
+				}
+			}
+		}
+		node := &aggregateNode{
+			PlanInfo: PlanInfo{Name: "Aggregate", Detail: strings.Join(stmt.Columns, ", "), EstRows: 1, Cost: root.Info().Cost, Children: []PlanNode{root}},
+			child:    root,
+			table:    table,
+			items:    stmt.Columns,
+		}
+		if scan, ok := root.(*parallelSeqScanNode); ok {
+			// Each worker folds the batches it reads
+			scan.aggregate = aggregateItems(table, stmt.Columns)
+			scan.Detail += ", partial " + node.Detail
+			node.partial = true
+		}
+		return node, stmt.Columns, nil
+	}
+
+	info := root.Info()
+	return &projectNode{
+		PlanInfo: PlanInfo{Name: "Project", Detail: strings.Join(stmt.Columns, ", "), EstRows: info.EstRows, Cost: info.Cost, Children: []PlanNode{root}},
+		child:    root,
+		table:    table,
+		columns:  columns,
+	}, columns, nil
+}
+
+// planTableSelect plans a single-table SELECT up to, but not including,
+// the projection.
+func planTableSelect(ctx context.Context, t *Table, stmt *SelectStmt, snap snapshot, aggregate bool) (PlanNode, []string, error) {
+	conj := conjuncts(stmt.Where)
+
+	columns := stmt.Columns
+	if len(columns) == 1 && columns[0] == "*" {
+		columns = make([]string, len(t.Columns))
+		for i, col := range t.Columns {
+			columns[i] = col.Name
+		}
+	}
+
+	filter, err := t.compile(stmt.Where)
+	if err != nil {
+		return nil, nil, err
+	}
+	if aggregate {
+		if node := planMinMax(ctx, t, snap, stmt.Columns, conj, filter); node != nil {
+			return node, columns, nil
+		}
+		path, estRows, cost := t.bestAccessPath(conj, nil, -1)
+		return scanNode(ctx, t, snap, path, filter, estRows, cost), columns, nil
+	}
+
+	path, estRows, cost := t.bestAccessPath(conj, stmt.OrderBy, stmt.Limit)
+	root := scanNode(ctx, t, snap, path, filter, estRows, cost)
+	ordered := path.ordered
+	if scan, ok := root.(*parallelSeqScanNode); ok && len(stmt.OrderBy) > 0 {
+		// The workers sort what they read and the scan merges it
+		scan.orderBy, ordered = stmt.OrderBy, true
+		scan.Detail += ", sorted by " + describeOrder(stmt.OrderBy)
+	}
+	root = addSortLimit(root, t, stmt.OrderBy, ordered, stmt.Limit)
+	return root, columns, nil
+}
+
+// planMinMax answers a lone MIN or MAX by reading the first qualifying key
+// off an ordered index, when that is cheaper than scanning.
+func planMinMax(ctx context.Context, t *Table, snap snapshot, items []string, conj []*WhereClause, filter *predicate) PlanNode {
+	if len(items) != 1 {
+		return nil
+	}
+	fn, col, ok := parseAggregate(items[0])
+	if !ok {
+		return nil
+	}
+	index := t.orderedIndexOn(col)
+	if index == nil {
+		return nil
+	}
+
+	path := accessPath{index: index, ordered: true, desc: fn == "MAX", notNull: true}
+	n := float64(t.rowCount())
+	scanned := n
+	for _, pred := range conj {
+		if pred.Column != col {
+			continue
+		}
+		if _, ok := t.boundsFor(pred); ok && path.pred == nil {
+			path.pred = pred
+			scanned = n * t.selectivity(pred)
+		}
+	}
+
+	// Rows are read until the first one passes every predicate
+	outRows := math.Max(t.estimateRows(conj), 1)
+	cost := probeCost(index, n) + indexRowCost*math.Max(scanned/outRows, 1)
+	if _, _, scanCost := t.bestAccessPath(conj, nil, -1); scanCost <= cost {
+		return nil
+	}
+
+	scan := scanNode(ctx, t, snap, path, filter, 1, cost)
+	return &limitNode{
+		PlanInfo: PlanInfo{Name: "Limit", Detail: "1", EstRows: 1, Cost: cost, Children: []PlanNode{scan}},
+		child:    scan,
+		limit:    1,
+	}
+}
+
+// addSortLimit adds ORDER BY and LIMIT operators above root. A sort is
+// only needed when the input is not already ordered.
+func addSortLimit(root PlanNode, t *Table, orderBy []OrderByItem, ordered bool, limit int) PlanNode {
+	info := root.Info()
+	if len(orderBy) > 0 && !ordered {
+		root = &sortNode{
+			PlanInfo: PlanInfo{Name: "Sort", Detail: describeOrder(orderBy), EstRows: info.EstRows, Cost: info.Cost, Children: []PlanNode{root}},
+			child:    root,
+			table:    t,
+			orderBy:  orderBy,
+		}
+	}
+	if limit >= 0 {
+		root = &limitNode{
+			PlanInfo: PlanInfo{Name: "Limit", Detail: fmt.Sprint(limit), EstRows: math.Min(info.EstRows, float64(limit)), Cost: info.Cost, Children: []PlanNode{root}},
+			child:    root,
+			limit:    limit,
+		}
+	}
+	return root
+}
+
+func describeOrder(orderBy []OrderByItem) string {
+	parts := make([]string, len(orderBy))
+	for i, item := range orderBy {
+		parts[i] = item.Column
+		if item.Desc {
+			parts[i] += " DESC"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// planJoin plans an inner equi-join. Predicates on a single table are
+// pushed down into that table's scan; the join algorithm and the roles of
+// the two inputs are picked by estimated cost.
+func (db *DB) planJoin(ctx context.Context, left *Table, stmt *SelectStmt, snap snapshot) (PlanNode, []string, error) {
+	right, exists := db.tables[stmt.Join.Table]
+	if !exists {
+		return nil, nil, &NotFoundError{Kind: "table", Name: stmt.Join.Table}
+	}
+	joins, joinConj, err := joinPlans(ctx, left, right, stmt, snap)
+	if err != nil {
+		return nil, nil, err
+	}
+	best := joins[0]
+	for _, node := range joins[1:] {
+		if node.Info().Cost < best.Info().Cost {
+			best = node
+		}
+	}
+
+	root := best
+	if joinWhere := chainWhere(joinConj); joinWhere != nil {
+		info := root.Info()
+		root = &filterNode{
+			PlanInfo: PlanInfo{Name: "Filter", Detail: describeWhere(joinWhere), EstRows: info.EstRows * math.Pow(defaultRangeSelectivity, float64(len(joinConj))), Cost: info.Cost, Children: []PlanNode{root}},
+			child:    root,
+			table:    left,
+			where:    joinWhere,
+		}
+	}
+	root = addSortLimit(root, left, stmt.OrderBy, false, stmt.Limit)
+
+	columns := stmt.Columns
+	if len(columns) == 1 && columns[0] == "*" {
+		columns = joinColumns(left, right)
+	}
+	return root, columns, nil
+}
+
+// joinPlans returns a plan of the join of left and right for every
+// algorithm that can compute it, the nested loop first, and the WHERE
+// predicates left for the joined rows.
+func joinPlans(ctx context.Context, left, right *Table, stmt *SelectStmt, snap snapshot) ([]PlanNode, []*WhereClause, error) {
+	// Accept the ON columns in either order
+	leftTable, leftCol := splitQualified(stmt.Join.LeftCol)
+	rightTable, rightCol := splitQualified(stmt.Join.RightCol)
+	if leftTable == right.Name && rightTable == left.Name {
+		leftTable, rightTable = rightTable, leftTable
+		leftCol, rightCol = rightCol, leftCol
+	}
+	if leftTable != left.Name || rightTable != right.Name {
+		return nil, nil, fmt.Errorf("JOIN condition must compare %s and %s columns", left.Name, right.Name)
+	}
+	if _, ok := left.column(leftCol); !ok {
+		return nil, nil, &NotFoundError{Kind: "column", Name: leftCol, Table: left.Name}
+	}
+	if _, ok := right.column(rightCol); !ok {
+		return nil, nil, &NotFoundError{Kind: "column", Name: rightCol, Table: right.Name}
+	}
+
+	leftConj, rightConj, joinConj, err := pushDown(left, right, conjuncts(stmt.Where))
+	if err != nil {
+		return nil, nil, err
+	}
+	leftFilter, err := left.compile(chainWhere(leftConj))
+	if err != nil {
+		return nil, nil, err
+	}
+	rightFilter, err := right.compile(chainWhere(rightConj))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lPath, lRows, lCost := left.bestAccessPath(leftConj, nil, -1)
+	rPath, rRows, rCost := right.bestAccessPath(rightConj, nil, -1)
+	sides := joinSides{interrupter: interrupter{ctx: ctx}, left: left, right: right, leftCol: leftCol, rightCol: rightCol}
+	estRows := lRows * rRows / math.Max(left.distinctValues(leftCol), right.distinctValues(rightCol))
+
+	leftScan := func() PlanNode { return scanNode(ctx, left, snap, lPath, leftFilter, lRows, lCost) }
+	rightScan := func() PlanNode { return scanNode(ctx, right, snap, rPath, rightFilter, rRows, rCost) }
+	joinInfo := func(name string, cost float64, children ...PlanNode) PlanInfo {
+		return PlanInfo{
+			Name:     name,
+			Detail:   fmt.Sprintf("%s.%s = %s.%s", left.Name, leftCol, right.Name, rightCol),
+			EstRows:  estRows,
+			Cost:     cost,
+			Children: children,
+		}
+	}
+
+	// Nested loop is the fallback every other algorithm has to beat
+	nested := &nestedLoopJoinNode{joinSides: sides, left: leftScan(), right: rightScan()}
+	nested.PlanInfo = joinInfo("Nested Loop Join", lCost+rCost+lRows*rRows*seqRowCost, nested.left, nested.right)
+	joins := []PlanNode{nested}
+
+	// Hash join builds on the smaller input
+	hash := &hashJoinNode{joinSides: sides, buildLeft: lRows < rRows}
+	buildName := right.Name
+	if hash.buildLeft {
+		hash.build, hash.probe = leftScan(), rightScan()
+		buildName = left.Name
+	} else {
+		hash.build, hash.probe = rightScan(), leftScan()
+	}
+	hash.PlanInfo = joinInfo("Hash Join", lCost+rCost+(lRows+rRows)*hashRowCost, hash.probe, hash.build)
+	hash.Detail += " (build " + buildName + ")"
+	joins = append(joins, hash)
+
+	// Index nested loop probes an index on the inner table for each outer row
+	if index := right.joinIndexOn(rightCol); index != nil {
+		perKey := float64(right.liveRows()) / right.distinctValues(rightCol)
+		node := &indexNestedLoopJoinNode{joinSides: sides, outer: leftScan(), inner: right, snap: snap, index: index, innerFilter: rightFilter}
+		node.PlanInfo = joinInfo("Index Nested Loop Join", lCost+lRows*(probeCost(index, float64(right.rowCount()))+perKey*indexRowCost), node.outer)
+		node.Index = index.Name
+		joins = append(joins, node)
+	}
+	if index := left.joinIndexOn(leftCol); index != nil {
+		perKey := float64(left.liveRows()) / left.distinctValues(leftCol)
+		node := &indexNestedLoopJoinNode{joinSides: sides, outer: rightScan(), inner: left, snap: snap, index: index, innerFilter: leftFilter, innerLeft: true}
+		node.PlanInfo = joinInfo("Index Nested Loop Join", rCost+rRows*(probeCost(index, float64(left.rowCount()))+perKey*indexRowCost), node.outer)
+		node.Index = index.Name
+		joins = append(joins, node)
+	}
+
+	// Merge join walks both inputs in join-key order
+	li, ri := left.orderedIndexOn(leftCol), right.orderedIndexOn(rightCol)
+	if li != nil && ri != nil && mergeCompatible(left, right, leftCol, rightCol) {
+		ln, rn := float64(left.rowCount()), float64(right.rowCount())
+		lScan := scanNode(ctx, left, snap, accessPath{index: li, ordered: true, notNull: true}, leftFilter, lRows, probeCost(li, ln)+ln*indexRowCost)
+		rScan := scanNode(ctx, right, snap, accessPath{index: ri, ordered: true, notNull: true}, rightFilter, rRows, probeCost(ri, rn)+rn*indexRowCost)
+		node := &mergeJoinNode{joinSides: sides, left: lScan, right: rScan}
+		node.PlanInfo = joinInfo("Merge Join", lScan.Info().Cost+rScan.Info().Cost, lScan, rScan)
+		joins = append(joins, node)
+	}
+	return joins, joinConj, nil
+}
+
+// pushDown sorts WHERE predicates into those on the left table, those on the
+// right table and those that need the joined row. Pushed-down predicates
+// lose their table qualifier.
+func pushDown(left, right *Table, conj []*WhereClause) ([]*WhereClause, []*WhereClause, []*WhereClause, error) {
+	var leftConj, rightConj, joinConj []*WhereClause
+	for _, pred := range conj {
+		if isExprText(pred.Column) {
+			joinConj = append(joinConj, pred)
+			continue
+		}
+
+		tableName, col := splitQualified(pred.Column)
+		_, inLeft := left.column(col)
+		_, inRight := right.column(col)
+		if tableName == "" && inLeft && inRight {
+			return nil, nil, nil, fmt.Errorf("column reference %s is ambiguous", col)
+		}
+
+		p := *pred
+		p.Column = col
+		switch {
+		case inLeft && (tableName == left.Name || tableName == "" && !inRight):
+			leftConj = append(leftConj, &p)
+		case inRight && (tableName == right.Name || tableName == "" && !inLeft):
+			rightConj = append(rightConj, &p)
+		default:
+			joinConj = append(joinConj, pred)
+		}
+	}
+	return leftConj, rightConj, joinConj, nil
+}
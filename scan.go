@@ -0,0 +1,288 @@
+package minidb
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// accessPath describes how a scan reaches a table's rows: a full scan, an
+// equality lookup, a range scan or an ordered walk of a BTREE index.
+type accessPath struct {
+	index   *tableIndex  // nil for a full table scan
+	pred    *WhereClause // predicate answered by the index, if any
+	ordered bool         // rows are produced in index order
+	desc    bool
+	notNull bool // skip NULL keys in an unbounded ordered walk
+}
+
+type scanBounds struct {
+	lo, hi         interface{}
+	loIncl, hiIncl bool
+}
+
+// orderedIndexOn returns a BTREE index whose first column is colName.
+func (t *Table) orderedIndexOn(colName string) *tableIndex {
+	var found *tableIndex
+	for _, index := range t.indexes {
+		if index.ordered() && index.Columns[0] == colName {
+			if found == nil || len(index.Columns) < len(found.Columns) {
+				found = index
+			}
+		}
+	}
+	return found
+}
+
+// boundsFor converts a predicate into a key range on its column, when it
+// has one.
+func (t *Table) boundsFor(where *WhereClause) (scanBounds, bool) {
+	if where.comparesNull() {
+		return scanBounds{}, false
+	}
+	switch where.Op {
+	case "=":
+		return scanBounds{lo: where.Value, hi: where.Value, loIncl: true, hiIncl: true}, true
+	case ">":
+		return scanBounds{lo: where.Value}, true
+	case ">=":
+		return scanBounds{lo: where.Value, loIncl: true}, true
+	case "<":
+		return scanBounds{hi: where.Value}, true
+	case "<=":
+		return scanBounds{hi: where.Value, hiIncl: true}, true
+	case "BETWEEN":
+		return scanBounds{lo: where.Value, hi: where.Value2, loIncl: true, hiIncl: true}, true
+	case "LIKE":
+		// Only a literal prefix on a plain string column maps to a range;
+		// enum columns are ordered by declaration, not text
+		if col, ok := t.column(where.Column); !ok || col.Type != TypeString {
+			return scanBounds{}, false
+		}
+		prefix := likePrefix(where.Value.(string))
+		if prefix == "" {
+			return scanBounds{}, false
+		}
+		return scanBounds{lo: prefix, hi: prefix + "\xff", loIncl: true, hiIncl: true}, true
+	}
+	return scanBounds{}, false
+}
+
+// indexIterator produces the positions of the rows reached through an
+// index, one at a time. Rows still have to be checked against the full
+// WHERE clause.
+type indexIterator struct {
+	table   *Table
+	path    accessPath
+	bounds  scanBounds
+	bounded bool
+	cursor  indexCursor
+	last    []interface{} // key the cursor reached
+	started bool
+	stale   bool // the index may have changed since the cursor reached last
+	done    bool
+	pending []int
+}
+
+func (t *Table) newIndexIterator(path accessPath) *indexIterator {
+	it := &indexIterator{table: t, path: path}
+	if path.pred != nil {
+		it.bounds, it.bounded = t.boundsFor(path.pred)
+	}
+	return it
+}
+
+func (it *indexIterator) next() (int, bool) {
+	for len(it.pending) == 0 {
+		if it.done || !it.advance() {
+			it.done = true
+			return 0, false
+		}
+	}
+	idx := it.pending[0]
+	it.pending = it.pending[1:]
+	return idx, true
+}
+
+// advance loads the rows of the next qualifying key into pending.
+func (it *indexIterator) advance() bool {
+	index := it.path.index
+	if !index.ordered() {
+		if it.started {
+			return false
+		}
+		it.started = true
+		it.pending = append([]int(nil), index.lookup(it.path.pred.Value)...)
+		return len(it.pending) > 0
+	}
+
+	col := index.Columns[0]
+	cmp := func(a, b interface{}) int { return it.table.compare(col, a, b) }
+
+	for {
+		switch {
+		case !it.started:
+			it.started = true
+			it.cursor = it.seek()
+		case it.stale && !it.reseek():
+			// The key reached is gone, and the cursor is on the one after
+		case it.path.desc:
+			it.cursor.prev()
+		default:
+			it.cursor.next()
+		}
+		if !it.cursor.valid() {
+			return false
+		}
+		it.last = it.cursor.key()
+
+		k := it.cursor.key()[0]
+		if k == nil {
+			// NULLs sort first: nothing past them qualifies when walking
+			// down, and they are skipped when walking up
+			if it.bounded || it.path.notNull {
+				if it.path.desc {
+					return false
+				}
+				continue
+			}
+		} else if it.bounded {
+			if it.bounds.lo != nil {
+				c := cmp(k, it.bounds.lo)
+				if c < 0 || (c == 0 && !it.bounds.loIncl) {
+					if it.path.desc {
+						return false
+					}
+					continue
+				}
+			}
+			if it.bounds.hi != nil {
+				c := cmp(k, it.bounds.hi)
+				if c > 0 || (c == 0 && !it.bounds.hiIncl) {
+					if !it.path.desc {
+						return false
+					}
+					continue
+				}
+			}
+		}
+
+		it.pending = append([]int(nil), it.cursor.rows()...)
+		return true
+	}
+}
+
+// resume tells the iterator it let go of the index, which may have changed
+// since: a node the cursor was in may have split.
+func (it *indexIterator) resume() {
+	it.stale = it.started
+}
+
+// reseek moves a fresh cursor to the key the walk had reached, and reports
+// whether that key is still there to step past.
+func (it *indexIterator) reseek() bool {
+	index := it.path.index
+	it.stale = false
+	it.cursor = index.seek(it.last, it.path.desc)
+	return it.cursor.valid() && index.tree.compare(it.cursor.key(), it.last) == 0
+}
+
+func (it *indexIterator) seek() indexCursor {
+	var from []interface{}
+	if it.path.desc {
+		if it.bounded && it.bounds.hi != nil {
+			from = []interface{}{it.bounds.hi}
+		}
+	} else if it.bounded && it.bounds.lo != nil {
+		from = []interface{}{it.bounds.lo}
+	}
+	return it.path.index.seek(from, it.path.desc)
+}
+
+// matchingPositions returns the positions of the row versions in snap
+// matching where, using the cheapest access path. It stops with an error
+// once ctx is cancelled.
+func (t *Table) matchingPositions(ctx context.Context, snap snapshot, where *WhereClause) ([]int, error) {
+	path, _, _ := t.bestAccessPath(conjuncts(where), nil, -1)
+	filter, err := t.compile(where)
+	if err != nil {
+		return nil, err
+	}
+	stop := interrupter{ctx: ctx}
+
+	positions := make([]int, 0)
+	if path.index == nil {
+		for i := 0; i < t.rowCount(); i++ {
+			if err := stop.check(); err != nil {
+				return nil, err
+			}
+			if !t.visible(snap, i) {
+				continue
+			}
+			matched, err := filter.matches(t.tuple(i))
+			if err != nil {
+				return nil, err
+			}
+			if matched {
+				positions = append(positions, i)
+			}
+		}
+		return positions, nil
+	}
+
+	it := t.newIndexIterator(path)
+	for idx, ok := it.next(); ok; idx, ok = it.next() {
+		if err := stop.check(); err != nil {
+			return nil, err
+		}
+		if !t.visible(snap, idx) {
+			continue
+		}
+		matched, err := filter.matches(t.tuple(idx))
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			positions = append(positions, idx)
+		}
+	}
+	sort.Ints(positions)
+	return positions, nil
+}
+
+// likePrefix returns the literal text before the first wildcard.
+func likePrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "%_"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// likeMatch implements SQL LIKE: % matches any run of characters and _
+// matches exactly one.
+func likeMatch(s, pattern string) bool {
+	sr, pr := []rune(s), []rune(pattern)
+	si, pi := 0, 0
+	star, match := -1, 0
+
+	for si < len(sr) {
+		if pi < len(pr) && (pr[pi] == '_' || pr[pi] == sr[si]) {
+			si++
+			pi++
+		} else if pi < len(pr) && pr[pi] == '%' {
+			star = pi
+			match = si
+			pi++
+		} else if star >= 0 {
+			pi = star + 1
+			match++
+			si = match
+		} else {
+			return false
+		}
+	}
+	for pi < len(pr) && pr[pi] == '%' {
+		pi++
+	}
+	return pi == len(pr)
+}
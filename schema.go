@@ -0,0 +1,55 @@
+package minidb
+
+import "sort"
+
+// TableInfo describes a table: its columns in order, and the indexes made
+// with CREATE INDEX. PRIMARY KEY and UNIQUE columns are indexed as well.
+type TableInfo struct {
+	Name    string
+	Columns []Column
+	Indexes []IndexDef
+}
+
+// The catalog only changes under mu held exclusive, so reading it needs no
+// table latches. A table or index created in a transaction shows as soon
+// as it is created, as it does to the transaction's own statements.
+
+// Tables returns the names of the database's tables in order.
+func (db *DB) Tables() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe returns the schema of the named table.
+func (db *DB) Describe(table string) (*TableInfo, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	t, exists := db.tables[table]
+	if !exists {
+		return nil, &NotFoundError{Kind: "table", Name: table}
+	}
+	return &TableInfo{
+		Name:    t.Name,
+		Columns: append([]Column(nil), t.Columns...),
+		Indexes: t.IndexDefs(),
+	}, nil
+}
+
+// EnumTypes returns the types made with CREATE TYPE ... AS ENUM, in order
+// of their names.
+func (db *DB) EnumTypes() []EnumType {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	types := make([]EnumType, 0, len(db.types))
+	for _, enum := range db.types {
+		types = append(types, EnumType{Name: enum.Name, Values: append([]string(nil), enum.Values...)})
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
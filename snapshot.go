@@ -0,0 +1,137 @@
+package minidb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// snapshotVersion is the format version written in the snapshot header.
+// Load refuses files from a newer version.
+const snapshotVersion = 2
+
+// snapshotMagic starts the header line, which is followed by the format
+// version and the CRC-32C of the body: "MINIDB 2 1a2b3c4d\n". Files from
+// before the header existed are plain JSON.
+const snapshotMagic = "MINIDB"
+
+// fileSystem is the part of the OS that writeSnapshot uses, so the crash
+// harness can fail any step of a save.
+type fileSystem interface {
+	Create(name string) (syncFile, error)
+	Rename(from, to string) error
+	SyncDir(dir string) error
+}
+
+type syncFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+type osFS struct{}
+
+func (osFS) Create(name string) (syncFile, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (osFS) Rename(from, to string) error {
+	return os.Rename(from, to)
+}
+
+func (osFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// writeSnapshot replaces the file at path with a snapshot holding body.
+func writeSnapshot(fs fileSystem, path string, body []byte) error {
+	return replaceFile(fs, path, func(w io.Writer) error {
+		header := fmt.Sprintf("%s %d %08x\n", snapshotMagic, snapshotVersion, crc32.Checksum(body, walCRC))
+		_, err := w.Write(append([]byte(header), body...))
+		return err
+	})
+}
+
+// replaceFile replaces the file at path with what write produces, without
+// ever leaving it half written: the new contents go to a temporary file
+// that is synced and then renamed over the old one, and the directory is
+// synced so the rename itself survives a crash.
+func replaceFile(fs fileSystem, path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	file, err := fs.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+
+	w := bufio.NewWriterSize(file, 1<<16)
+	if err := write(w); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %v", filepath.Base(path), err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %v", filepath.Base(path), err)
+	}
+
+	if err := fs.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", filepath.Base(path), err)
+	}
+	if err := fs.SyncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
+
+// readSnapshot returns the body of the snapshot at path and its format
+// version, after checking its header and checksum. The body is nil if
+// there is no snapshot; files written before the header existed are
+// version 0.
+func readSnapshot(path string) ([]byte, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(snapshotMagic+" ")) {
+		return data, 0, nil
+	}
+
+	end := bytes.IndexByte(data, '\n')
+	if end < 0 {
+		return nil, 0, fmt.Errorf("snapshot %s is corrupt: truncated header", path)
+	}
+	var version int
+	var sum uint32
+	if _, err := fmt.Sscanf(string(data[:end]), snapshotMagic+" %d %x", &version, &sum); err != nil {
+		return nil, 0, fmt.Errorf("snapshot %s is corrupt: bad header", path)
+	}
+	if version > snapshotVersion {
+		return nil, 0, fmt.Errorf("snapshot %s has format version %d; this build reads up to %d", path, version, snapshotVersion)
+	}
+	body := data[end+1:]
+	if crc32.Checksum(body, walCRC) != sum {
+		return nil, 0, fmt.Errorf("snapshot %s is corrupt: checksum mismatch", path)
+	}
+	return body, version, nil
+}
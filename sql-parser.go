@@ -1,9 +1,10 @@
-package main
+package minidb
 
 import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Statement interface{}
@@ -13,6 +14,101 @@ type CreateTableStmt struct {
 	Columns []Column
 }
 
+type CreateTypeStmt struct {
+	Name   string
+	Values []string
+}
+
+type CreateIndexStmt struct {
+	Name    string
+	Table   string
+	Columns []string
+	Unique  bool
+	Kind    string
+}
+
+type DropIndexStmt struct {
+	Name string
+}
+
+// CreateDatabaseStmt, DropDatabaseStmt and UseStmt manage the databases of
+// an Instance, so only a Session made by one can run them.
+type CreateDatabaseStmt struct {
+	Name string
+}
+
+type DropDatabaseStmt struct {
+	Name string
+}
+
+type UseStmt struct {
+	Name string
+}
+
+// BackupStmt copies the database into the backup directory Path, or with
+// Incremental adds what was committed since the backup there was taken.
+type BackupStmt struct {
+	Path        string
+	Incremental bool
+}
+
+// RestoreStmt replaces a database with the backup in Path: the one it was
+// taken of, or Name when set. Unless To is zero, only the commits made by
+// then are restored. Without a Path it recovers the database in use as of
+// To from the history it keeps, into Name when set.
+type RestoreStmt struct {
+	Path string
+	Name string
+	To   time.Time
+}
+
+type BeginStmt struct {
+	Isolation IsolationLevel
+}
+
+type CommitStmt struct{}
+
+// RollbackStmt undoes the whole transaction, or only the changes made since
+// Savepoint when it is set.
+type RollbackStmt struct {
+	Savepoint string
+}
+
+type SavepointStmt struct {
+	Name string
+}
+
+type ReleaseStmt struct {
+	Name string
+}
+
+// SetStmt changes a setting of the session. statement_timeout is the only
+// one so far; Default puts it back to the database's.
+type SetStmt struct {
+	Name    string
+	Timeout time.Duration
+	Default bool
+}
+
+// ExplainStmt reports the plan chosen for a query and, with Analyze, runs
+// it to measure each operator.
+type ExplainStmt struct {
+	Analyze bool
+	Query   *SelectStmt
+}
+
+// AnalyzeStmt gathers planner statistics for one table, or for every table
+// when Table is empty.
+type AnalyzeStmt struct {
+	Table string
+}
+
+// VacuumStmt reclaims the space of dead row versions in one table, or in
+// every table when Table is empty.
+type VacuumStmt struct {
+	Table string
+}
+
 type InsertStmt struct {
 	Table  string
 	Values Row
@@ -23,6 +119,10 @@ type SelectStmt struct {
 	Table   string
 	Where   *WhereClause
 	Join    *JoinClause
+	OrderBy []OrderByItem
+	Limit   int       // -1 when there is no LIMIT
+	AsOf    time.Time // read the database as it was then, unless zero
+	Lock    lockMode  // lockX for FOR UPDATE, lockS for FOR SHARE
 }
 
 type UpdateStmt struct {
@@ -36,10 +136,34 @@ type DeleteStmt struct {
 	Where *WhereClause
 }
 
+// WhereClause is one predicate; Next chains further predicates joined by
+// AND.
 type WhereClause struct {
 	Column string
 	Op     string
 	Value  interface{}
+	Value2 interface{} // upper bound for BETWEEN
+	Next   *WhereClause
+}
+
+// comparesNull reports whether the predicate compares with NULL, which no
+// value satisfies.
+func (w *WhereClause) comparesNull() bool {
+	return w.Value == nil || (w.Op == "BETWEEN" && w.Value2 == nil)
+}
+
+// conjuncts flattens an AND chain into its predicates.
+func conjuncts(where *WhereClause) []*WhereClause {
+	preds := make([]*WhereClause, 0)
+	for w := where; w != nil; w = w.Next {
+		preds = append(preds, w)
+	}
+	return preds
+}
+
+type OrderByItem struct {
+	Column string
+	Desc   bool
 }
 
 type JoinClause struct {
@@ -48,7 +172,16 @@ type JoinClause struct {
 	RightCol string
 }
 
+// Parse parses one SQL statement. Its errors are *SyntaxError.
 func Parse(query string) (Statement, error) {
+	stmt, err := parse(query)
+	if err != nil {
+		return nil, &SyntaxError{Query: query, Msg: err.Error()}
+	}
+	return stmt, nil
+}
+
+func parse(query string) (Statement, error) {
 	query = strings.TrimSpace(query)
 	tokens := tokenize(query)
 
@@ -58,7 +191,42 @@ func Parse(query string) (Statement, error) {
 
 	switch strings.ToUpper(tokens[0]) {
 	case "CREATE":
+		if len(tokens) > 1 && strings.ToUpper(tokens[1]) == "TYPE" {
+			return parseCreateType(tokens)
+		}
+		if len(tokens) > 1 && strings.ToUpper(tokens[1]) == "DATABASE" {
+			return parseCreateDatabase(tokens)
+		}
+		if len(tokens) > 1 && (strings.ToUpper(tokens[1]) == "INDEX" || strings.ToUpper(tokens[1]) == "UNIQUE") {
+			return parseCreateIndex(tokens)
+		}
 		return parseCreateTable(tokens)
+	case "DROP":
+		return parseDrop(tokens)
+	case "USE":
+		return parseUse(tokens)
+	case "BACKUP":
+		return parseBackup(tokens)
+	case "RESTORE":
+		return parseRestore(tokens)
+	case "ANALYZE":
+		return parseAnalyze(tokens)
+	case "VACUUM":
+		return parseVacuum(tokens)
+	case "EXPLAIN":
+		return parseExplain(tokens)
+	case "BEGIN", "START":
+		return parseBegin(tokens)
+	case "COMMIT", "END":
+		return parseCommit(tokens)
+	case "ROLLBACK":
+		return parseRollback(tokens)
+	case "SAVEPOINT":
+		return parseSavepoint(tokens)
+	case "RELEASE":
+		return parseRelease(tokens)
+	case "SET":
+		return parseSet(tokens)
 	case "INSERT":
 		return parseInsert(tokens)
 	case "SELECT":
@@ -74,21 +242,34 @@ func Parse(query string) (Statement, error) {
 
 func tokenize(query string) []string {
 	// Simple tokenizer - splits on spaces but preserves quoted strings
+	// (including their quotes, so literals can be told apart from names)
 	tokens := make([]string, 0)
 	current := ""
-	inQuotes := false
+	var quote byte
 
 	for i := 0; i < len(query); i++ {
 		ch := query[i]
 
-		if ch == '\'' || ch == '"' {
-			inQuotes = !inQuotes
-		} else if (ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r') && !inQuotes {
+		if quote != 0 {
+			current += string(ch)
+			if ch == quote {
+				// A doubled quote is an escaped quote inside the literal
+				if i+1 < len(query) && query[i+1] == quote {
+					current += string(ch)
+					i++
+				} else {
+					quote = 0
+				}
+			}
+		} else if ch == '\'' || ch == '"' {
+			quote = ch
+			current += string(ch)
+		} else if ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' {
 			if current != "" {
 				tokens = append(tokens, current)
 				current = ""
 			}
-		} else if (ch == '(' || ch == ')' || ch == ',' || ch == ';') && !inQuotes {
+		} else if ch == '(' || ch == ')' || ch == ',' || ch == ';' {
 			if current != "" {
 				tokens = append(tokens, current)
 				current = ""
@@ -105,7 +286,46 @@ func tokenize(query string) []string {
 		tokens = append(tokens, current)
 	}
 
-	return tokens
+	return mergeExprTokens(tokens)
+}
+
+// mergeExprTokens glues function calls and JSON arrow operators back into
+// single tokens, e.g. "json_extract ( meta '$.a' )" -> "json_extract(meta, '$.a')".
+func mergeExprTokens(tokens []string) []string {
+	merged := make([]string, 0, len(tokens))
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+
+		if (isFunctionName(tok) || isAggregateName(tok)) && i+1 < len(tokens) && tokens[i+1] == "(" {
+			depth := 0
+			j := i + 1
+			for ; j < len(tokens); j++ {
+				if tokens[j] == "(" {
+					depth++
+				} else if tokens[j] == ")" {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if j >= len(tokens) {
+				j = len(tokens) - 1
+			}
+			args := mergeExprTokens(tokens[i+2 : j])
+			tok = tok + "(" + strings.Join(args, ", ") + ")"
+			i = j
+		}
+
+		if n := len(merged); n > 0 && (strings.HasPrefix(tok, "->") || strings.HasSuffix(merged[n-1], "->") || strings.HasSuffix(merged[n-1], "->>")) {
+			merged[n-1] += tok
+			continue
+		}
+		merged = append(merged, tok)
+	}
+
+	return merged
 }
 
 func parseCreateTable(tokens []string) (*CreateTableStmt, error) {
@@ -153,8 +373,12 @@ func parseCreateTable(tokens []string) (*CreateTableStmt, error) {
 			col.Type = TypeString
 		case "FLOAT", "REAL":
 			col.Type = TypeFloat
+		case "JSON":
+			col.Type = TypeJSON
 		default:
-			return nil, fmt.Errorf("unknown type: %s", typeStr)
+			// Anything else must name a type created with CREATE TYPE
+			col.Type = TypeEnum
+			col.EnumType = tokens[i]
 		}
 		i++
 
@@ -181,6 +405,366 @@ func parseCreateTable(tokens []string) (*CreateTableStmt, error) {
 	return stmt, nil
 }
 
+func parseCreateType(tokens []string) (*CreateTypeStmt, error) {
+	// CREATE TYPE name AS ENUM ('a', 'b', 'c')
+	if len(tokens) < 7 || strings.ToUpper(tokens[3]) != "AS" || strings.ToUpper(tokens[4]) != "ENUM" || tokens[5] != "(" {
+		return nil, fmt.Errorf("invalid CREATE TYPE syntax")
+	}
+
+	stmt := &CreateTypeStmt{
+		Name:   tokens[2],
+		Values: make([]string, 0),
+	}
+
+	i := 6
+	for i < len(tokens) && tokens[i] != ")" {
+		val, ok := parseValue(tokens[i]).(string)
+		if !ok || tokens[i][0] != '\'' {
+			return nil, fmt.Errorf("enum values must be quoted strings: %s", tokens[i])
+		}
+		stmt.Values = append(stmt.Values, val)
+		i++
+	}
+	if i >= len(tokens) {
+		return nil, fmt.Errorf("missing ) in CREATE TYPE")
+	}
+
+	return stmt, nil
+}
+
+func parseCreateIndex(tokens []string) (*CreateIndexStmt, error) {
+	// CREATE [UNIQUE] INDEX name ON table [USING BTREE|HASH] (col1, col2) [USING BTREE|HASH]
+	stmt := &CreateIndexStmt{Columns: make([]string, 0), Kind: IndexHash}
+
+	i := 1
+	if strings.ToUpper(tokens[i]) == "UNIQUE" {
+		stmt.Unique = true
+		i++
+	}
+	if i+4 >= len(tokens) || strings.ToUpper(tokens[i]) != "INDEX" || strings.ToUpper(tokens[i+2]) != "ON" {
+		return nil, fmt.Errorf("invalid CREATE INDEX syntax")
+	}
+	stmt.Name = tokens[i+1]
+	stmt.Table = tokens[i+3]
+	i += 4
+
+	if kind, n, err := parseIndexUsing(tokens[i:]); err != nil {
+		return nil, err
+	} else if n > 0 {
+		stmt.Kind = kind
+		i += n
+	}
+
+	if i >= len(tokens) || tokens[i] != "(" {
+		return nil, fmt.Errorf("missing index columns")
+	}
+	i++
+	for i < len(tokens) && tokens[i] != ")" {
+		stmt.Columns = append(stmt.Columns, tokens[i])
+		i++
+	}
+	if len(stmt.Columns) == 0 {
+		return nil, fmt.Errorf("missing index columns")
+	}
+	i++ // skip )
+
+	if kind, n, err := parseIndexUsing(tokens[i:]); err != nil {
+		return nil, err
+	} else if n > 0 {
+		stmt.Kind = kind
+		i += n
+	}
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s in CREATE INDEX", tokens[i])
+	}
+
+	return stmt, nil
+}
+
+func parseIndexUsing(tokens []string) (string, int, error) {
+	if len(tokens) == 0 || strings.ToUpper(tokens[0]) != "USING" {
+		return "", 0, nil
+	}
+	if len(tokens) < 2 {
+		return "", 0, fmt.Errorf("missing index method after USING")
+	}
+	switch kind := strings.ToUpper(tokens[1]); kind {
+	case IndexHash, IndexBTree:
+		return kind, 2, nil
+	default:
+		return "", 0, fmt.Errorf("unknown index method: %s", tokens[1])
+	}
+}
+
+func parseDrop(tokens []string) (Statement, error) {
+	// DROP INDEX name | DROP DATABASE name
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("invalid DROP syntax")
+	}
+	switch strings.ToUpper(tokens[1]) {
+	case "INDEX":
+		return &DropIndexStmt{Name: tokens[2]}, nil
+	case "DATABASE":
+		return &DropDatabaseStmt{Name: tokens[2]}, nil
+	}
+	return nil, fmt.Errorf("invalid DROP syntax")
+}
+
+func parseCreateDatabase(tokens []string) (*CreateDatabaseStmt, error) {
+	// CREATE DATABASE name
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("invalid CREATE DATABASE syntax")
+	}
+	return &CreateDatabaseStmt{Name: tokens[2]}, nil
+}
+
+func parseBackup(tokens []string) (*BackupStmt, error) {
+	// BACKUP TO 'path' [INCREMENTAL]
+	if len(tokens) < 3 || len(tokens) > 4 || strings.ToUpper(tokens[1]) != "TO" {
+		return nil, fmt.Errorf("invalid BACKUP syntax")
+	}
+	path, ok := parseStringLiteral(tokens[2])
+	if !ok {
+		return nil, fmt.Errorf("BACKUP TO needs a quoted path")
+	}
+	stmt := &BackupStmt{Path: path}
+	if len(tokens) == 4 {
+		if strings.ToUpper(tokens[3]) != "INCREMENTAL" {
+			return nil, fmt.Errorf("invalid BACKUP syntax")
+		}
+		stmt.Incremental = true
+	}
+	return stmt, nil
+}
+
+func parseRestore(tokens []string) (*RestoreStmt, error) {
+	// RESTORE FROM 'path' [TO TIMESTAMP 'time'] [AS name]
+	// RESTORE TO TIMESTAMP 'time' [AS name]
+	stmt := &RestoreStmt{}
+	i := 1
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "FROM" {
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("invalid RESTORE syntax")
+		}
+		path, ok := parseStringLiteral(tokens[i+1])
+		if !ok {
+			return nil, fmt.Errorf("RESTORE FROM needs a quoted path")
+		}
+		stmt.Path = path
+		i += 2
+	}
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "TO" {
+		at, err := parseAsOf(tokens[i:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.To = at
+		i += 3
+	}
+	if i+1 < len(tokens) && strings.ToUpper(tokens[i]) == "AS" {
+		stmt.Name = tokens[i+1]
+		i += 2
+	}
+	if i != len(tokens) || (stmt.Path == "" && stmt.To.IsZero()) {
+		return nil, fmt.Errorf("invalid RESTORE syntax")
+	}
+	return stmt, nil
+}
+
+// parseAsOf parses the TO or OF that tokens start with, then TIMESTAMP
+// 'time'.
+func parseAsOf(tokens []string) (time.Time, error) {
+	if len(tokens) < 3 || strings.ToUpper(tokens[1]) != "TIMESTAMP" {
+		return time.Time{}, fmt.Errorf("expected TIMESTAMP 'time' after %s", strings.ToUpper(tokens[0]))
+	}
+	text, ok := parseStringLiteral(tokens[2])
+	if !ok {
+		return time.Time{}, fmt.Errorf("TIMESTAMP needs a quoted time")
+	}
+	return ParseTimestamp(text)
+}
+
+// timestampLayouts are the forms a TIMESTAMP literal may take. Times
+// without a zone are local.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses a time in one of the forms of a TIMESTAMP literal.
+func ParseTimestamp(text string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q; use YYYY-MM-DD [HH:MM[:SS]] or RFC 3339", text)
+}
+
+// parseStringLiteral returns the text of a quoted literal.
+func parseStringLiteral(token string) (string, bool) {
+	if len(token) < 2 || token[0] != '\'' {
+		return "", false
+	}
+	s, ok := parseValue(token).(string)
+	return s, ok
+}
+
+func parseUse(tokens []string) (*UseStmt, error) {
+	// USE name
+	if len(tokens) != 2 {
+		return nil, fmt.Errorf("invalid USE syntax")
+	}
+	return &UseStmt{Name: tokens[1]}, nil
+}
+
+func parseBegin(tokens []string) (*BeginStmt, error) {
+	// BEGIN [TRANSACTION] | START TRANSACTION, then [ISOLATION LEVEL level]
+	rest := tokens[1:]
+	if strings.ToUpper(tokens[0]) == "START" && (len(rest) == 0 || strings.ToUpper(rest[0]) != "TRANSACTION") {
+		return nil, fmt.Errorf("invalid START TRANSACTION syntax")
+	}
+	if len(rest) > 0 && strings.ToUpper(rest[0]) == "TRANSACTION" {
+		rest = rest[1:]
+	}
+	stmt := &BeginStmt{}
+	if len(rest) >= 2 && strings.ToUpper(rest[0]) == "ISOLATION" && strings.ToUpper(rest[1]) == "LEVEL" {
+		level, ok := parseIsolationLevel(strings.Join(rest[2:], " "))
+		if !ok {
+			return nil, fmt.Errorf("unknown isolation level: %s", strings.Join(rest[2:], " "))
+		}
+		stmt.Isolation = level
+		rest = nil
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("invalid BEGIN syntax")
+	}
+	return stmt, nil
+}
+
+func parseCommit(tokens []string) (*CommitStmt, error) {
+	// COMMIT [TRANSACTION] | END [TRANSACTION]
+	if len(tokens) > 2 || (len(tokens) == 2 && strings.ToUpper(tokens[1]) != "TRANSACTION") {
+		return nil, fmt.Errorf("invalid COMMIT syntax")
+	}
+	return &CommitStmt{}, nil
+}
+
+func parseRollback(tokens []string) (*RollbackStmt, error) {
+	// ROLLBACK [TRANSACTION] [TO [SAVEPOINT] name]
+	rest := tokens[1:]
+	if len(rest) > 0 && strings.ToUpper(rest[0]) == "TRANSACTION" {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return &RollbackStmt{}, nil
+	}
+
+	if strings.ToUpper(rest[0]) != "TO" {
+		return nil, fmt.Errorf("invalid ROLLBACK syntax")
+	}
+	rest = rest[1:]
+	if len(rest) > 0 && strings.ToUpper(rest[0]) == "SAVEPOINT" {
+		rest = rest[1:]
+	}
+	if len(rest) != 1 {
+		return nil, fmt.Errorf("invalid ROLLBACK TO syntax")
+	}
+	return &RollbackStmt{Savepoint: rest[0]}, nil
+}
+
+func parseSavepoint(tokens []string) (*SavepointStmt, error) {
+	// SAVEPOINT name
+	if len(tokens) != 2 {
+		return nil, fmt.Errorf("invalid SAVEPOINT syntax")
+	}
+	return &SavepointStmt{Name: tokens[1]}, nil
+}
+
+func parseRelease(tokens []string) (*ReleaseStmt, error) {
+	// RELEASE [SAVEPOINT] name
+	rest := tokens[1:]
+	if len(rest) > 0 && strings.ToUpper(rest[0]) == "SAVEPOINT" {
+		rest = rest[1:]
+	}
+	if len(rest) != 1 {
+		return nil, fmt.Errorf("invalid RELEASE syntax")
+	}
+	return &ReleaseStmt{Name: rest[0]}, nil
+}
+
+func parseExplain(tokens []string) (*ExplainStmt, error) {
+	// EXPLAIN [ANALYZE] SELECT ...
+	stmt := &ExplainStmt{}
+	i := 1
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "ANALYZE" {
+		stmt.Analyze = true
+		i++
+	}
+	if i >= len(tokens) || strings.ToUpper(tokens[i]) != "SELECT" {
+		return nil, fmt.Errorf("EXPLAIN only supports SELECT")
+	}
+
+	query, err := parseSelect(tokens[i:])
+	if err != nil {
+		return nil, err
+	}
+	stmt.Query = query
+	return stmt, nil
+}
+
+func parseAnalyze(tokens []string) (*AnalyzeStmt, error) {
+	// ANALYZE [tablename]
+	switch len(tokens) {
+	case 1:
+		return &AnalyzeStmt{}, nil
+	case 2:
+		return &AnalyzeStmt{Table: tokens[1]}, nil
+	}
+	return nil, fmt.Errorf("invalid ANALYZE syntax")
+}
+
+func parseSet(tokens []string) (*SetStmt, error) {
+	// SET statement_timeout {= | TO} {milliseconds | 'duration' | DEFAULT}
+	if len(tokens) != 4 || (tokens[2] != "=" && strings.ToUpper(tokens[2]) != "TO") {
+		return nil, fmt.Errorf("invalid SET syntax")
+	}
+	stmt := &SetStmt{Name: strings.ToLower(tokens[1])}
+	if stmt.Name != "statement_timeout" {
+		return nil, fmt.Errorf("unrecognized setting %s", tokens[1])
+	}
+	if strings.ToUpper(tokens[3]) == "DEFAULT" {
+		stmt.Default = true
+		return stmt, nil
+	}
+
+	// A bare number is in milliseconds, as is a quoted one; anything else
+	// is a duration such as '1.5s'
+	value := fmt.Sprint(parseValue(tokens[3]))
+	timeout, err := time.ParseDuration(value)
+	if ms, convErr := strconv.Atoi(value); convErr == nil {
+		timeout, err = time.Duration(ms)*time.Millisecond, nil
+	}
+	if err != nil || timeout < 0 {
+		return nil, fmt.Errorf("invalid statement_timeout %s", tokens[3])
+	}
+	stmt.Timeout = timeout
+	return stmt, nil
+}
+
+func parseVacuum(tokens []string) (*VacuumStmt, error) {
+	// VACUUM [tablename]
+	switch len(tokens) {
+	case 1:
+		return &VacuumStmt{}, nil
+	case 2:
+		return &VacuumStmt{Table: tokens[1]}, nil
+	}
+	return nil, fmt.Errorf("invalid VACUUM syntax")
+}
+
 func parseInsert(tokens []string) (*InsertStmt, error) {
 	// INSERT INTO tablename (col1, col2) VALUES (val1, val2)
 	if len(tokens) < 4 || strings.ToUpper(tokens[1]) != "INTO" {
@@ -238,6 +822,7 @@ func parseSelect(tokens []string) (*SelectStmt, error) {
 	// SELECT * FROM table1 JOIN table2 ON table1.id = table2.id
 	stmt := &SelectStmt{
 		Columns: make([]string, 0),
+		Limit:   -1,
 	}
 
 	i := 1
@@ -258,7 +843,23 @@ func parseSelect(tokens []string) (*SelectStmt, error) {
 	stmt.Table = tokens[i]
 	i++
 
-	// Check for JOIN
+	// AS OF TIMESTAMP 'time' reads every table of the query as of then
+	if i+1 < len(tokens) && strings.ToUpper(tokens[i]) == "AS" && strings.ToUpper(tokens[i+1]) == "OF" {
+		at, err := parseAsOf(tokens[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.AsOf = at
+		i += 4
+	}
+
+	// Check for [INNER] JOIN
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "INNER" {
+		i++
+		if i >= len(tokens) || strings.ToUpper(tokens[i]) != "JOIN" {
+			return nil, fmt.Errorf("expected JOIN after INNER")
+		}
+	}
 	if i < len(tokens) && strings.ToUpper(tokens[i]) == "JOIN" {
 		i++
 		if i >= len(tokens) {
@@ -270,30 +871,89 @@ func parseSelect(tokens []string) (*SelectStmt, error) {
 		}
 		i++
 
-		if i < len(tokens) && strings.ToUpper(tokens[i]) == "ON" {
-			i++
-			// Parse ON condition: table1.col = table2.col
-			if i+2 < len(tokens) {
-				leftParts := strings.Split(tokens[i], ".")
-				if len(leftParts) == 2 {
-					join.LeftCol = leftParts[0] + "." + leftParts[1]
-				}
-				i++ // skip =
-				i++
-				rightParts := strings.Split(tokens[i], ".")
-				if len(rightParts) == 2 {
-					join.RightCol = rightParts[0] + "." + rightParts[1]
-				}
-				i++
-			}
+		// Parse ON condition: table1.col = table2.col
+		if i+3 >= len(tokens) || strings.ToUpper(tokens[i]) != "ON" || tokens[i+2] != "=" {
+			return nil, fmt.Errorf("JOIN requires ON table1.col = table2.col")
+		}
+		join.LeftCol = tokens[i+1]
+		join.RightCol = tokens[i+3]
+		if !strings.Contains(join.LeftCol, ".") || !strings.Contains(join.RightCol, ".") {
+			return nil, fmt.Errorf("JOIN columns must be qualified as table.column")
 		}
+		i += 4
 
 		stmt.Join = join
 	}
 
 	// Parse WHERE
 	if i < len(tokens) && strings.ToUpper(tokens[i]) == "WHERE" {
-		stmt.Where = parseWhere(tokens[i+1:])
+		where, n, err := parseWhere(tokens[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+		i += 1 + n
+	}
+
+	// Parse ORDER BY col [ASC|DESC], ...
+	if i+1 < len(tokens) && strings.ToUpper(tokens[i]) == "ORDER" && strings.ToUpper(tokens[i+1]) == "BY" {
+		i += 2
+		for i < len(tokens) && strings.ToUpper(tokens[i]) != "LIMIT" && strings.ToUpper(tokens[i]) != "FOR" {
+			item := OrderByItem{Column: tokens[i]}
+			i++
+			if i < len(tokens) {
+				switch strings.ToUpper(tokens[i]) {
+				case "DESC":
+					item.Desc = true
+					i++
+				case "ASC":
+					i++
+				}
+			}
+			stmt.OrderBy = append(stmt.OrderBy, item)
+		}
+		if len(stmt.OrderBy) == 0 {
+			return nil, fmt.Errorf("missing ORDER BY columns")
+		}
+	}
+
+	// Parse LIMIT n
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "LIMIT" {
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("missing LIMIT value")
+		}
+		limit, err := strconv.Atoi(tokens[i+1])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid LIMIT: %s", tokens[i+1])
+		}
+		stmt.Limit = limit
+		i += 2
+	}
+
+	// Parse FOR UPDATE | FOR SHARE
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "FOR" {
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("expected UPDATE or SHARE after FOR")
+		}
+		switch strings.ToUpper(tokens[i+1]) {
+		case "UPDATE":
+			stmt.Lock = lockX
+		case "SHARE":
+			stmt.Lock = lockS
+		default:
+			return nil, fmt.Errorf("expected UPDATE or SHARE after FOR")
+		}
+		i += 2
+		switch {
+		case stmt.Join != nil:
+			return nil, fmt.Errorf("FOR %s is not supported with JOIN", strings.ToUpper(tokens[i-1]))
+		case !stmt.AsOf.IsZero():
+			return nil, fmt.Errorf("FOR %s is not supported with AS OF", strings.ToUpper(tokens[i-1]))
+		}
+	}
+
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s in SELECT", tokens[i])
 	}
 
 	return stmt, nil
@@ -322,14 +982,33 @@ func parseUpdate(tokens []string) (*UpdateStmt, error) {
 		col := tokens[i]
 		i++ // skip =
 		i++
-		val := parseValue(tokens[i])
-		stmt.Updates[col] = val
+		if i >= len(tokens) {
+			return nil, fmt.Errorf("missing value for %s", col)
+		}
+		if isExprText(tokens[i]) {
+			expr, err := compileExpr(tokens[i])
+			if err != nil {
+				return nil, err
+			}
+			stmt.Updates[col] = expr
+		} else {
+			stmt.Updates[col] = parseValue(tokens[i])
+		}
 		i++
 	}
 
 	// Parse WHERE
 	if i < len(tokens) && strings.ToUpper(tokens[i]) == "WHERE" {
-		stmt.Where = parseWhere(tokens[i+1:])
+		where, n, err := parseWhere(tokens[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+		i += 1 + n
+	}
+
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s in UPDATE", tokens[i])
 	}
 
 	return stmt, nil
@@ -346,26 +1025,86 @@ func parseDelete(tokens []string) (*DeleteStmt, error) {
 	}
 
 	// Parse WHERE
-	if len(tokens) > 3 && strings.ToUpper(tokens[3]) == "WHERE" {
-		stmt.Where = parseWhere(tokens[4:])
+	i := 3
+	if i < len(tokens) && strings.ToUpper(tokens[i]) == "WHERE" {
+		where, n, err := parseWhere(tokens[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+		i += 1 + n
+	}
+
+	if i < len(tokens) {
+		return nil, fmt.Errorf("unexpected %s in DELETE", tokens[i])
 	}
 
 	return stmt, nil
 }
 
-func parseWhere(tokens []string) *WhereClause {
+// parseWhere parses predicates joined by AND and returns how many tokens it
+// used.
+func parseWhere(tokens []string) (*WhereClause, int, error) {
+	where, n, err := parsePredicate(tokens)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if n < len(tokens) && strings.ToUpper(tokens[n]) == "AND" {
+		next, m, err := parseWhere(tokens[n+1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		where.Next = next
+		n += 1 + m
+	}
+
+	return where, n, nil
+}
+
+func parsePredicate(tokens []string) (*WhereClause, int, error) {
 	if len(tokens) < 3 {
-		return nil
+		return nil, 0, fmt.Errorf("incomplete WHERE clause")
 	}
 
-	return &WhereClause{
+	where := &WhereClause{
 		Column: tokens[0],
-		Op:     tokens[1],
+		Op:     strings.ToUpper(tokens[1]),
 		Value:  parseValue(tokens[2]),
 	}
+
+	switch where.Op {
+	case "=", "!=", "<>", ">", "<", ">=", "<=":
+		if where.Op == "<>" {
+			where.Op = "!="
+		}
+		return where, 3, nil
+	case "LIKE":
+		if _, ok := where.Value.(string); !ok {
+			return nil, 0, fmt.Errorf("LIKE pattern must be a string")
+		}
+		return where, 3, nil
+	case "BETWEEN":
+		if len(tokens) < 5 || strings.ToUpper(tokens[3]) != "AND" {
+			return nil, 0, fmt.Errorf("BETWEEN requires AND")
+		}
+		where.Value2 = parseValue(tokens[4])
+		return where, 5, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported operator: %s", tokens[1])
+	}
 }
 
 func parseValue(s string) interface{} {
+	// Quoted literals are always strings
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		quote := s[:1]
+		return strings.ReplaceAll(s[1:len(s)-1], quote+quote, quote)
+	}
+	if strings.ToUpper(s) == "NULL" {
+		return nil
+	}
+
 	// Try int
 	if val, err := strconv.Atoi(s); err == nil {
 		return val
@@ -376,7 +1115,5 @@ func parseValue(s string) interface{} {
 		return val
 	}
 
-	// String (remove quotes if present)
-	s = strings.Trim(s, "'\"")
 	return s
 }
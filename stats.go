@@ -0,0 +1,180 @@
+package minidb
+
+import (
+	"math"
+	"sort"
+)
+
+// histogramBuckets is the number of equi-depth buckets ANALYZE builds per
+// column.
+const histogramBuckets = 32
+
+// Selectivities assumed for predicates on columns without statistics.
+const (
+	defaultEqSelectivity    = 0.1
+	defaultRangeSelectivity = 1.0 / 3
+	defaultLikeSelectivity  = 0.1
+)
+
+// TableStats is gathered by ANALYZE and drives the planner's cost
+// estimates.
+type TableStats struct {
+	RowCount int
+	Columns  map[string]*ColumnStats
+}
+
+type ColumnStats struct {
+	NullCount int
+	Distinct  int
+	Min       interface{}
+	Max       interface{}
+	// Histogram holds equi-depth bucket boundaries: Histogram[0] is the
+	// minimum and each following bound closes a bucket holding the same
+	// share of non-NULL rows.
+	Histogram []interface{}
+}
+
+// Analyze gathers statistics over the rows visible to tx.
+func (t *Table) Analyze(tx *Tx) *TableStats {
+	snap := tx.snapshot()
+	live := make([]rowTuple, 0, t.rowCount())
+	for i := 0; i < t.rowCount(); i++ {
+		if t.visible(snap, i) {
+			live = append(live, t.tuple(i))
+		}
+	}
+
+	stats := &TableStats{
+		RowCount: len(live),
+		Columns:  make(map[string]*ColumnStats),
+	}
+
+	for ord, col := range t.Columns {
+		cs := &ColumnStats{}
+		values := make([]interface{}, 0, len(live))
+		distinct := make(map[interface{}]bool)
+
+		for _, tuple := range live {
+			val := tuple[ord]
+			if val == nil {
+				cs.NullCount++
+				continue
+			}
+			values = append(values, val)
+			distinct[val] = true
+		}
+		cs.Distinct = len(distinct)
+
+		if len(values) > 0 {
+			sort.SliceStable(values, func(i, j int) bool {
+				return t.compare(col.Name, values[i], values[j]) < 0
+			})
+			cs.Min = values[0]
+			cs.Max = values[len(values)-1]
+
+			buckets := min(histogramBuckets, len(values))
+			cs.Histogram = make([]interface{}, 0, buckets+1)
+			cs.Histogram = append(cs.Histogram, values[0])
+			for b := 1; b <= buckets; b++ {
+				cs.Histogram = append(cs.Histogram, values[b*len(values)/buckets-1])
+			}
+		}
+
+		stats.Columns[col.Name] = cs
+	}
+
+	old := t.stats
+	t.stats = stats
+	tx.undo.log(walChange{Op: walAnalyze, Table: t.Name, Stats: stats}, func() { t.stats = old })
+	return stats
+}
+
+// columnStats returns ANALYZE results for a column, or nil if the table has
+// not been analyzed.
+func (t *Table) columnStats(colName string) *ColumnStats {
+	if t.stats == nil {
+		return nil
+	}
+	return t.stats.Columns[colName]
+}
+
+// distinctValues estimates the number of distinct non-NULL values in a
+// column.
+func (t *Table) distinctValues(colName string) float64 {
+	rows := float64(t.liveRows())
+	if cs := t.columnStats(colName); cs != nil && cs.Distinct > 0 {
+		// Scale to the current table size if rows were added since
+		return math.Max(1, float64(cs.Distinct)*rows/math.Max(1, float64(t.stats.RowCount)))
+	}
+	if index := t.indexOn(colName); index != nil && index.Unique {
+		return math.Max(1, rows)
+	}
+	return math.Max(1, rows*defaultEqSelectivity)
+}
+
+// selectivity estimates the fraction of rows satisfying a predicate.
+func (t *Table) selectivity(pred *WhereClause) float64 {
+	cs := t.columnStats(pred.Column)
+	nonNull := 1.0
+	if cs != nil && t.stats.RowCount > 0 {
+		nonNull = 1 - float64(cs.NullCount)/float64(t.stats.RowCount)
+	}
+
+	switch pred.Op {
+	case "=":
+		if cs == nil {
+			if index := t.indexOn(pred.Column); index != nil && index.Unique {
+				return 1 / math.Max(1, float64(t.liveRows()))
+			}
+			return defaultEqSelectivity
+		}
+		return nonNull / t.distinctValues(pred.Column)
+	case "!=":
+		return nonNull * (1 - 1/t.distinctValues(pred.Column))
+	case ">", ">=", "<", "<=", "BETWEEN", "LIKE":
+		bounds, ok := t.boundsFor(pred)
+		if !ok {
+			return defaultLikeSelectivity
+		}
+		if cs == nil || len(cs.Histogram) < 2 {
+			if pred.Op == "LIKE" {
+				return defaultLikeSelectivity
+			}
+			return defaultRangeSelectivity
+		}
+		lo, hi := 0.0, 1.0
+		if bounds.lo != nil {
+			lo = t.histogramFraction(pred.Column, cs.Histogram, bounds.lo)
+		}
+		if bounds.hi != nil {
+			hi = t.histogramFraction(pred.Column, cs.Histogram, bounds.hi)
+		}
+		// Never estimate zero: statistics may be stale
+		return nonNull * math.Max(hi-lo, 1/math.Max(1, float64(t.stats.RowCount)))
+	}
+	return defaultRangeSelectivity
+}
+
+// histogramFraction estimates the share of non-NULL values below val,
+// interpolating linearly inside a numeric bucket.
+func (t *Table) histogramFraction(colName string, hist []interface{}, val interface{}) float64 {
+	buckets := len(hist) - 1
+	if t.compare(colName, val, hist[0]) <= 0 {
+		return 0
+	}
+	if t.compare(colName, val, hist[buckets]) > 0 {
+		return 1
+	}
+
+	b := sort.Search(buckets, func(i int) bool {
+		return t.compare(colName, hist[i+1], val) >= 0
+	})
+	within := 0.5
+	lo, lok := toFloat(hist[b])
+	hi, hok := toFloat(hist[b+1])
+	v, vok := toFloat(val)
+	if lok && hok && vok && hi > lo {
+		within = (v - lo) / (hi - lo)
+	}
+	return (float64(b) + within) / float64(buckets)
+}
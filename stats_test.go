@@ -0,0 +1,67 @@
+package minidb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// scanEstimate returns the rows EXPLAIN ANALYZE estimates and finds for a
+// full scan of items.
+func scanEstimate(t *testing.T, db *DB) (est, actual interface{}) {
+	t.Helper()
+	rows := mustExec(t, db, "EXPLAIN ANALYZE SELECT * FROM items").Rows
+	return rows[0]["est_rows"], rows[0]["actual_rows"]
+}
+
+// TestEstimatesCountLiveRows checks that the rows a scan is estimated to
+// return leave out the versions updates and deletes left behind, before
+// and after reopening the database.
+func TestEstimatesCountLiveRows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minidb.db")
+	open := func() *DB {
+		db := NewDB(WithStorage(NewWALStorage(path)))
+		if err := db.Load(); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	db := open()
+	mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+	for _, query := range []string{
+		"INSERT INTO items (id, name) VALUES (1, 'a')",
+		"INSERT INTO items (id, name) VALUES (2, 'b')",
+		"INSERT INTO items (id, name) VALUES (3, 'c')",
+		"INSERT INTO items (id, name) VALUES (4, 'd')",
+	} {
+		mustExec(t, db, query)
+	}
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "UPDATE items SET name = 'x'")
+	mustExec(t, db, "UPDATE items SET name = 'y' WHERE id < 3")
+	mustExec(t, db, "DELETE FROM items WHERE id = 4")
+
+	// Changes rolled back leave the estimate as it was
+	tx := db.Begin()
+	if _, err := tx.Exec("INSERT INTO items (id, name) VALUES (5, 'e')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM items WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if est, actual := scanEstimate(t, db); est != 3 || actual != 3 {
+		t.Errorf("estimated %v rows and found %v, want 3 of each", est, actual)
+	}
+	db.Close()
+
+	db = open()
+	defer db.Close()
+	if est, actual := scanEstimate(t, db); est != 3 || actual != 3 {
+		t.Errorf("reopened: estimated %v rows and found %v, want 3 of each", est, actual)
+	}
+}
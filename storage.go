@@ -0,0 +1,187 @@
+package minidb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// storageEngine keeps a database durable. It is implemented only by the
+// engines of this package: WALStorage, JSONStorage and MemoryStorage, plus
+// historyStorage for a database rebuilt as of a point in time. Tables,
+// rows and indexes are read and changed through the DB, which keeps every
+// row version under MVCC, so the engine does not see each table or row
+// operation, nor any scan or index lookup; it sees the database at a few
+// points:
+//
+//   - Load fills an empty database with the tables, rows and indexes the
+//     engine holds. An engine may leave rows on disk, as heap and index
+//     pages that scans and index lookups then read through the tables.
+//     An engine keeping files locks them so no other process writes them,
+//     unless the database is read-only; then it only reads.
+//   - Commit receives the changes of a committing transaction in order:
+//     created and dropped tables, types and indexes, and inserted,
+//     updated and deleted rows. If it fails the transaction is rolled
+//     back. snap sees the database as it is once the commit is visible.
+//   - Sync is called outside the latches when Commit returned a
+//     position still to be made durable, so commits can share an fsync.
+//     The transaction is visible by then, so it stays committed if Sync
+//     fails; the engine should fail every Commit after that.
+//   - Checkpoint folds everything committed so far into the engine's own
+//     storage, and NeedsCheckpoint says when a commit should do so.
+//
+// Commit and NeedsCheckpoint are called with the catalog latch held
+// shared, Commit one at a time in commit order; Checkpoint is called with
+// it held exclusive.
+type storageEngine interface {
+	Load(db *DB) error
+	Commit(db *DB, snap snapshot, changes []walChange) (int64, error)
+	Sync(end int64) error
+	Checkpoint(db *DB) error
+	NeedsCheckpoint() bool
+	Close() error
+}
+
+// Option configures a database created by NewDB.
+type Option func(*DB)
+
+// WithStorage sets where the database keeps its data: a *WALStorage,
+// *JSONStorage or *MemoryStorage. The default is a WALStorage on minidb.db
+// in the working directory.
+func WithStorage(storage storageEngine) Option {
+	return func(db *DB) {
+		db.storage = storage
+	}
+}
+
+// ReadOnly attaches to the database without locking it or ever writing to
+// it, so it works while another process has it open. Statements that
+// write fail, and the database shows what was committed when it loaded.
+func ReadOnly() Option {
+	return func(db *DB) {
+		db.readOnly = true
+	}
+}
+
+// WithStatementTimeout stops any statement that runs longer than timeout,
+// unless its session sets a statement_timeout of its own. Zero, the
+// default, lets statements run as long as they take.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(db *DB) {
+		db.timeout = timeout
+	}
+}
+
+// StorageKinds lists the engines NewInstance accepts, for -storage.
+const StorageKinds = "wal, json or memory"
+
+// storageOpener returns a function opening the engine named kind, keeping
+// its files at a path with the engine's own extension.
+func storageOpener(kind string) (func(path string) storageEngine, error) {
+	switch kind {
+	case "wal":
+		return func(path string) storageEngine { return NewWALStorage(path + ".db") }, nil
+	case "json":
+		return func(path string) storageEngine { return NewJSONStorage(path + ".json") }, nil
+	case "memory":
+		return func(path string) storageEngine { return NewMemoryStorage() }, nil
+	}
+	return nil, fmt.Errorf("unknown storage engine %q; use %s", kind, StorageKinds)
+}
+
+// MemoryStorage keeps nothing: the database starts empty and is lost when
+// the process exits. It suits tests and scratch sessions.
+type MemoryStorage struct{}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (*MemoryStorage) Load(db *DB) error { return nil }
+
+func (*MemoryStorage) Commit(db *DB, snap snapshot, changes []walChange) (int64, error) {
+	return 0, nil
+}
+
+func (*MemoryStorage) Sync(end int64) error    { return nil }
+func (*MemoryStorage) Checkpoint(db *DB) error { return nil }
+func (*MemoryStorage) NeedsCheckpoint() bool   { return false }
+func (*MemoryStorage) Close() error            { return nil }
+
+// JSONStorage keeps the whole database in one JSON snapshot, rewritten
+// atomically by every commit. It needs no log and the file is easy to
+// read, but each commit costs as much as the database is large.
+type JSONStorage struct {
+	path string
+	fs   fileSystem
+	mu   sync.Mutex
+	lsn  uint64
+	lock *fileLock
+}
+
+func NewJSONStorage(path string) *JSONStorage {
+	return &JSONStorage{path: path, fs: osFS{}}
+}
+
+// Load reads the snapshot, upgrading one written by an older version.
+func (js *JSONStorage) Load(db *DB) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if !db.readOnly {
+		lock, err := lockDatabase(strings.TrimSuffix(js.path, filepath.Ext(js.path)) + ".lock")
+		if err != nil {
+			return err
+		}
+		js.lock = lock
+	}
+	lsn, _, err := loadSnapshot(db, js.path)
+	if err != nil {
+		return err
+	}
+	js.lsn = lsn
+	for _, table := range db.tables {
+		table.vacuum(0)
+	}
+	return nil
+}
+
+// Commit writes a snapshot holding the committing transaction, so it is
+// durable before it becomes visible.
+func (js *JSONStorage) Commit(db *DB, snap snapshot, changes []walChange) (int64, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return 0, js.save(db, snap, js.lsn+1)
+}
+
+// Checkpoint rewrites the snapshot from what is committed.
+func (js *JSONStorage) Checkpoint(db *DB) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.save(db, db.txm.latest(), js.lsn)
+}
+
+func (js *JSONStorage) save(db *DB, snap snapshot, lsn uint64) error {
+	body, err := encodeSnapshot(db, snap, lsn)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(js.fs, js.path, body); err != nil {
+		return err
+	}
+	js.lsn = lsn
+	return nil
+}
+
+func (*JSONStorage) Sync(end int64) error  { return nil }
+func (*JSONStorage) NeedsCheckpoint() bool { return false }
+
+func (js *JSONStorage) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	err := js.lock.unlock()
+	js.lock = nil
+	return err
+}
@@ -0,0 +1,104 @@
+package minidb
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordingStorage keeps nothing, like MemoryStorage, but records the
+// changes of each commit, and fails commits once fail is set.
+type recordingStorage struct {
+	MemoryStorage
+	loaded  bool
+	commits [][]walChange
+	fail    bool
+}
+
+func (rs *recordingStorage) Load(db *DB) error {
+	rs.loaded = true
+	return nil
+}
+
+func (rs *recordingStorage) Commit(db *DB, snap snapshot, changes []walChange) (int64, error) {
+	if rs.fail {
+		return 0, errors.New("commit failed")
+	}
+	rs.commits = append(rs.commits, changes)
+	return 0, nil
+}
+
+func TestPluggedStorage(t *testing.T) {
+	storage := &recordingStorage{}
+	db := newTestDB(t, WithStorage(storage))
+	if !storage.loaded {
+		t.Fatal("Load was not called")
+	}
+	mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+	mustExec(t, db, "INSERT INTO items (id, name) VALUES (1, 'pen')")
+	mustExec(t, db, "UPDATE items SET name = 'ink' WHERE id = 1")
+	mustExec(t, db, "DELETE FROM items WHERE id = 1")
+
+	var ops []string
+	for _, changes := range storage.commits {
+		for _, c := range changes {
+			ops = append(ops, c.Op)
+		}
+	}
+	want := []string{walCreateTable, walInsert, walDelete, walInsert, walDelete}
+	if len(ops) != len(want) {
+		t.Fatalf("engine received %v, want %v", ops, want)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Fatalf("engine received %v, want %v", ops, want)
+		}
+	}
+
+	// A commit the engine refuses is rolled back
+	storage.fail = true
+	if _, err := db.Exec("INSERT INTO items (id, name) VALUES (2, 'pad')"); err == nil {
+		t.Fatal("commit the engine refused: no error")
+	}
+	storage.fail = false
+	if rows := mustExec(t, db, "SELECT * FROM items").Rows; len(rows) != 0 {
+		t.Errorf("refused commit left %v", rows)
+	}
+}
+
+// TestStorageKinds reopens a database kept with each engine that writes
+// files and checks its rows are still there.
+func TestStorageKinds(t *testing.T) {
+	for _, kind := range []string{"wal", "json"} {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			instance, err := NewInstance(dir, kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := instance.Open("shop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+			mustExec(t, db, "INSERT INTO items (id, name) VALUES (1, 'pen')")
+			mustExec(t, db, "INSERT INTO items (id, name) VALUES (2, 'ink')")
+			mustExec(t, db, "DELETE FROM items WHERE id = 1")
+			if err := instance.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			instance, err = NewInstance(dir, kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer instance.Close()
+			if db, err = instance.Database("shop"); err != nil {
+				t.Fatal(err)
+			}
+			rows := mustExec(t, db, "SELECT * FROM items").Rows
+			if len(rows) != 1 || rows[0]["name"] != "ink" {
+				t.Errorf("reopened with %v, want only ink", rows)
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
-package main
+package minidb
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type DataType int
@@ -10,6 +13,8 @@ const (
 	TypeInt DataType = iota
 	TypeString
 	TypeFloat
+	TypeJSON
+	TypeEnum
 )
 
 type Column struct {
@@ -18,53 +23,142 @@ type Column struct {
 	PrimaryKey bool
 	Unique     bool
 	NotNull    bool
+	EnumType   string
 }
 
 type Row map[string]interface{}
 
+// Table positions number every version of every row. The versions in the
+// data file come first and are read through the buffer pool; those written
+// since the last checkpoint follow in tuples. A position identifies its
+// version until a checkpoint or compact renumbers them.
 type Table struct {
-	Name       string
-	Columns    []Column
-	Rows       []Row
-	nextID     int
-	indexes    map[string]map[interface{}][]int // column -> value -> row indices
-	primaryKey string
+	latch        sync.RWMutex // held by statements reading or changing the table
+	Name         string
+	Columns      []Column
+	ordinals     map[string]int      // column name -> position in a tuple
+	tuples       []rowTuple          // versions from position baseRows() on
+	versions     []*rowVersion       // versions[i] describes tuples[i]
+	base         *heapFile           // versions in the data file, if any
+	baseVersions map[int]*rowVersion // base versions not yet visible to everyone
+	mgr          *txManager
+	nextID       int
+	indexes      map[string]*tableIndex // index name -> index
+	primaryKey   string
+	types        map[string]*EnumType
+	stats        *TableStats
+	tombstones   int // positions in tuples whose version is gone
+	live         int // versions no one deleted, which estimates count as rows
 }
 
-func NewTable(name string, columns []Column) *Table {
+func newTable(name string, columns []Column) *Table {
 	t := &Table{
-		Name:    name,
-		Columns: columns,
-		Rows:    make([]Row, 0),
-		nextID:  1,
-		indexes: make(map[string]map[interface{}][]int),
+		Name:         name,
+		Columns:      columns,
+		ordinals:     make(map[string]int, len(columns)),
+		tuples:       make([]rowTuple, 0),
+		baseVersions: make(map[int]*rowVersion),
+		nextID:       1,
+		indexes:      make(map[string]*tableIndex),
+	}
+
+	for i, col := range columns {
+		t.ordinals[col.Name] = i
 	}
 
 	// Create indexes for primary and unique columns
 	for _, col := range columns {
+		var index *tableIndex
 		if col.PrimaryKey {
 			t.primaryKey = col.Name
-			t.indexes[col.Name] = make(map[interface{}][]int)
+			index = newIndex(name+"_pkey", []string{col.Name}, true)
 		} else if col.Unique {
-			t.indexes[col.Name] = make(map[interface{}][]int)
+			index = newIndex(name+"_"+col.Name+"_key", []string{col.Name}, true)
+		} else {
+			continue
 		}
+		index.Implicit = true
+		index.ords = t.ordinalsOf(index.Columns)
+		t.indexes[index.Name] = index
 	}
 
 	return t
 }
 
-func (t *Table) Insert(values Row) error {
+func (t *Table) CreateIndex(name string, columns []string, unique bool, kind string) error {
+	if _, exists := t.indexes[name]; exists {
+		return fmt.Errorf("index %s already exists", name)
+	}
+	for _, col := range columns {
+		if _, exists := t.column(col); !exists {
+			return &NotFoundError{Kind: "column", Name: col, Table: t.Name}
+		}
+	}
+
+	index := newIndex(name, columns, unique)
+	if kind == IndexBTree {
+		index = newBTreeIndex(name, columns, unique, t.compare)
+	}
+	index.ords = t.ordinalsOf(columns)
+	// Versions that are gone for good cannot violate uniqueness
+	dead := func(i int) bool { return !t.mayBeLive(i, 0) }
+	if err := index.rebuild(t, dead); err != nil {
+		return err
+	}
+	t.indexes[name] = index
+	return nil
+}
+
+func (t *Table) DropIndex(name string) error {
+	index, exists := t.indexes[name]
+	if !exists {
+		return &NotFoundError{Kind: "index", Name: name}
+	}
+	if index.Implicit {
+		return fmt.Errorf("cannot drop index %s: it backs a PRIMARY KEY or UNIQUE constraint", name)
+	}
+	delete(t.indexes, name)
+	return nil
+}
+
+// IndexDefs lists the indexes created with CREATE INDEX, for persistence.
+func (t *Table) IndexDefs() []IndexDef {
+	defs := make([]IndexDef, 0)
+	for _, index := range t.indexes {
+		if !index.Implicit {
+			defs = append(defs, index.Def())
+		}
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// indexOn returns an index whose only column is colName, preferring
+// unique indexes.
+func (t *Table) indexOn(colName string) *tableIndex {
+	var found *tableIndex
+	for _, index := range t.indexes {
+		if len(index.Columns) == 1 && index.Columns[0] == colName {
+			if index.Unique {
+				return index
+			}
+			found = index
+		}
+	}
+	return found
+}
+
+func (t *Table) Insert(tx *Tx, values Row) error {
 	// Validate columns
-	row := make(Row)
+	tuple := make(rowTuple, len(t.Columns))
 
-	for _, col := range t.Columns {
+	for i, col := range t.Columns {
 		val, exists := values[col.Name]
 
-		if !exists {
+		if !exists || val == nil {
 			if col.NotNull {
-				return fmt.Errorf("column %s cannot be null", col.Name)
+				return notNullError(t, col.Name)
 			}
-			row[col.Name] = nil
 			continue
 		}
 
@@ -72,28 +166,37 @@ func (t *Table) Insert(values Row) error {
 		if err := t.validateType(col, val); err != nil {
 			return err
 		}
-
-		// Check unique/primary key constraints
-		if col.PrimaryKey || col.Unique {
-			if t.valueExists(col.Name, val) {
-				return fmt.Errorf("duplicate value for %s: %v", col.Name, val)
+		if col.Type == TypeJSON && val != nil {
+			normalized, err := normalizeJSON(val)
+			if err != nil {
+				return err
 			}
+			val = normalized
 		}
 
-		row[col.Name] = val
+		tuple[i] = val
 	}
 
-	// Add row
-	rowIdx := len(t.Rows)
-	t.Rows = append(t.Rows, row)
+	// Check unique/primary key constraints
+	if err := t.checkUnique(tx, tuple, nil); err != nil {
+		return err
+	}
+
+	t.appendVersion(tx, tuple)
+	return nil
+}
 
-	// Update indexes
-	for colName, index := range t.indexes {
-		if val, exists := row[colName]; exists && val != nil {
-			index[val] = append(index[val], rowIdx)
+// checkUnique checks row against every version that is or may become live,
+// except those at positions in skip.
+func (t *Table) checkUnique(tx *Tx, tuple rowTuple, skip map[int]bool) error {
+	ignore := func(i int) bool {
+		return skip[i] || !t.mayBeLive(i, tx.state.id)
+	}
+	for _, index := range t.indexes {
+		if index.conflicts(tuple, ignore) {
+			return uniqueError(t, index, tuple)
 		}
 	}
-
 	return nil
 }
 
@@ -111,226 +214,401 @@ func (t *Table) validateType(col Column, val interface{}) error {
 		if _, ok := val.(float64); !ok {
 			return fmt.Errorf("invalid type for %s: expected float", col.Name)
 		}
+	case TypeJSON:
+		text, ok := val.(string)
+		if !ok {
+			return fmt.Errorf("invalid type for %s: expected JSON text", col.Name)
+		}
+		if _, err := decodeJSON(text); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", col.Name, err)
+		}
+	case TypeEnum:
+		enum, exists := t.types[col.EnumType]
+		if !exists {
+			return &NotFoundError{Kind: "type", Name: col.EnumType}
+		}
+		return enum.Validate(col.Name, val)
 	}
 	return nil
 }
 
-func (t *Table) valueExists(colName string, val interface{}) bool {
-	if index, exists := t.indexes[colName]; exists {
-		if _, found := index[val]; found {
-			return true
+// useTypes gives the table the enum types of its columns out of the
+// catalog's. A type never changes once created, so the table's own map is
+// never written to again, and a cursor reading between latches can compare
+// values while CREATE TYPE adds to the catalog.
+func (t *Table) useTypes(types map[string]*EnumType) {
+	t.types = make(map[string]*EnumType)
+	for _, col := range t.Columns {
+		if enum, exists := types[col.EnumType]; exists && col.Type == TypeEnum {
+			t.types[col.EnumType] = enum
 		}
 	}
-	return false
 }
 
-func (t *Table) Select(columns []string, where *WhereClause) []Row {
-	result := make([]Row, 0)
+func (t *Table) column(name string) (Column, bool) {
+	for _, col := range t.Columns {
+		if col.Name == name {
+			return col, true
+		}
+	}
+	return Column{}, false
+}
 
-	// If WHERE clause uses indexed column with equality, use index
-	if where != nil && where.Op == "=" {
-		if index, indexed := t.indexes[where.Column]; indexed {
-			if indices, found := index[where.Value]; found {
-				for _, idx := range indices {
-					if t.matchesWhere(t.Rows[idx], where) {
-						result = append(result, t.projectRow(t.Rows[idx], columns))
-					}
-				}
-				return result
+// compare orders two values of the given column, using declaration order
+// for enum columns.
+func (t *Table) compare(colName string, a, b interface{}) int {
+	if col, ok := t.column(colName); ok && col.Type == TypeEnum {
+		if enum, exists := t.types[col.EnumType]; exists {
+			as, aok := a.(string)
+			bs, bok := b.(string)
+			if aok && bok {
+				return enum.Ordinal(as) - enum.Ordinal(bs)
 			}
 		}
 	}
+	return compareValues(a, b)
+}
 
-	// Full table scan
-	for _, row := range t.Rows {
-		if t.matchesWhere(row, where) {
-			result = append(result, t.projectRow(row, columns))
+func (t *Table) matchesWhere(row Row, where *WhereClause) (bool, error) {
+	for w := where; w != nil; w = w.Next {
+		if ok, err := t.matchesPredicate(row, w); !ok || err != nil {
+			return false, err
 		}
 	}
-
-	return result
+	return true, nil
 }
 
-func (t *Table) matchesWhere(row Row, where *WhereClause) bool {
-	if where == nil {
-		return true
+func (t *Table) matchesPredicate(row Row, where *WhereClause) (bool, error) {
+	val, exists, err := lookupValue(row, where.Column)
+	if err != nil {
+		return false, err
 	}
-
-	val, exists := row[where.Column]
-	if !exists {
-		return false
+	if !exists || val == nil || where.comparesNull() {
+		// NULL never satisfies a comparison
+		return false, nil
 	}
+	return t.testValue(where, val), nil
+}
 
+// testValue reports whether val, which is not NULL, satisfies where.
+func (t *Table) testValue(where *WhereClause, val interface{}) bool {
 	switch where.Op {
 	case "=":
 		return val == where.Value
 	case ">":
-		return compareValues(val, where.Value) > 0
+		return t.compare(where.Column, val, where.Value) > 0
 	case "<":
-		return compareValues(val, where.Value) < 0
+		return t.compare(where.Column, val, where.Value) < 0
 	case ">=":
-		return compareValues(val, where.Value) >= 0
+		return t.compare(where.Column, val, where.Value) >= 0
 	case "<=":
-		return compareValues(val, where.Value) <= 0
+		return t.compare(where.Column, val, where.Value) <= 0
 	case "!=":
 		return val != where.Value
+	case "BETWEEN":
+		return t.compare(where.Column, val, where.Value) >= 0 && t.compare(where.Column, val, where.Value2) <= 0
+	case "LIKE":
+		s, ok := val.(string)
+		return ok && likeMatch(s, where.Value.(string))
 	}
 
 	return false
 }
 
 func compareValues(a, b interface{}) int {
-	switch av := a.(type) {
-	case int:
-		bv := b.(int)
-		if av < bv {
+	// NULL sorts first; mixed INT/FLOAT compares numerically
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		} else if a == nil {
 			return -1
-		} else if av > bv {
-			return 1
 		}
-		return 0
-	case float64:
-		bv := b.(float64)
-		if av < bv {
-			return -1
-		} else if av > bv {
-			return 1
+		return 1
+	}
+	if af, aok := toFloat(a); aok {
+		if bf, bok := toFloat(b); bok {
+			if af < bf {
+				return -1
+			} else if af > bf {
+				return 1
+			}
+			return 0
 		}
-		return 0
-	case string:
-		bv := b.(string)
-		if av < bv {
-			return -1
-		} else if av > bv {
-			return 1
+	}
+
+	if as, ok := a.(string); ok {
+		if bs, ok := b.(string); ok {
+			return strings.Compare(as, bs)
 		}
-		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// sortKey is a row's values for the items of an ORDER BY.
+type sortKey []interface{}
+
+// sortKeyOf evaluates orderBy against row.
+func sortKeyOf(row Row, orderBy []OrderByItem) (sortKey, error) {
+	key := make(sortKey, len(orderBy))
+	for i, item := range orderBy {
+		val, _, err := lookupValue(row, item.Column)
+		if err != nil {
+			return nil, err
+		}
+		key[i] = val
+	}
+	return key, nil
+}
+
+// sortRows stably sorts rows by orderBy and returns their keys in the new
+// order. Each row's key is evaluated once, before sorting, so an
+// expression that fails is an error rather than a NULL.
+func (t *Table) sortRows(rows []Row, orderBy []OrderByItem) ([]sortKey, error) {
+	keys := make([]sortKey, len(rows))
+	for i, row := range rows {
+		key, err := sortKeyOf(row, orderBy)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	sort.Stable(&rowSorter{table: t, orderBy: orderBy, rows: rows, keys: keys})
+	return keys, nil
+}
+
+// rowSorter sorts rows together with their keys.
+type rowSorter struct {
+	table   *Table
+	orderBy []OrderByItem
+	rows    []Row
+	keys    []sortKey
+}
+
+func (s *rowSorter) Len() int { return len(s.rows) }
+
+func (s *rowSorter) Less(i, j int) bool {
+	return s.table.compareKeys(s.keys[i], s.keys[j], s.orderBy) < 0
+}
+
+func (s *rowSorter) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// compareKeys orders two sort keys by orderBy.
+func (t *Table) compareKeys(a, b sortKey, orderBy []OrderByItem) int {
+	for i, item := range orderBy {
+		cmp := t.compare(item.Column, a[i], b[i])
+		if cmp == 0 {
+			continue
+		}
+		if item.Desc {
+			return -cmp
+		}
+		return cmp
 	}
 	return 0
 }
 
-func (t *Table) projectRow(row Row, columns []string) Row {
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func (t *Table) projectRow(row Row, columns []string) (Row, error) {
 	if len(columns) == 1 && columns[0] == "*" {
-		return row
+		return row, nil
 	}
 
 	result := make(Row)
 	for _, col := range columns {
-		if val, exists := row[col]; exists {
+		val, exists, err := lookupValue(row, col)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
 			result[col] = val
 		}
 	}
-	return result
+	return result, nil
 }
 
-func (t *Table) Update(updates map[string]interface{}, where *WhereClause) int {
-	count := 0
+func (t *Table) Update(tx *Tx, updates map[string]interface{}, where *WhereClause) (int, error) {
+	// Compute and validate every new value before touching any row, so a
+	// bad value leaves the table unchanged
+	matched := make([]int, 0)
+	newValues := make([]map[string]interface{}, 0)
 
-	for i, row := range t.Rows {
-		if t.matchesWhere(row, where) {
-			for col, val := range updates {
-				// Remove old index entry
-				if index, indexed := t.indexes[col]; indexed {
-					if oldVal, exists := row[col]; exists {
-						t.removeFromIndex(index, oldVal, i)
-					}
+	positions, err := t.matchingPositions(tx.ctx, tx.snapshot(), where)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range positions {
+		if err := t.lockRow(tx, i, lockX); err != nil {
+			return 0, err
+		}
+		if err := t.checkWritable(tx, i); err != nil {
+			return 0, err
+		}
+		var row Row
+
+		values := make(map[string]interface{}, len(updates))
+		for colName, val := range updates {
+			if expr, ok := val.(*scalarExpr); ok {
+				// Expressions read columns by name
+				if row == nil {
+					row = t.row(i)
 				}
+				var err error
+				if val, err = expr.Eval(row); err != nil {
+					return 0, err
+				}
+			}
 
-				row[col] = val
-
-				// Add new index entry
-				if index, indexed := t.indexes[col]; indexed {
-					index[val] = append(index[val], i)
+			col, exists := t.column(colName)
+			if !exists {
+				return 0, &NotFoundError{Kind: "column", Name: colName}
+			}
+			if val == nil {
+				if col.NotNull {
+					return 0, notNullError(t, col.Name)
+				}
+			} else {
+				if err := t.validateType(col, val); err != nil {
+					return 0, err
+				}
+				if col.Type == TypeJSON {
+					normalized, err := normalizeJSON(val)
+					if err != nil {
+						return 0, err
+					}
+					val = normalized
 				}
 			}
-			count++
+			values[colName] = val
 		}
-	}
-
-	return count
-}
 
-func (t *Table) Delete(where *WhereClause) int {
-	newRows := make([]Row, 0)
-	count := 0
+		matched = append(matched, i)
+		newValues = append(newValues, values)
+	}
 
-	for _, row := range t.Rows {
-		if t.matchesWhere(row, where) {
-			count++
-			// Remove from indexes
-			for colName, index := range t.indexes {
-				if val, exists := row[colName]; exists {
-					t.removeFromIndex(index, val, len(newRows))
-				}
+	// Unique indexes must hold both against untouched rows and among the
+	// updated rows themselves
+	skip := make(map[int]bool, len(matched))
+	for _, i := range matched {
+		skip[i] = true
+	}
+	seen := make(map[string]map[interface{}]bool)
+	for n, i := range matched {
+		updated := t.merge(t.tuple(i), newValues[n])
+		if err := t.checkUnique(tx, updated, skip); err != nil {
+			return 0, err
+		}
+		for _, index := range t.indexes {
+			if !index.Unique || !touchesIndex(index, updates) {
+				continue
 			}
-		} else {
-			newRows = append(newRows, row)
+			key, ok := index.key(updated)
+			if !ok {
+				continue
+			}
+			if seen[index.Name] == nil {
+				seen[index.Name] = make(map[interface{}]bool)
+			}
+			if seen[index.Name][key] {
+				return 0, uniqueError(t, index, updated)
+			}
+			seen[index.Name][key] = true
 		}
 	}
 
-	t.Rows = newRows
-
-	// Rebuild indexes
-	t.rebuildIndexes()
+	// Each updated row gets a new version; the old one stays for readers
+	// whose snapshot predates this change
+	for n, i := range matched {
+		if err := t.deleteVersion(tx, i); err != nil {
+			return 0, err
+		}
+		t.appendVersion(tx, t.merge(t.tuple(i), newValues[n]))
+	}
 
-	return count
+	return len(matched), nil
 }
 
-func (t *Table) removeFromIndex(index map[interface{}][]int, val interface{}, rowIdx int) {
-	if indices, found := index[val]; found {
-		newIndices := make([]int, 0)
-		for _, idx := range indices {
-			if idx != rowIdx {
-				newIndices = append(newIndices, idx)
-			}
-		}
-		if len(newIndices) > 0 {
-			index[val] = newIndices
-		} else {
-			delete(index, val)
+func touchesIndex(index *tableIndex, values map[string]interface{}) bool {
+	for _, col := range index.Columns {
+		if _, changed := values[col]; changed {
+			return true
 		}
 	}
+	return false
 }
 
-func (t *Table) rebuildIndexes() {
-	// Clear indexes
-	for colName := range t.indexes {
-		t.indexes[colName] = make(map[interface{}][]int)
+// merge returns a copy of tuple with the named columns set to values.
+func (t *Table) merge(tuple rowTuple, values map[string]interface{}) rowTuple {
+	merged := make(rowTuple, len(tuple))
+	copy(merged, tuple)
+	for name, v := range values {
+		merged[t.ordinals[name]] = v
 	}
+	return merged
+}
 
-	// Rebuild
-	for i, row := range t.Rows {
-		for colName, index := range t.indexes {
-			if val, exists := row[colName]; exists && val != nil {
-				index[val] = append(index[val], i)
-			}
+func (t *Table) Delete(tx *Tx, where *WhereClause) (int, error) {
+	positions, err := t.matchingPositions(tx.ctx, tx.snapshot(), where)
+	if err != nil {
+		return 0, err
+	}
+	for _, i := range positions {
+		if err := t.lockRow(tx, i, lockX); err != nil {
+			return 0, err
+		}
+		if err := t.deleteVersion(tx, i); err != nil {
+			return 0, err
 		}
 	}
+	return len(positions), nil
 }
 
-func (t *Table) Join(right *Table, leftCol, rightCol string, columns []string, where *WhereClause) []Row {
-	result := make([]Row, 0)
-
-	for _, leftRow := range t.Rows {
-		leftVal := leftRow[leftCol]
+func (t *Table) rebuildIndexes() {
+	for _, index := range t.indexes {
+		// Rows already satisfied every constraint when they were written
+		_ = index.rebuild(t, nil)
+	}
+}
 
-		for _, rightRow := range right.Rows {
-			if rightRow[rightCol] == leftVal {
-				// Merge rows
-				merged := make(Row)
-				for k, v := range leftRow {
-					merged[t.Name+"."+k] = v
-				}
-				for k, v := range rightRow {
-					merged[right.Name+"."+k] = v
-				}
+// restoreIndex puts back an index dropped earlier. If a checkpoint
+// replaced the data file meanwhile, its entries there are stale, so it is
+// rebuilt from memory alone until the next checkpoint.
+func (t *Table) restoreIndex(index *tableIndex) {
+	if index.paged != nil && (t.base == nil || index.paged.file != t.base.file) {
+		index.paged, index.base = nil, 0
+	}
+	t.indexes[index.Name] = index
+	_ = index.rebuild(t, nil)
+}
 
-				if t.matchesWhere(merged, where) {
-					result = append(result, t.projectRow(merged, columns))
-				}
-			}
-		}
+// baseRows returns how many versions are in the data file.
+func (t *Table) baseRows() int {
+	if t.base == nil {
+		return 0
 	}
+	return t.base.count
+}
+
+// rowCount returns how many positions hold a version, dead or alive.
+// Scans walk all of them.
+func (t *Table) rowCount() int {
+	return t.baseRows() + len(t.tuples)
+}
 
-	return result
+// liveRows returns how many versions no transaction deleted, for
+// estimating how many rows a statement sees. Deletes and inserts count as
+// soon as they are made, and stop counting if they roll back.
+func (t *Table) liveRows() int {
+	return t.live
 }
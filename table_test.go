@@ -0,0 +1,81 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestUpdateExpressionErrors(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE events (id INT PRIMARY KEY, meta JSON)")
+	mustExec(t, db, `INSERT INTO events (id, meta) VALUES (1, '{"a": 1}')`)
+
+	for _, query := range []string{
+		"UPDATE events SET meta = json_set(meta, 'a.b', 1) WHERE id = 1",
+		"UPDATE events SET meta = json_set(meta, '$.a.b', 1) WHERE id = 1",
+		"UPDATE events SET meta = json_set(nosuch, '$.a', 1) WHERE id = 1",
+	} {
+		if _, err := db.Exec(query); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+	var notFound *NotFoundError
+	if _, err := db.Exec("UPDATE events SET meta = json_set(nosuch, '$.a', 1)"); !errors.As(err, &notFound) || notFound.Name != "nosuch" {
+		t.Errorf("unknown column: got %v, want a NotFoundError for nosuch", err)
+	}
+
+	rows := mustExec(t, db, "SELECT * FROM events WHERE id = 1").Rows
+	if got := rows[0]["meta"]; got != `{"a":1}` {
+		t.Errorf("meta is %v after failed updates, want it unchanged", got)
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE events (id INT PRIMARY KEY, meta JSON)")
+	mustExec(t, db, "CREATE TABLE tags (id INT PRIMARY KEY, event_id INT)")
+	mustExec(t, db, `INSERT INTO events (id, meta) VALUES (1, '{"a": 1}')`)
+	mustExec(t, db, `INSERT INTO events (id, meta) VALUES (2, NULL)`)
+	mustExec(t, db, "INSERT INTO tags (id, event_id) VALUES (1, 1)")
+
+	// A bad path or an unknown column fails the statement rather than
+	// reading as NULL
+	for _, query := range []string{
+		"SELECT * FROM events WHERE json_extract(meta, 'a') = 1",
+		"SELECT * FROM events WHERE id = 1 AND json_extract(nosuch, '$.a') = 1",
+		"SELECT * FROM events JOIN tags ON events.id = tags.event_id WHERE json_extract(meta, 'a') = 1",
+		"SELECT id, json_extract(meta, 'a') FROM events",
+		"SELECT id FROM events ORDER BY json_extract(meta, 'a')",
+		"SELECT id FROM events ORDER BY meta->>",
+		"DELETE FROM events WHERE json_extract(meta, 'a') = 1",
+		"UPDATE events SET id = 3 WHERE json_extract(meta, 'a') = 1",
+	} {
+		if _, err := db.Exec(query); err == nil {
+			t.Errorf("%s: no error", query)
+		}
+	}
+
+	if _, err := db.tables["events"].compile(&WhereClause{Column: "meta->>", Op: "=", Value: 1}); err == nil {
+		t.Error("compiling meta->>: no error")
+	}
+
+	// A NULL document is not an error
+	rows := mustExec(t, db, "SELECT id, json_extract(meta, '$.a') FROM events ORDER BY json_extract(meta, '$.a') DESC").Rows
+	if len(rows) != 2 || rows[0]["id"] != 1 || rows[1]["json_extract(meta, '$.a')"] != nil {
+		t.Errorf("got %v, want event 1 and then event 2 with NULL", rows)
+	}
+}
+
+func TestExprCacheBounded(t *testing.T) {
+	for i := 0; i < 2*exprCacheSize; i++ {
+		if _, err := compileExpr(fmt.Sprintf("json_extract(meta, '$.k%d')", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exprCache.RLock()
+	defer exprCache.RUnlock()
+	if n := len(exprCache.exprs); n > exprCacheSize {
+		t.Errorf("expression cache holds %d entries, want at most %d", n, exprCacheSize)
+	}
+}
@@ -0,0 +1,198 @@
+package minidb
+
+import "fmt"
+
+// rowTuple holds the values of one row version in the order of its table's
+// columns. Tables keep their rows as tuples, and scans test them against
+// predicates that read columns by ordinal; a Row map, keyed by column
+// name, is only built for a row a query returns.
+type rowTuple []interface{}
+
+// ordinal returns the position of the named column, or -1.
+func (t *Table) ordinal(name string) int {
+	if i, ok := t.ordinals[name]; ok {
+		return i
+	}
+	return -1
+}
+
+func (t *Table) ordinalsOf(columns []string) []int {
+	ords := make([]int, len(columns))
+	for i, col := range columns {
+		ords[i] = t.ordinal(col)
+	}
+	return ords
+}
+
+// toTuple takes the values of the table's columns from row; missing
+// columns are NULL.
+func (t *Table) toTuple(row Row) rowTuple {
+	tuple := make(rowTuple, len(t.Columns))
+	for i, col := range t.Columns {
+		tuple[i] = row[col.Name]
+	}
+	return tuple
+}
+
+func (t *Table) toRow(tuple rowTuple) Row {
+	row := make(Row, len(t.Columns))
+	for i, col := range t.Columns {
+		row[col.Name] = tuple[i]
+	}
+	return row
+}
+
+// tuple returns the version at position i. A version in the data file is
+// decoded afresh on each call; a failed read panics with a storageError.
+func (t *Table) tuple(i int) rowTuple {
+	n := t.baseRows()
+	if i >= n {
+		return t.tuples[i-n]
+	}
+	data, err := t.base.tuple(i)
+	if err != nil {
+		panic(storageError{err})
+	}
+	tuple, err := t.decodeTuple(data)
+	if err != nil {
+		panic(storageError{err})
+	}
+	return tuple
+}
+
+// row returns the version at position i as a Row.
+func (t *Table) row(i int) Row {
+	return t.toRow(t.tuple(i))
+}
+
+func (t *Table) decodeTuple(data []byte) (rowTuple, error) {
+	values, err := decodeTuple(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(t.Columns) {
+		return nil, fmt.Errorf("data file is corrupt: table %s has a row of %d values for %d columns", t.Name, len(values), len(t.Columns))
+	}
+	return values, nil
+}
+
+// predicate is a WHERE clause resolved against a table once, before a
+// scan: each term reads its column by ordinal, knows how the column
+// orders, and has its expression compiled.
+type predicate struct {
+	table *Table
+	where *WhereClause // compiled from
+	terms []predicateTerm
+}
+
+type predicateTerm struct {
+	where *WhereClause
+	ord   int         // column read, or -1
+	expr  *scalarExpr // expression read instead of a column, if any
+	enum  *EnumType   // orders the column by declaration, if an enum
+}
+
+// compile resolves where against the table. A nil where matches every
+// row. An expression that does not compile is an error.
+func (t *Table) compile(where *WhereClause) (*predicate, error) {
+	p := &predicate{table: t, where: where}
+	for w := where; w != nil; w = w.Next {
+		term := predicateTerm{where: w, ord: t.ordinal(w.Column)}
+		if term.ord >= 0 {
+			if col := t.Columns[term.ord]; col.Type == TypeEnum {
+				term.enum = t.types[col.EnumType]
+			}
+		} else if isExprText(w.Column) {
+			expr, err := compileExpr(w.Column)
+			if err != nil {
+				return nil, err
+			}
+			term.expr = expr
+		}
+		p.terms = append(p.terms, term)
+	}
+	return p, nil
+}
+
+// matches reports whether tuple satisfies every term, as matchesWhere
+// does for a Row.
+func (p *predicate) matches(tuple rowTuple) (bool, error) {
+	for i := range p.terms {
+		if ok, err := p.holds(&p.terms[i], tuple); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// filter keeps the tuples of batch that satisfy every term, in order,
+// reusing batch. It tests one term against the whole batch before the
+// next, so later terms only see the tuples earlier ones kept.
+func (p *predicate) filter(batch []rowTuple) ([]rowTuple, error) {
+	for i := range p.terms {
+		term := &p.terms[i]
+		kept := batch[:0]
+		for _, tuple := range batch {
+			ok, err := p.holds(term, tuple)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				kept = append(kept, tuple)
+			}
+		}
+		batch = kept
+	}
+	return batch, nil
+}
+
+func (p *predicate) holds(term *predicateTerm, tuple rowTuple) (bool, error) {
+	var val interface{}
+	switch {
+	case term.ord >= 0:
+		val = tuple[term.ord]
+	case term.expr != nil:
+		// Expressions read columns by name
+		var err error
+		if val, err = term.expr.Eval(p.table.toRow(tuple)); err != nil {
+			return false, err
+		}
+	}
+	// NULL never satisfies a comparison
+	return val != nil && !term.where.comparesNull() && term.test(val), nil
+}
+
+func (term *predicateTerm) test(val interface{}) bool {
+	w := term.where
+	switch w.Op {
+	case "=":
+		return val == w.Value
+	case "!=":
+		return val != w.Value
+	case ">":
+		return term.compare(val, w.Value) > 0
+	case "<":
+		return term.compare(val, w.Value) < 0
+	case ">=":
+		return term.compare(val, w.Value) >= 0
+	case "<=":
+		return term.compare(val, w.Value) <= 0
+	case "BETWEEN":
+		return term.compare(val, w.Value) >= 0 && term.compare(val, w.Value2) <= 0
+	case "LIKE":
+		s, ok := val.(string)
+		return ok && likeMatch(s, w.Value.(string))
+	}
+	return false
+}
+
+func (term *predicateTerm) compare(a, b interface{}) int {
+	if term.enum != nil {
+		as, aok := a.(string)
+		bs, bok := b.(string)
+		if aok && bok {
+			return term.enum.Ordinal(as) - term.enum.Ordinal(bs)
+		}
+	}
+	return compareValues(a, b)
+}
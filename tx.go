@@ -0,0 +1,679 @@
+package minidb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// undoLog records how to reverse each change made in a transaction, and
+// the change itself for the write-ahead log. Entries are undone newest
+// first, so each one sees the database exactly as it was right after its
+// change.
+type undoLog struct {
+	entries []undoEntry
+}
+
+type undoEntry struct {
+	undo   func()
+	change *walChange
+}
+
+// log records a change, which reaches the write-ahead log at commit.
+func (u *undoLog) log(change walChange, undo func()) {
+	u.entries = append(u.entries, undoEntry{undo: undo, change: &change})
+}
+
+// changes returns the logged changes that were not undone, in order.
+func (u *undoLog) changes() []walChange {
+	var changes []walChange
+	for _, entry := range u.entries {
+		if entry.change != nil {
+			changes = append(changes, *entry.change)
+		}
+	}
+	return changes
+}
+
+func (u *undoLog) mark() int {
+	return len(u.entries)
+}
+
+func (u *undoLog) rollbackTo(mark int) {
+	for i := len(u.entries) - 1; i >= mark; i-- {
+		u.entries[i].undo()
+	}
+	u.entries = u.entries[:mark]
+}
+
+type savepoint struct {
+	name  string
+	mark  int
+	locks int // locks granted before it
+}
+
+// Tx is an open transaction. Its changes are new row versions that other
+// transactions ignore until it commits, so readers never wait for writers
+// beyond the statement currently running. The rows it changes, or selects
+// FOR UPDATE or FOR SHARE, stay locked until it ends, so writers of the
+// same row take turns. A Tx must not be used from several goroutines at
+// once.
+type Tx struct {
+	db         *DB
+	ctx        context.Context // of the statement running
+	state      *txnState
+	undo       undoLog
+	savepoints []savepoint
+	cursor     *Rows // of the last query, which may still be open
+	wrote      bool
+	ddl        bool // changed the catalog, so undoing it needs mu exclusive
+	done       bool
+}
+
+// Begin starts a READ COMMITTED transaction. Changes made through it are
+// saved together by Commit, or undone together by Rollback.
+func (db *DB) Begin() *Tx {
+	return db.BeginTx(ReadCommitted)
+}
+
+// BeginTx starts a transaction with the given isolation level.
+func (db *DB) BeginTx(level IsolationLevel) *Tx {
+	return &Tx{db: db, ctx: context.Background(), state: db.txm.begin(level)}
+}
+
+// IsolationLevel returns the transaction's isolation level.
+func (tx *Tx) IsolationLevel() IsolationLevel {
+	return tx.state.level
+}
+
+// snapshot returns the snapshot the current statement reads from.
+func (tx *Tx) snapshot() snapshot {
+	m := tx.db.txm
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tx.state.level == ReadCommitted {
+		return snapshot{mgr: m, ts: m.clock, self: tx.state.id}
+	}
+	if tx.state.snapshot == 0 {
+		tx.state.snapshot = m.clock
+	}
+	return snapshot{mgr: m, ts: tx.state.snapshot, self: tx.state.id}
+}
+
+// Exec runs a statement inside the transaction, with args bound to its ?
+// placeholders. SAVEPOINT, RELEASE, ROLLBACK [TO] and COMMIT are accepted
+// as well.
+func (tx *Tx) Exec(query string, args ...interface{}) (*Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is Exec under ctx: the statement stops with an error once
+// ctx is cancelled or the statement timeout runs out, and the transaction
+// stays open.
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (*Result, error) {
+	stmt, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withStatementTimeout(ctx, tx.db.timeout)
+	defer cancel()
+	return tx.run(ctx, stmt)
+}
+
+// Query runs a statement inside the transaction like Exec and returns
+// a cursor over its result. The rows of a SELECT are read as the cursor
+// advances; running anything else in the transaction closes the cursor.
+func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext is Query under ctx: reading from the cursor stops with an
+// error once ctx is cancelled or the statement timeout runs out.
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	stmt, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return openCursor(ctx, tx.db.timeout, stmt, tx.query, tx.run)
+}
+
+// query opens a cursor on a SELECT in the transaction.
+func (tx *Tx) query(ctx context.Context, stmt *SelectStmt) (*Rows, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.closeCursor()
+	tx.ctx = ctx
+
+	for _, name := range statementTables(stmt) {
+		tx.state.reads[name] = true
+	}
+	c, err := tx.db.openSelect(tx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	tx.cursor = c
+	return c, nil
+}
+
+// closeCursor closes the cursor of the last query, since the transaction's
+// next statement may change the rows it reads.
+func (tx *Tx) closeCursor() {
+	if tx.cursor != nil {
+		tx.cursor.Close()
+		tx.cursor = nil
+	}
+}
+
+func (tx *Tx) run(ctx context.Context, stmt Statement) (*Result, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.closeCursor()
+	tx.ctx = ctx
+
+	switch s := stmt.(type) {
+	case *BeginStmt:
+		return nil, fmt.Errorf("a transaction is already in progress")
+	case *CommitStmt:
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return &Result{Message: "COMMIT"}, nil
+	case *RollbackStmt:
+		if s.Savepoint != "" {
+			if err := tx.RollbackTo(s.Savepoint); err != nil {
+				return nil, err
+			}
+			return &Result{Message: fmt.Sprintf("Rolled back to savepoint %s", s.Savepoint)}, nil
+		}
+		if err := tx.Rollback(); err != nil {
+			return nil, err
+		}
+		return &Result{Message: "ROLLBACK"}, nil
+	case *SavepointStmt:
+		if err := tx.Savepoint(s.Name); err != nil {
+			return nil, err
+		}
+		return &Result{Message: fmt.Sprintf("Savepoint %s created", s.Name)}, nil
+	case *ReleaseStmt:
+		if err := tx.Release(s.Name); err != nil {
+			return nil, err
+		}
+		return &Result{Message: fmt.Sprintf("Savepoint %s released", s.Name)}, nil
+	case *SetStmt:
+		return nil, fmt.Errorf("SET needs a session")
+	case *BackupStmt:
+		return nil, fmt.Errorf("BACKUP cannot run inside a transaction")
+	case *VacuumStmt:
+		return nil, fmt.Errorf("VACUUM cannot run inside a transaction")
+	}
+	if at := asOf(stmt); !at.IsZero() {
+		return tx.db.history(ctx, stmt, at)
+	}
+
+	readOnly := isReadOnly(stmt)
+	if !readOnly && tx.db.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	// A statement that has to wait for a lock is undone and waits without
+	// its latches, then runs again. Under READ COMMITTED it then sees what
+	// the holder of the lock committed.
+	for {
+		result, err := tx.execute(stmt)
+		wait, blocked := err.(*lockWait)
+		if blocked {
+			err = tx.db.locks.wait(ctx, wait.req)
+			if err == nil {
+				continue
+			}
+		}
+		if err == ErrDeadlock {
+			tx.abort()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !readOnly {
+			tx.wrote = true
+		}
+		return result, nil
+	}
+}
+
+// execute runs a statement under the latches it needs. A failed statement
+// leaves no partial changes behind, but the transaction stays open.
+func (tx *Tx) execute(stmt Statement) (*Result, error) {
+	defer tx.db.latch(stmt)()
+	if isDDL(stmt) {
+		tx.ddl = true
+	}
+	for _, name := range statementTables(stmt) {
+		tx.state.reads[name] = true
+	}
+
+	mark := tx.undo.mark()
+	result, err := tx.db.execute(tx, stmt)
+	if err != nil {
+		tx.undo.rollbackTo(mark)
+		return nil, err
+	}
+	return result, nil
+}
+
+// Commit makes the transaction's changes visible and logs them to the
+// write-ahead log. A SERIALIZABLE transaction fails to commit if a table it
+// read was changed by a transaction that committed after its snapshot was
+// taken. If logging fails the changes are rolled back, so memory never runs
+// ahead of disk. With group commit the log is synced only once the changes
+// are visible; a failed sync then leaves the transaction committed, and
+// the log refuses every commit after it.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.closeCursor()
+
+	db := tx.db
+	end, due, err := tx.commit()
+	if err != nil {
+		tx.abort()
+		return err
+	}
+
+	// Maintenance needs the database to itself, so it only starts when
+	// due. The commit is already durable, so a failed checkpoint only
+	// means the log keeps growing until the next one succeeds
+	if due {
+		db.mu.Lock()
+		_ = db.maintain()
+		db.mu.Unlock()
+	}
+	if end == 0 {
+		return nil
+	}
+
+	// With group commit the log is synced outside the latches, so commits
+	// arriving meanwhile can share the fsync. Other transactions may have
+	// read the changes by then, so a failed sync is not this one's error;
+	// the storage engine fails the commits that follow instead
+	_ = db.storage.Sync(end)
+	return nil
+}
+
+// commit logs the transaction's changes and makes them visible, then
+// releases its locks. It returns the position the storage engine still
+// has to sync, or 0, and whether maintenance is due. Commits share mu, so
+// a checkpoint never runs beside one, and take turns on commitMu, so they
+// reach the log in the order of their timestamps. On failure the caller
+// aborts the transaction.
+func (tx *Tx) commit() (int64, bool, error) {
+	db := tx.db
+	m := db.txm
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.commitMu.Lock()
+	defer db.commitMu.Unlock()
+
+	if tx.state.level == Serializable {
+		m.mu.RLock()
+		for _, c := range m.commits {
+			if c.commitTS > tx.state.snapshot && tx.state.snapshot != 0 && overlaps(c.writes, tx.state.reads) {
+				m.mu.RUnlock()
+				return 0, false, ErrSerialization
+			}
+		}
+		m.mu.RUnlock()
+	}
+
+	changes := tx.undo.changes()
+	if !tx.wrote || len(changes) == 0 {
+		m.forget(tx.state, txCommitted)
+		tx.finish()
+		return 0, tx.maintenanceDue(), nil
+	}
+
+	// The engine sees the database as it is once this commit is visible
+	snap := snapshot{mgr: m, ts: m.latest().ts, self: tx.state.id}
+	end, err := db.storage.Commit(db, snap, changes)
+	if err != nil {
+		return 0, false, err
+	}
+	m.mu.Lock()
+	m.clock++
+	tx.state.commitTS = m.clock
+	tx.state.status = txCommitted
+	m.commits = append(m.commits, tx.state)
+	m.mu.Unlock()
+	tx.finish()
+	return end, tx.maintenanceDue(), nil
+}
+
+// maintenanceDue reports whether the transaction should run maintenance
+// once it has committed: when it is due, or after a statement that may
+// have left an index to write out. The caller holds mu, which keeps a
+// checkpoint from changing the storage engine underneath. Checkpoints wait
+// while a cursor is open, so they are not due then.
+func (tx *Tx) maintenanceDue() bool {
+	db := tx.db
+	if db.txm.garbageDue() {
+		return true
+	}
+	return (tx.ddl || db.storage.NeedsCheckpoint()) && !db.txm.pinned()
+}
+
+// maintain collects garbage and checkpoints when they are due, leaving the
+// checkpoint to a later commit while a cursor is open. The caller holds mu
+// exclusive.
+func (db *DB) maintain() (err error) {
+	defer recoverStorage(&err)
+	if db.txm.garbageDue() {
+		db.collectGarbage()
+	}
+	if db.needsCheckpoint() && !db.txm.pinned() {
+		return db.checkpoint()
+	}
+	return nil
+}
+
+// Rollback undoes every change made in the transaction.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.closeCursor()
+	tx.abort()
+	return nil
+}
+
+// abort undoes the transaction and releases its locks.
+func (tx *Tx) abort() {
+	defer tx.latchWrites()()
+	tx.undo.rollbackTo(0)
+	tx.db.txm.forget(tx.state, txAborted)
+	tx.finish()
+}
+
+// latchWrites takes the latches for undoing the transaction's changes: mu
+// exclusive if it changed the catalog, or else each table it changed
+// exclusive.
+func (tx *Tx) latchWrites() func() {
+	db := tx.db
+	if tx.ddl {
+		db.mu.Lock()
+		return db.mu.Unlock
+	}
+	db.mu.RLock()
+	exclusive := make(map[string]bool)
+	for name := range tx.state.writes {
+		exclusive[name] = true
+	}
+	return db.latchTables(exclusive)
+}
+
+// Savepoint marks the current state so it can be returned to with
+// RollbackTo. Savepoints nest; reusing a name shadows the older one.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, mark: tx.undo.mark(), locks: tx.db.locks.mark(tx.state.id)})
+	return nil
+}
+
+// RollbackTo undoes the changes made since the named savepoint and gives
+// up the locks taken since. The savepoint itself stays, and any savepoints created after it are removed.
+func (tx *Tx) RollbackTo(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	i := tx.findSavepoint(name)
+	if i < 0 {
+		return &NotFoundError{Kind: "savepoint", Name: name}
+	}
+
+	tx.closeCursor()
+	defer tx.latchWrites()()
+	tx.undo.rollbackTo(tx.savepoints[i].mark)
+	tx.db.locks.releaseTo(tx.state.id, tx.savepoints[i].locks)
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release forgets the named savepoint and those created after it, keeping
+// their changes.
+func (tx *Tx) Release(name string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	i := tx.findSavepoint(name)
+	if i < 0 {
+		return &NotFoundError{Kind: "savepoint", Name: name}
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+func (tx *Tx) findSavepoint(name string) int {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.undo.entries = nil
+	tx.db.locks.releaseAll(tx.state.id)
+}
+
+func overlaps(a, b map[string]bool) bool {
+	for name := range a {
+		if b[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// isReadOnly reports whether a statement only reads, so it needs no
+// transaction of its own. A SELECT that locks rows does not count.
+func isReadOnly(stmt Statement) bool {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		return s.Lock == lockNone
+	case *ExplainStmt:
+		return true
+	}
+	return false
+}
+
+// isDDL reports whether a statement changes the catalog, so it needs the
+// database to itself.
+func isDDL(stmt Statement) bool {
+	switch stmt.(type) {
+	case *CreateTableStmt, *CreateTypeStmt, *CreateIndexStmt, *DropIndexStmt, *AnalyzeStmt:
+		return true
+	}
+	return false
+}
+
+// writtenTable returns the table a statement changes, or "".
+func writtenTable(stmt Statement) string {
+	switch s := stmt.(type) {
+	case *InsertStmt:
+		return s.Table
+	case *UpdateStmt:
+		return s.Table
+	case *DeleteStmt:
+		return s.Table
+	}
+	return ""
+}
+
+// statementTables lists the tables a statement reads.
+func statementTables(stmt Statement) []string {
+	switch s := stmt.(type) {
+	case *SelectStmt:
+		if s.Join != nil {
+			return []string{s.Table, s.Join.Table}
+		}
+		return []string{s.Table}
+	case *ExplainStmt:
+		return statementTables(s.Query)
+	case *UpdateStmt:
+		return []string{s.Table}
+	case *DeleteStmt:
+		return []string{s.Table}
+	}
+	return nil
+}
+
+// Session runs statements for one client, such as the REPL, and keeps its
+// transaction open between statements. A session made by an Instance can
+// also switch databases and reach the tables of others.
+type Session struct {
+	instance *Instance
+	db       *DB
+	name     string // of db, when the session belongs to an instance
+	tx       *Tx
+	timeout  *time.Duration // set by SET statement_timeout
+}
+
+// NewSession returns a session on db alone, outside any instance.
+func (db *DB) NewSession() *Session {
+	return &Session{db: db}
+}
+
+// InTransaction reports whether the session has an open transaction.
+func (s *Session) InTransaction() bool {
+	return s.tx != nil
+}
+
+// Database returns the name of the database the session uses, or "" if
+// it does not belong to an instance.
+func (s *Session) Database() string {
+	return s.name
+}
+
+// StatementTimeout returns how long a statement of the session may run:
+// what SET statement_timeout last set, or else the database's timeout.
+// Zero means no limit.
+func (s *Session) StatementTimeout() time.Duration {
+	if s.timeout != nil {
+		return *s.timeout
+	}
+	return s.db.timeout
+}
+
+// Exec runs a statement in the session's transaction, or in one of its
+// own, with args bound to its ? placeholders.
+func (s *Session) Exec(query string, args ...interface{}) (*Result, error) {
+	return s.ExecContext(context.Background(), query, args...)
+}
+
+// ExecContext is Exec under ctx: the statement stops with an error once
+// ctx is cancelled or the session's statement timeout runs out.
+func (s *Session) ExecContext(ctx context.Context, query string, args ...interface{}) (*Result, error) {
+	stmt, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := withStatementTimeout(ctx, s.StatementTimeout())
+	defer cancel()
+	return s.run(ctx, stmt)
+}
+
+// Query runs a statement like Exec and returns a cursor over its
+// result. The rows of a SELECT are read as the cursor advances.
+func (s *Session) Query(query string, args ...interface{}) (*Rows, error) {
+	return s.QueryContext(context.Background(), query, args...)
+}
+
+// QueryContext is Query under ctx: reading from the cursor stops with an
+// error once ctx is cancelled or the session's statement timeout runs out.
+func (s *Session) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	stmt, err := prepare(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return openCursor(ctx, s.StatementTimeout(), stmt, s.query, s.run)
+}
+
+func (s *Session) query(ctx context.Context, stmt *SelectStmt) (*Rows, error) {
+	db, err := s.target(stmt)
+	if err != nil {
+		return nil, err
+	}
+	if s.tx != nil {
+		return s.tx.query(ctx, stmt)
+	}
+	return db.query(ctx, stmt)
+}
+
+func (s *Session) run(ctx context.Context, stmt Statement) (*Result, error) {
+	switch st := stmt.(type) {
+	case *CreateDatabaseStmt, *DropDatabaseStmt, *UseStmt, *RestoreStmt:
+		return s.manage(stmt)
+	case *SetStmt:
+		return s.set(st)
+	}
+	db, err := s.target(stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.tx == nil {
+		switch st := stmt.(type) {
+		case *BeginStmt:
+			s.tx = s.db.BeginTx(st.Isolation)
+			return &Result{Message: "BEGIN"}, nil
+		case *CommitStmt, *RollbackStmt, *SavepointStmt, *ReleaseStmt:
+			return nil, fmt.Errorf("no transaction in progress")
+		}
+		return db.run(ctx, stmt)
+	}
+
+	result, err := s.tx.run(ctx, stmt)
+	if s.tx.done {
+		s.tx = nil
+	}
+	return result, err
+}
+
+// set changes a setting of the session. SET ... TO DEFAULT goes back to
+// the database's.
+func (s *Session) set(stmt *SetStmt) (*Result, error) {
+	switch stmt.Name {
+	case "statement_timeout":
+		if stmt.Default {
+			s.timeout = nil
+		} else {
+			timeout := stmt.Timeout
+			s.timeout = &timeout
+		}
+		if t := s.StatementTimeout(); t > 0 {
+			return &Result{Message: fmt.Sprintf("statement_timeout set to %s", t)}, nil
+		}
+		return &Result{Message: "statement_timeout disabled"}, nil
+	}
+	return nil, fmt.Errorf("unrecognized setting %s", stmt.Name)
+}
+
+// Close rolls back any transaction the session left open.
+func (s *Session) Close() {
+	if s.tx != nil {
+		_ = s.tx.Rollback()
+		s.tx = nil
+	}
+	s.leave()
+}
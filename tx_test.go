@@ -0,0 +1,181 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// lockTestContents returns the rows of a as "(id v)" strings, in order.
+func lockTestContents(t *testing.T, db *DB) string {
+	t.Helper()
+	contents := ""
+	for _, row := range mustExec(t, db, "SELECT * FROM a ORDER BY id").Rows {
+		contents += fmt.Sprintf("(%v %v)", row["id"], row["v"])
+	}
+	return contents
+}
+
+func TestSavepoints(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		steps   []string
+		missing string // a last step naming a savepoint that is gone
+		want    string
+	}{
+		{
+			name: "rollback to undoes later writes",
+			steps: []string{
+				"UPDATE a SET v = 1 WHERE id = 1",
+				"SAVEPOINT s",
+				"UPDATE a SET v = 2 WHERE id = 1",
+				"INSERT INTO a (id, v) VALUES (3, 3)",
+				"DELETE FROM a WHERE id = 2",
+				"ROLLBACK TO s",
+			},
+			want: "(1 1)(2 0)",
+		},
+		{
+			name: "savepoint stays after rollback to",
+			steps: []string{
+				"SAVEPOINT s",
+				"UPDATE a SET v = 1 WHERE id = 1",
+				"ROLLBACK TO s",
+				"UPDATE a SET v = 2 WHERE id = 2",
+				"ROLLBACK TO s",
+			},
+			want: "(1 0)(2 0)",
+		},
+		{
+			name: "nested",
+			steps: []string{
+				"SAVEPOINT outer",
+				"UPDATE a SET v = 1 WHERE id = 1",
+				"SAVEPOINT inner",
+				"UPDATE a SET v = 2 WHERE id = 2",
+				"ROLLBACK TO inner",
+				"INSERT INTO a (id, v) VALUES (3, 3)",
+			},
+			want: "(1 1)(2 0)(3 3)",
+		},
+		{
+			name: "rollback to outer forgets inner",
+			steps: []string{
+				"SAVEPOINT outer",
+				"UPDATE a SET v = 1 WHERE id = 1",
+				"SAVEPOINT inner",
+				"UPDATE a SET v = 2 WHERE id = 2",
+				"ROLLBACK TO outer",
+			},
+			missing: "ROLLBACK TO inner",
+			want:    "(1 0)(2 0)",
+		},
+		{
+			name: "reused name shadows",
+			steps: []string{
+				"SAVEPOINT s",
+				"UPDATE a SET v = 1 WHERE id = 1",
+				"SAVEPOINT s",
+				"UPDATE a SET v = 2 WHERE id = 1",
+				"ROLLBACK TO s",
+			},
+			want: "(1 1)(2 0)",
+		},
+		{
+			name: "release keeps changes",
+			steps: []string{
+				"SAVEPOINT outer",
+				"SAVEPOINT inner",
+				"UPDATE a SET v = 1 WHERE id = 1",
+				"RELEASE outer",
+			},
+			missing: "ROLLBACK TO inner",
+			want:    "(1 1)(2 0)",
+		},
+		{
+			name:    "release unknown name",
+			steps:   []string{"UPDATE a SET v = 1 WHERE id = 1"},
+			missing: "RELEASE SAVEPOINT nope",
+			want:    "(1 1)(2 0)",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db := lockTestDB(t)
+			tx := db.Begin()
+			for _, query := range tc.steps {
+				if _, err := tx.Exec(query); err != nil {
+					t.Fatalf("%s: %v", query, err)
+				}
+			}
+			if tc.missing != "" {
+				var notFound *NotFoundError
+				if _, err := tx.Exec(tc.missing); !errors.As(err, &notFound) || notFound.Kind != "savepoint" {
+					t.Fatalf("%s: got %v, want a missing savepoint", tc.missing, err)
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if got := lockTestContents(t, db); got != tc.want {
+				t.Errorf("committed %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestRollbackToReleasesLocks checks that ROLLBACK TO gives up the locks
+// taken after the savepoint, and keeps those taken before it in the mode
+// they had then.
+func TestRollbackToReleasesLocks(t *testing.T) {
+	db := lockTestDB(t)
+	tx := db.Begin()
+	for _, query := range []string{
+		"UPDATE a SET v = 1 WHERE id = 1",
+		"SELECT * FROM a WHERE id = 2 FOR SHARE",
+		"SAVEPOINT s",
+		"UPDATE a SET v = 2 WHERE id = 2",
+		"INSERT INTO a (id, v) VALUES (3, 3)",
+		"ROLLBACK TO s",
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	// Row 2 is back to shared, and row 3 is free
+	other := db.Begin()
+	within(t, func() {
+		for _, query := range []string{
+			"SELECT * FROM a WHERE id = 2 FOR SHARE",
+			"INSERT INTO a (id, v) VALUES (3, 3)",
+		} {
+			if _, err := other.Exec(query); err != nil {
+				t.Errorf("%s: %v", query, err)
+			}
+		}
+	})
+
+	// Row 1 stays locked
+	done := execAsync(other, "UPDATE a SET v = 5 WHERE id = 1")
+	waitForLock(t, db, other)
+	select {
+	case err := <-done:
+		t.Fatalf("UPDATE of a row locked before the savepoint finished early: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	within(t, func() {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	if err := other.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := lockTestContents(t, db); got != "(1 5)(2 0)(3 3)" {
+		t.Errorf("committed %s, want (1 5)(2 0)(3 3)", got)
+	}
+}
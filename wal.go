@@ -0,0 +1,369 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpointSize is how large the write-ahead log may grow before a commit
+// folds it into a new snapshot.
+const checkpointSize = 4 << 20
+
+// Each frame is the payload length, its CRC-32C, then the JSON payload.
+const walFrameHeader = 8
+
+var walCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// Logical changes recorded in the write-ahead log.
+const (
+	walCreateTable = "create_table"
+	walCreateType  = "create_type"
+	walCreateIndex = "create_index"
+	walDropIndex   = "drop_index"
+	walAnalyze     = "analyze"
+	walInsert      = "insert"
+	walDelete      = "delete"
+)
+
+type walChange struct {
+	Op      string      `json:"op"`
+	Table   string      `json:"table,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Row     Row         `json:"row,omitempty"`
+	Columns []Column    `json:"columns,omitempty"`
+	Type    *EnumType   `json:"type,omitempty"`
+	Index   *IndexDef   `json:"index,omitempty"`
+	Stats   *TableStats `json:"stats,omitempty"`
+}
+
+// walRecord holds the changes of one committed transaction. LSNs grow by
+// one per record and are never reused, so a snapshot can tell which
+// records it already contains. Time is when the commit was logged, for
+// reading and recovering the database as of a point in time; logs written
+// before it was recorded lack it.
+type walRecord struct {
+	LSN     uint64      `json:"lsn"`
+	Time    time.Time   `json:"time,omitzero"`
+	Changes []walChange `json:"changes"`
+}
+
+// writeAheadLog is an append-only file of commit records.
+type writeAheadLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	synced int64
+	lsn    uint64
+	time   time.Time // when commit lsn was logged
+	err    error     // set once a sync fails; the log accepts nothing after that
+
+	syncMu      sync.Mutex
+	groupCommit time.Duration
+}
+
+// openWAL opens the log at path and returns the records it holds. A torn
+// or corrupt frame ends the log: it and everything after it is cut off,
+// since it can only come from a commit that never finished.
+func openWAL(path string) (*writeAheadLog, []walRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to read write-ahead log: %v", err)
+	}
+	records, valid := decodeWAL(data)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	if valid < int64(len(data)) {
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to truncate write-ahead log: %v", err)
+		}
+	}
+	if _, err := file.Seek(valid, 0); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	w := &writeAheadLog{file: file, size: valid, synced: valid}
+	if len(records) > 0 {
+		w.lsn = records[len(records)-1].LSN
+		w.time = records[len(records)-1].Time
+	}
+	return w, records, nil
+}
+
+// readWAL returns the records of the log at path without opening it for
+// writing, for a read-only database. A torn frame at the end is ignored,
+// not cut off: it may be a commit another process is writing.
+func readWAL(path string) ([]walRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read write-ahead log: %v", err)
+	}
+	records, _ := decodeWAL(data)
+	return records, nil
+}
+
+// decodeWAL returns the records in data up to the first bad frame, and
+// how many bytes they take.
+func decodeWAL(data []byte) ([]walRecord, int64) {
+	var records []walRecord
+	off := 0
+	for len(data)-off >= walFrameHeader {
+		n := int(binary.LittleEndian.Uint32(data[off:]))
+		sum := binary.LittleEndian.Uint32(data[off+4:])
+		if n > len(data)-off-walFrameHeader {
+			break
+		}
+		payload := data[off+walFrameHeader : off+walFrameHeader+n]
+		if crc32.Checksum(payload, walCRC) != sum {
+			break
+		}
+		var record walRecord
+		if err := unmarshalNumbers(payload, &record); err != nil {
+			break
+		}
+		records = append(records, record)
+		off += walFrameHeader + n
+	}
+	return records, int64(off)
+}
+
+// encodeFrame frames a record for the log.
+func encodeFrame(record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, walFrameHeader+len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload, walCRC))
+	copy(frame[walFrameHeader:], payload)
+	return frame, nil
+}
+
+// write appends a record for changes and returns the log size after it.
+// The record is not durable until sync covers that size.
+func (w *writeAheadLog) write(changes []walChange) (int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	// Times never go back, even if the clock does, so the log stays
+	// ordered by them
+	now := time.Now().UTC()
+	if now.Before(w.time) {
+		now = w.time
+	}
+	frame, err := encodeFrame(walRecord{LSN: w.lsn + 1, Time: now, Changes: changes})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := w.file.Write(frame); err != nil {
+		// Drop whatever part of the frame reached the file
+		if terr := w.file.Truncate(w.size); terr != nil {
+			w.err = fmt.Errorf("write-ahead log is unusable: %v", terr)
+		}
+		_, _ = w.file.Seek(w.size, 0)
+		return 0, fmt.Errorf("failed to write write-ahead log: %v", err)
+	}
+	w.size += int64(len(frame))
+	w.lsn++
+	w.time = now
+	return w.size, nil
+}
+
+// sync returns once the log is on disk up to end. Callers waiting at the
+// same time share one fsync; with group commit the first of them waits a
+// little first so that more commits can join.
+func (w *writeAheadLog) sync(end int64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+
+	w.mu.Lock()
+	synced, err := w.synced, w.err
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if synced >= end {
+		return nil
+	}
+
+	if w.groupCommit > 0 {
+		time.Sleep(w.groupCommit)
+	}
+	w.mu.Lock()
+	size := w.size
+	w.mu.Unlock()
+
+	// After a failed fsync the kernel may have dropped the dirty pages, so
+	// nothing written since the last good sync can be trusted
+	if err := w.file.Sync(); err != nil {
+		w.mu.Lock()
+		w.err = fmt.Errorf("write-ahead log is unusable after failed sync: %v", err)
+		w.mu.Unlock()
+		return w.err
+	}
+	w.mu.Lock()
+	if size > w.synced {
+		w.synced = size
+	}
+	w.mu.Unlock()
+	return nil
+}
+
+// reset empties the log once a checkpoint holds everything in it.
+func (w *writeAheadLog) reset() error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size, w.synced = 0, 0
+	return nil
+}
+
+func (w *writeAheadLog) close() error {
+	return w.file.Close()
+}
+
+// redo applies the changes of a logged commit while loading.
+func (db *DB) redo(record walRecord, deleted map[*Table]map[string][]int) error {
+	for _, c := range record.Changes {
+		if c.Op == walCreateTable {
+			table := newTable(c.Table, c.Columns)
+			table.useTypes(db.types)
+			table.mgr = db.txm
+			db.tables[c.Table] = table
+			continue
+		}
+		if c.Op == walCreateType {
+			db.types[c.Type.Name] = c.Type
+			continue
+		}
+
+		table, exists := db.tables[c.Table]
+		if !exists {
+			return fmt.Errorf("write-ahead log record %d refers to unknown table %s", record.LSN, c.Table)
+		}
+		switch c.Op {
+		case walCreateIndex:
+			if err := table.CreateIndex(c.Index.Name, c.Index.Columns, c.Index.Unique, c.Index.Kind); err != nil {
+				return err
+			}
+		case walDropIndex:
+			if err := table.DropIndex(c.Name); err != nil {
+				return err
+			}
+		case walAnalyze:
+			if err := table.decodeStats(c.Stats); err != nil {
+				return err
+			}
+			table.stats = c.Stats
+		case walInsert:
+			if err := table.decodeRow(c.Row); err != nil {
+				return err
+			}
+			table.redoInsert(table.toTuple(c.Row), deleted[table])
+		case walDelete:
+			if err := table.decodeRow(c.Row); err != nil {
+				return err
+			}
+			if !table.redoDelete(table.toTuple(c.Row), deleted) {
+				return fmt.Errorf("write-ahead log record %d deletes a missing row from %s", record.LSN, c.Table)
+			}
+		default:
+			return fmt.Errorf("write-ahead log record %d has unknown change %s", record.LSN, c.Op)
+		}
+	}
+	return nil
+}
+
+// positionsByRow maps each live row, encoded as JSON, to its positions.
+// Rows have no identity beyond their values, so a logged delete removes
+// any one row equal to the deleted one.
+func (t *Table) positionsByRow() map[string][]int {
+	positions := make(map[string][]int)
+	for i := 0; i < t.rowCount(); i++ {
+		if t.version(i).xmin != abortedTxID {
+			key := rowKey(t.tuple(i))
+			positions[key] = append(positions[key], i)
+		}
+	}
+	return positions
+}
+
+func rowKey(tuple rowTuple) string {
+	data, _ := json.Marshal(tuple)
+	return string(data)
+}
+
+func (t *Table) redoInsert(tuple rowTuple, positions map[string][]int) {
+	i := t.rowCount()
+	t.tuples = append(t.tuples, tuple)
+	t.versions = append(t.versions, &rowVersion{})
+	t.live++
+	for _, index := range t.indexes {
+		index.add(tuple, i)
+	}
+	if positions != nil {
+		key := rowKey(tuple)
+		positions[key] = append(positions[key], i)
+	}
+}
+
+// redoDelete marks a row equal to tuple as gone; Load vacuums it away once
+// the whole log is applied. The row is found through a unique index when
+// it has a key in one, since mapping every row of a large table is slow;
+// otherwise deleted holds the table's map, built on first use.
+func (t *Table) redoDelete(tuple rowTuple, deleted map[*Table]map[string][]int) bool {
+	key := rowKey(tuple)
+	for _, index := range t.indexes {
+		if _, ok := index.key(tuple); !ok || !index.Unique {
+			continue
+		}
+		for _, i := range index.positions(tuple) {
+			if v := t.version(i); v.xmin != abortedTxID && rowKey(t.tuple(i)) == key {
+				t.ownVersion(i).xmin = abortedTxID
+				t.live--
+				return true
+			}
+		}
+		return false
+	}
+
+	if deleted[t] == nil {
+		deleted[t] = t.positionsByRow()
+	}
+	positions := deleted[t]
+	for found := positions[key]; len(found) > 0; found = positions[key] {
+		i := found[len(found)-1]
+		positions[key] = found[:len(found)-1]
+		if v := t.ownVersion(i); v.xmin != abortedTxID {
+			v.xmin = abortedTxID
+			t.live--
+			return true
+		}
+	}
+	return false
+}
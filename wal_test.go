@@ -0,0 +1,146 @@
+package minidb
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWALReplay commits without ever checkpointing and checks that
+// reopening replays every commit from the log.
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minidb.db")
+	storage := NewWALStorage(path)
+	storage.GroupCommit = time.Millisecond
+	db := NewDB(WithStorage(storage))
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := db.Exec("INSERT INTO items (id, name) VALUES (?, 'log')", i); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	mustExec(t, db, "UPDATE items SET name = 'updated' WHERE id = 2")
+	mustExec(t, db, "DELETE FROM items WHERE id > 5")
+	want := crashTestContents(t, db)
+	db.Close()
+
+	reopened := NewDB(WithStorage(NewWALStorage(path)))
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := crashTestContents(t, reopened); got != want {
+		t.Errorf("reopened with %s, want %s", got, want)
+	}
+}
+
+// TestWALTornTail cuts the last frame of the log short, as a crash while
+// writing it would, and checks that reopening drops it and the commits
+// before it survive.
+func TestWALTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "minidb.db")
+	db := crashTestDatabase(t, NewWALStorage(path))
+	want := crashTestContents(t, db)
+	mustExec(t, db, "INSERT INTO items (id, name) VALUES (3, 'torn')")
+	db.Close()
+
+	walPath := filepath.Join(filepath.Dir(path), "minidb.wal")
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, valid := decodeWAL(data)
+	frame, err := encodeFrame(records[len(records)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := valid - int64(len(frame)/2)
+	if err := os.Truncate(walPath, torn); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := NewDB(WithStorage(NewWALStorage(path)))
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := crashTestContents(t, reopened); got != want {
+		t.Errorf("reopened with %s, want %s", got, want)
+	}
+	if info, err := os.Stat(walPath); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != valid-int64(len(frame)) {
+		t.Errorf("log is %d bytes after reopening, want the torn frame cut off at %d", info.Size(), valid-int64(len(frame)))
+	}
+
+	// The log takes new commits where the torn frame was
+	mustExec(t, reopened, "INSERT INTO items (id, name) VALUES (4, 'after')")
+	want = crashTestContents(t, reopened)
+	reopened.Close()
+	reopened = NewDB(WithStorage(NewWALStorage(path)))
+	if err := reopened.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := crashTestContents(t, reopened); got != want {
+		t.Errorf("reopened again with %s, want %s", got, want)
+	}
+}
+
+// TestGroupCommitSyncFailure fails the fsync of a group commit after the
+// transaction is visible, and checks that it stays committed while the
+// commits after it fail.
+func TestGroupCommitSyncFailure(t *testing.T) {
+	storage := NewWALStorage(filepath.Join(t.TempDir(), "minidb.db"))
+	storage.GroupCommit = 200 * time.Millisecond
+	db := NewDB(WithStorage(storage))
+	if err := db.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mustExec(t, db, "CREATE TABLE items (id INT PRIMARY KEY, name STRING)")
+
+	// Close the log once the commit is written, while the sync waits for
+	// more commits to join
+	storage.wal.mu.Lock()
+	size := storage.wal.size
+	storage.wal.mu.Unlock()
+	go func() {
+		for {
+			storage.wal.mu.Lock()
+			if storage.wal.size > size {
+				storage.wal.file.Close()
+				storage.wal.mu.Unlock()
+				return
+			}
+			storage.wal.mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	if _, err := db.Exec("INSERT INTO items (id, name) VALUES (1, 'visible')"); err != nil {
+		t.Fatalf("commit whose sync failed: %v, want it committed", err)
+	}
+	storage.wal.mu.Lock()
+	failed := storage.wal.err != nil
+	storage.wal.mu.Unlock()
+	if !failed {
+		t.Fatal("the sync did not fail")
+	}
+	if _, err := db.Exec("INSERT INTO items (id, name) VALUES (2, 'refused')"); err == nil {
+		t.Error("commit after a failed sync: no error")
+	}
+	if got := crashTestContents(t, db); got != "(1 visible)" {
+		t.Errorf("items holds %s, want only the first commit", got)
+	}
+}